@@ -1,7 +1,10 @@
 package isolator
 
 import (
+	"fmt"
 	"net"
+	"syscall"
+	"time"
 
 	"github.com/outofforest/isolator/wire"
 )
@@ -18,13 +21,50 @@ type Config struct {
 	// Directory where root filesystem exists.
 	Dir string
 
+	// StopSignal is sent to executor when context is canceled. If zero, SIGTERM and SIGINT are sent.
+	StopSignal syscall.Signal
+
+	// StopTimeout is the time given to executor to exit gracefully. Once it passes, executor is killed.
+	// If zero, one minute is used.
+	StopTimeout time.Duration
+
 	// ExposedPorts is the list of ports to expose.
 	ExposedPorts []ExposedPort
 
+	// Resources defines resource limits applied to the executor and all the processes started inside it.
+	Resources Resources
+
+	// StatsInterval is the interval of sending wire.Stats messages to the client. If zero, stats are not sent.
+	StatsInterval time.Duration
+
+	// UIDMappings maps user IDs inside namespace to user IDs on host. If empty, IDs 0-65534 are mapped to the same
+	// IDs on host. In rootless mode root is mapped to the invoking user and other IDs to its ranges in /etc/subuid.
+	UIDMappings []IDMapping
+
+	// GIDMappings maps group IDs inside namespace to group IDs on host. If empty, IDs 0-65534 are mapped to the same
+	// IDs on host. In rootless mode root is mapped to the invoking group and other IDs to its ranges in /etc/subgid.
+	GIDMappings []IDMapping
+
+	// Rootless runs executor without root privileges on host. Mappings are written using newuidmap and newgidmap
+	// tools, so they must be allowed by /etc/subuid and /etc/subgid. Network can't be configured in this mode.
+	Rootless bool
+
 	// Executor stores configuration passed to executor.
 	Executor wire.Config
 }
 
+// IDMapping maps the range of user or group IDs inside namespace to the range of IDs on host.
+type IDMapping struct {
+	ContainerID uint32
+	HostID      uint32
+	Size        uint32
+}
+
+// String returns the string representation of the mapping.
+func (m IDMapping) String() string {
+	return fmt.Sprintf("%d:%d:%d", m.ContainerID, m.HostID, m.Size)
+}
+
 // ExposedPort defines a port to be exposed from the namespace.
 type ExposedPort struct {
 	Protocol     string
@@ -33,3 +73,35 @@ type ExposedPort struct {
 	InternalPort uint16
 	Public       bool
 }
+
+// Resources defines resource limits applied using cgroup v2. If any limit is set or stats are enabled, cgroup is
+// created for the executor and delegated to it.
+type Resources struct {
+	// CgroupParent is the path of the cgroup, relative to the root of cgroup hierarchy, where cgroups of executors
+	// are created. If empty, "isolator" is used.
+	CgroupParent string
+
+	// MemoryMax is the hard limit of memory usage in bytes. Zero means no limit.
+	MemoryMax int64
+
+	// MemoryHigh is the memory usage in bytes above which processes are throttled. Zero means no limit.
+	MemoryHigh int64
+
+	// MemorySwapMax is the limit of swap usage in bytes. Zero means no limit, negative value disables swap.
+	MemorySwapMax int64
+
+	// CPUWeight is the relative share of CPU time, in range 1-10000. Zero means default weight.
+	CPUWeight uint64
+
+	// CPUQuota is the CPU time available within each CPUPeriod. Zero means no limit.
+	CPUQuota time.Duration
+
+	// CPUPeriod is the period used by CPUQuota. Zero means 100ms.
+	CPUPeriod time.Duration
+
+	// PidsMax is the maximum number of processes. Zero means no limit.
+	PidsMax int64
+
+	// IOWeight is the relative share of block IO, in range 1-10000. Zero means default weight.
+	IOWeight uint64
+}
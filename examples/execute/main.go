@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"net"
 	"os"
 
@@ -21,7 +20,8 @@ func main() {
 	run.New().WithFlavour(executor.NewFlavour(executor.Config{
 		// Define commands recognized by the executor server.
 		Router: executor.NewRouter().
-			RegisterHandler(wire.Execute{}, executor.ExecuteHandler),
+			RegisterHandler(wire.Execute{}, executor.ExecuteHandler).
+			RegisterHandler(wire.ExecuteTerminal{}, executor.ExecuteTerminalHandler),
 	})).Run("example", func(ctx context.Context) (retErr error) {
 		log := logger.Get(ctx)
 		rootDir := "/tmp/example-execute"
@@ -47,10 +47,6 @@ func main() {
 		config := isolator.Config{
 			// Directory where container is created, filesystem of container should exist inside "root" directory there
 			Dir: rootDir,
-			Types: []interface{}{
-				wire.Result{},
-				wire.Log{},
-			},
 			Executor: wire.Config{
 				ConfigureSystem: true,
 				IP:              ip,
@@ -99,34 +95,16 @@ func main() {
 		// inside container.
 		// It is assumed that `root` contains `bin/sh` shell and all the required libraries. Without them it will fail.
 
-		return isolator.Run(ctx, config, func(ctx context.Context, incoming <-chan interface{}, outgoing chan<- interface{}) error {
-			// Request to execute command in isolation
-			select {
-			case <-ctx.Done():
-				return errors.WithStack(ctx.Err())
-			case outgoing <- wire.Execute{Command: `hostname && ip a && ip r && curl https://google.com`}:
-			}
-
-			// Communication channel loop
-			for content := range incoming {
-				switch m := content.(type) {
-				// wire.Log contains message printed by executed command to stdout or stderr
-				case wire.Log:
-					if _, err := fmt.Println(string(m.Content)); err != nil {
-						panic(err)
-					}
-				// wire.Result means command finished
-				case wire.Result:
-					if m.Error != "" {
-						panic(errors.Errorf("command failed: %s", m.Error))
-					}
-					return nil
-				default:
-					panic("unexpected message received")
+		// Logs printed by executed command to stdout or stderr are written to os.Stdout.
+		return isolator.RunSession(ctx, config, isolator.LogWriter(os.Stdout),
+			func(ctx context.Context, session *isolator.Session) error {
+				// Request to execute command in isolation and wait until it finishes
+				if _, err := session.Exec(ctx, wire.Execute{
+					Command: `hostname && ip a && ip r && curl https://google.com`,
+				}); err != nil {
+					return errors.Wrap(err, "command failed")
 				}
-			}
-
-			return errors.WithStack(ctx.Err())
-		})
+				return nil
+			})
 	})
 }
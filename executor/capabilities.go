@@ -0,0 +1,186 @@
+package executor
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultCapabilities is the set of capabilities granted to processes if not configured otherwise.
+// It is the same set as the default one used by Docker.
+var DefaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+// allCapabilities is the keyword used to grant all the capabilities.
+const allCapabilities = "ALL"
+
+// capabilities maps names of capabilities to their numbers.
+var capabilities = map[string]uintptr{
+	"CAP_CHOWN":              unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":             unix.CAP_FOWNER,
+	"CAP_FSETID":             unix.CAP_FSETID,
+	"CAP_KILL":               unix.CAP_KILL,
+	"CAP_SETGID":             unix.CAP_SETGID,
+	"CAP_SETUID":             unix.CAP_SETUID,
+	"CAP_SETPCAP":            unix.CAP_SETPCAP,
+	"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"CAP_NET_RAW":            unix.CAP_NET_RAW,
+	"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+	"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"CAP_MKNOD":              unix.CAP_MKNOD,
+	"CAP_LEASE":              unix.CAP_LEASE,
+	"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"CAP_SETFCAP":            unix.CAP_SETFCAP,
+	"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"CAP_SYSLOG":             unix.CAP_SYSLOG,
+	"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+	"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"CAP_PERFMON":            unix.CAP_PERFMON,
+	"CAP_BPF":                unix.CAP_BPF,
+	"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+type privilegesKey struct{}
+
+// privileges defines privileges granted to processes started by the executor.
+type privileges struct {
+	// Capabilities is the set of capabilities kept in bounding and inheritable sets.
+	Capabilities map[uintptr]bool
+
+	// NoNewPrivs prevents processes from gaining privileges using setuid binaries and file capabilities.
+	NoNewPrivs bool
+}
+
+func withPrivileges(ctx context.Context, p privileges) context.Context {
+	return context.WithValue(ctx, privilegesKey{}, p)
+}
+
+func privilegesFromContext(ctx context.Context) (privileges, error) {
+	p, ok := ctx.Value(privilegesKey{}).(privileges)
+	if !ok {
+		return privileges{}, errors.New("privileges are not defined in the context")
+	}
+	return p, nil
+}
+
+// parseCapabilities parses capability names. Names are case-insensitive, CAP_ prefix is optional.
+func parseCapabilities(names []string) (map[uintptr]bool, error) {
+	caps := map[uintptr]bool{}
+	for _, name := range names {
+		name = strings.ToUpper(name)
+		if name == allCapabilities {
+			for _, c := range capabilities {
+				caps[c] = true
+			}
+			continue
+		}
+		if !strings.HasPrefix(name, "CAP_") {
+			name = "CAP_" + name
+		}
+		c, exists := capabilities[name]
+		if !exists {
+			return nil, errors.Errorf("unknown capability %s", name)
+		}
+		caps[c] = true
+	}
+	return caps, nil
+}
+
+// restrictCapabilities returns privileges with capabilities limited to the requested ones. Requested capabilities
+// must be a subset of the capabilities granted to the environment.
+func (p privileges) restrictCapabilities(names []string) (privileges, error) {
+	caps, err := parseCapabilities(names)
+	if err != nil {
+		return privileges{}, err
+	}
+	for name, c := range capabilities {
+		if caps[c] && !p.Capabilities[c] {
+			return privileges{}, errors.Errorf("capability %s is not granted to the environment", name)
+		}
+	}
+	p.Capabilities = caps
+	return p, nil
+}
+
+// apply drops privileges of the current thread, so they are not inherited by processes started from it.
+// Capabilities not granted are dropped from bounding, ambient and inheritable sets. Effective and permitted
+// sets of the thread are not modified, so it may still do its job.
+func (p privileges) apply() error {
+	for c := uintptr(0); ; c++ {
+		// EINVAL is returned once capability is not supported by the kernel.
+		if _, err := unix.PrctlRetInt(unix.PR_CAPBSET_READ, c, 0, 0, 0); err != nil {
+			if errors.Is(err, unix.EINVAL) {
+				break
+			}
+			return errors.WithStack(err)
+		}
+		if p.Capabilities[c] {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, c, 0, 0, 0); err != nil {
+			return errors.Wrapf(err, "dropping capability %d from bounding set failed", c)
+		}
+	}
+
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return errors.WithStack(err)
+	}
+
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return errors.WithStack(err)
+	}
+	for i := range data {
+		data[i].Inheritable = 0
+	}
+	for c := range p.Capabilities {
+		if data[c/32].Permitted&(1<<(c%32)) != 0 {
+			data[c/32].Inheritable |= 1 << (c % 32)
+		}
+	}
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if p.NoNewPrivs {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
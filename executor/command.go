@@ -0,0 +1,117 @@
+package executor
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/isolator/lib/passwd"
+	"github.com/outofforest/isolator/wire"
+)
+
+// newCommand creates the command defined by Execute message.
+func newCommand(m wire.Execute) (*exec.Cmd, error) {
+	args := m.Args
+	if len(args) == 0 {
+		args = []string{"/bin/sh", "-c", m.Command}
+	}
+
+	var creds *passwd.Credentials
+	if m.User != "" || m.Group != "" || len(m.Groups) > 0 {
+		c, err := passwd.Resolve("/", m.User, m.Group, m.Groups)
+		if err != nil {
+			return nil, err
+		}
+		creds = &c
+	}
+
+	names := make([]string, 0, len(m.Env))
+	for name := range m.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	env := os.Environ()
+	// HOME of the executor is replaced by the home directory of the user, unless it is set explicitly.
+	if _, exists := m.Env["HOME"]; !exists && creds != nil {
+		env = append(env, "HOME="+creds.Home)
+	}
+	for _, name := range names {
+		env = append(env, name+"="+m.Env[name])
+	}
+
+	path, err := lookPath(args[0], m.WorkingDir, env)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := &exec.Cmd{
+		Path: path,
+		Args: args,
+		Env:  env,
+		Dir:  m.WorkingDir,
+	}
+
+	if creds != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{
+				Uid:    creds.UID,
+				Gid:    creds.GID,
+				Groups: creds.Groups,
+			},
+		}
+	}
+
+	return cmd, nil
+}
+
+// lookPath searches for the executable in directories listed in PATH variable of the environment.
+// The last definition of the variable wins. Relative paths are resolved against the working directory of the command,
+// and the absolute path is returned.
+func lookPath(file, workingDir string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		return absPath(workingDir, file)
+	}
+
+	var pathVar string
+	for _, v := range env {
+		if value, ok := strings.CutPrefix(v, "PATH="); ok {
+			pathVar = value
+		}
+	}
+
+	for _, dir := range filepath.SplitList(pathVar) {
+		if dir == "" {
+			dir = "."
+		}
+		path, err := absPath(workingDir, filepath.Join(dir, file))
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Stat(path)
+		if err == nil && !info.IsDir() && info.Mode().Perm()&0o111 != 0 {
+			return path, nil
+		}
+	}
+	return "", errors.Errorf("executable %q not found in $PATH", file)
+}
+
+// absPath resolves the path relative to the working directory of the command, which is relative to the working
+// directory of the executor.
+func absPath(workingDir, path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return path, nil
+	}
+	if !filepath.IsAbs(workingDir) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		workingDir = filepath.Join(wd, workingDir)
+	}
+	return filepath.Join(workingDir, path), nil
+}
@@ -0,0 +1,98 @@
+package executor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/isolator/wire"
+)
+
+func TestLookPath(t *testing.T) {
+	workingDir := t.TempDir()
+	binDir := filepath.Join(workingDir, "bin")
+	require.NoError(t, os.Mkdir(binDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "app"), nil, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "data"), nil, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(workingDir, "local"), nil, 0o755))
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	tests := []struct {
+		Name       string
+		File       string
+		WorkingDir string
+		Path       string
+		Expected   string
+	}{
+		{Name: "absolute", File: "/usr/bin/app", WorkingDir: workingDir, Expected: "/usr/bin/app"},
+		{Name: "relative", File: "./bin/app", WorkingDir: workingDir, Expected: filepath.Join(binDir, "app")},
+		{Name: "noWorkingDir", File: "./app", Expected: filepath.Join(wd, "app")},
+		{Name: "absolutePath", File: "app", Path: "/nonexistent:" + binDir, Expected: filepath.Join(binDir, "app")},
+		{Name: "relativePath", File: "app", WorkingDir: workingDir, Path: "bin", Expected: filepath.Join(binDir, "app")},
+		{
+			Name:       "emptyPath",
+			File:       "local",
+			WorkingDir: workingDir,
+			Path:       ":bin",
+			Expected:   filepath.Join(workingDir, "local"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			path, err := lookPath(test.File, test.WorkingDir, []string{"PATH=/nonexistent", "PATH=" + test.Path})
+			require.NoError(t, err)
+			assert.Equal(t, test.Expected, path)
+		})
+	}
+}
+
+func TestLookPathNotFound(t *testing.T) {
+	binDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "data"), nil, 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(binDir, "dir"), 0o755))
+
+	for _, file := range []string{"missing", "data", "dir"} {
+		t.Run(file, func(t *testing.T) {
+			_, err := lookPath(file, "", []string{"PATH=" + binDir})
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestNewCommandHome(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Env      map[string]string
+		Expected string
+	}{
+		// UID not existing in passwd file gets root directory as home.
+		{Name: "default", Expected: "/"},
+		{Name: "explicit", Env: map[string]string{"HOME": "/home/app"}, Expected: "/home/app"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			cmd, err := newCommand(wire.Execute{
+				Args: []string{"/bin/true"},
+				Env:  test.Env,
+				User: "4000000",
+			})
+			require.NoError(t, err)
+
+			var home string
+			for _, v := range cmd.Env {
+				if value, ok := strings.CutPrefix(v, "HOME="); ok {
+					home = value
+				}
+			}
+			assert.Equal(t, test.Expected, home)
+		})
+	}
+}
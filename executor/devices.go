@@ -0,0 +1,196 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/outofforest/isolator/lib/cgroup"
+	"github.com/outofforest/isolator/wire"
+)
+
+// Standard devices which don't correspond to single device node.
+const (
+	deviceShm = "shm"
+	devicePts = "pts"
+)
+
+// defaultShmSize is the size limit of /dev/shm used if not configured otherwise.
+const defaultShmSize = 64 * 1024 * 1024
+
+// DefaultDevices is the set of standard devices created in /dev if not configured otherwise.
+var DefaultDevices = []string{
+	"console",
+	"null",
+	"zero",
+	"full",
+	"random",
+	"urandom",
+	"tty",
+	deviceShm,
+	devicePts,
+}
+
+// standardDevices maps names of standard devices to the rules granting access to them.
+var standardDevices = map[string][]cgroup.DeviceRule{
+	"console": {{Type: cgroup.DeviceChar, Major: 5, Minor: 1, Access: "rw"}},
+	"null":    {{Type: cgroup.DeviceChar, Major: 1, Minor: 3, Access: "rw"}},
+	"zero":    {{Type: cgroup.DeviceChar, Major: 1, Minor: 5, Access: "rw"}},
+	"full":    {{Type: cgroup.DeviceChar, Major: 1, Minor: 7, Access: "rw"}},
+	"random":  {{Type: cgroup.DeviceChar, Major: 1, Minor: 8, Access: "rw"}},
+	"urandom": {{Type: cgroup.DeviceChar, Major: 1, Minor: 9, Access: "rw"}},
+	"tty":     {{Type: cgroup.DeviceChar, Major: 5, Minor: 0, Access: "rw"}},
+	deviceShm: nil,
+	// Pseudo-terminals use 8 major numbers starting from 136, ptmx multiplexer is 5:2.
+	devicePts: {
+		{Type: cgroup.DeviceChar, Major: 5, Minor: 2, Access: "rw"},
+		{Type: cgroup.DeviceChar, Major: 136, Minor: cgroup.AnyDevice, Access: "rw"},
+		{Type: cgroup.DeviceChar, Major: 137, Minor: cgroup.AnyDevice, Access: "rw"},
+		{Type: cgroup.DeviceChar, Major: 138, Minor: cgroup.AnyDevice, Access: "rw"},
+		{Type: cgroup.DeviceChar, Major: 139, Minor: cgroup.AnyDevice, Access: "rw"},
+		{Type: cgroup.DeviceChar, Major: 140, Minor: cgroup.AnyDevice, Access: "rw"},
+		{Type: cgroup.DeviceChar, Major: 141, Minor: cgroup.AnyDevice, Access: "rw"},
+		{Type: cgroup.DeviceChar, Major: 142, Minor: cgroup.AnyDevice, Access: "rw"},
+		{Type: cgroup.DeviceChar, Major: 143, Minor: cgroup.AnyDevice, Access: "rw"},
+	},
+}
+
+// DeviceRules returns rules of the device filter allowing access to the devices created by the executor only.
+// It must be called on host, because numbers of host devices are taken from their nodes.
+func DeviceRules(config wire.Config) ([]cgroup.DeviceRule, error) {
+	devices := config.Devices
+	if devices == nil {
+		devices = DefaultDevices
+	}
+
+	// Null device is always allowed, because it is opened by the executor to start commands.
+	rules := append([]cgroup.DeviceRule{}, standardDevices["null"]...)
+	for _, dev := range devices {
+		devRules, exists := standardDevices[dev]
+		if !exists {
+			return nil, errors.Errorf("unknown device %q", dev)
+		}
+		rules = append(rules, devRules...)
+	}
+
+	for _, d := range config.HostDevices {
+		var stat unix.Stat_t
+		if err := unix.Stat(d.Host, &stat); err != nil {
+			return nil, errors.Wrapf(err, "reading device %s failed", d.Host)
+		}
+
+		rule := cgroup.DeviceRule{
+			Major:  int64(unix.Major(stat.Rdev)),
+			Minor:  int64(unix.Minor(stat.Rdev)),
+			Access: d.Permissions,
+		}
+		switch stat.Mode & unix.S_IFMT {
+		case unix.S_IFCHR:
+			rule.Type = cgroup.DeviceChar
+		case unix.S_IFBLK:
+			rule.Type = cgroup.DeviceBlock
+		default:
+			return nil, errors.Errorf("%s is not a device", d.Host)
+		}
+		if rule.Access == "" {
+			rule.Access = "rw"
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func populateDev(devices []string, shmSize int64, hostDevices []wire.HostDevice) error {
+	devDir := "dev"
+	if err := os.Mkdir(devDir, 0o755); err != nil && !os.IsExist(err) {
+		return errors.WithStack(err)
+	}
+	if err := syscall.Mount("none", devDir, "tmpfs", 0, ""); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, dev := range devices {
+		var err error
+		switch dev {
+		case deviceShm:
+			err = mountShm(filepath.Join(devDir, dev), shmSize)
+		case devicePts:
+			err = mountPts(devDir)
+		default:
+			if _, exists := standardDevices[dev]; !exists {
+				return errors.Errorf("unknown device %q", dev)
+			}
+			err = bindDevice(filepath.Join("/", devDir, dev), filepath.Join(devDir, dev))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, d := range hostDevices {
+		namespace := d.Namespace
+		if namespace == "" {
+			namespace = d.Host
+		}
+		// force path in container should be relative to the new filesystem to prevent hacks (we haven't pivoted yet)
+		if err := bindDevice(d.Host, filepath.Join(".", namespace)); err != nil {
+			return err
+		}
+	}
+	links := map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "fd/0",
+		"stdout": "fd/1",
+		"stderr": "fd/2",
+	}
+	for newName, oldName := range links {
+		if err := os.Symlink(oldName, devDir+"/"+newName); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func bindDevice(host, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0o644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := syscall.Mount(host, target, "", syscall.MS_BIND|syscall.MS_PRIVATE, ""); err != nil {
+		return errors.Wrapf(err, "binding device %s failed", host)
+	}
+	return nil
+}
+
+func mountShm(target string, size int64) error {
+	if size == 0 {
+		size = defaultShmSize
+	}
+
+	if err := os.Mkdir(target, 0o777|os.ModeSticky); err != nil && !os.IsExist(err) {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(syscall.Mount("shm", target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC,
+		fmt.Sprintf("mode=1777,size=%d", size)))
+}
+
+func mountPts(devDir string) error {
+	// New instance of devpts is mounted, so pseudo-terminals allocated inside namespace are not visible on host.
+	ptsDir := filepath.Join(devDir, devicePts)
+	if err := os.Mkdir(ptsDir, 0o755); err != nil && !os.IsExist(err) {
+		return errors.WithStack(err)
+	}
+	if err := syscall.Mount("devpts", ptsDir, "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC,
+		"newinstance,ptmxmode=0666,mode=0620"); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Symlink("pts/ptmx", filepath.Join(devDir, "ptmx")))
+}
@@ -3,6 +3,7 @@ package executor
 import (
 	"context"
 	"os/exec"
+	"syscall"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
@@ -10,7 +11,6 @@ import (
 	"github.com/outofforest/isolator/lib/docker"
 	"github.com/outofforest/isolator/lib/libhttp"
 	"github.com/outofforest/isolator/wire"
-	"github.com/outofforest/libexec"
 	"github.com/outofforest/logger"
 )
 
@@ -29,6 +29,7 @@ func NewInflateDockerImageHandler() HandlerFunc {
 			CacheDir:   m.CacheDir,
 			Image:      m.Image,
 			Tag:        m.Tag,
+			LayersDir:  m.LayersDir,
 		})
 	}
 }
@@ -53,9 +54,19 @@ func RunDockerContainerHandler(ctx context.Context, content interface{}, encode
 		WorkingDir: m.WorkingDir,
 		Entrypoint: m.Entrypoint,
 		Args:       m.Args,
+		StopSignal: m.StopSignal,
 
 		StdOut: stdOut,
 		StdErr: stdErr,
+		Exec: func(ctx context.Context, cmd *exec.Cmd, stopSignal syscall.Signal) error {
+			return execCommand(ctx, cmd, execConfig{
+				Stdin:        m.Stdin,
+				StopSignal:   stopSignal,
+				StopTimeout:  m.StopTimeout,
+				Capabilities: m.Capabilities,
+				Rlimits:      m.Rlimits,
+			})
+		},
 	})
 }
 
@@ -98,14 +109,21 @@ func ExecuteHandler(ctx context.Context, content interface{}, encode wire.Encode
 	outTransmitter := newLogTransmitter(encode)
 	errTransmitter := newLogTransmitter(encode)
 
-	cmd := exec.Command("/bin/sh", "-c", m.Command)
+	cmd, err := newCommand(m)
+	if err != nil {
+		return err
+	}
 	cmd.Stdout = outTransmitter
 	cmd.Stderr = errTransmitter
 
 	log := logger.Get(ctx)
 	log.Info("Starting command")
 
-	if err := libexec.Exec(ctx, cmd); err != nil {
+	if err := execCommand(ctx, cmd, execConfig{
+		Stdin:        m.Stdin,
+		Capabilities: m.Capabilities,
+		Rlimits:      m.Rlimits,
+	}); err != nil {
 		log.Error("Command exited with error", zap.Error(err))
 		return err
 	}
@@ -0,0 +1,159 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/isolator/wire"
+)
+
+// propagationFlags maps propagation modes to mount flags.
+var propagationFlags = map[wire.Propagation]uintptr{
+	"":                       syscall.MS_PRIVATE,
+	wire.PropagationPrivate:  syscall.MS_PRIVATE,
+	wire.PropagationRPrivate: syscall.MS_PRIVATE | syscall.MS_REC,
+	wire.PropagationSlave:    syscall.MS_SLAVE,
+	wire.PropagationRSlave:   syscall.MS_SLAVE | syscall.MS_REC,
+	wire.PropagationShared:   syscall.MS_SHARED,
+	wire.PropagationRShared:  syscall.MS_SHARED | syscall.MS_REC,
+}
+
+func applyMounts(mounts []wire.Mount) error {
+	for _, m := range mounts {
+		// force path in container should be relative to the new filesystem to prevent hacks (we haven't pivoted yet)
+		if err := mount(m, filepath.Join(".", m.Namespace)); err != nil {
+			return errors.Wrapf(err, "mounting %s failed", m.Namespace)
+		}
+	}
+	return nil
+}
+
+func mount(m wire.Mount, target string) error {
+	propagation, exists := propagationFlags[m.Propagation]
+	if !exists {
+		return errors.Errorf("unsupported propagation %q", m.Propagation)
+	}
+
+	flags := mountFlags(m)
+	switch m.Type {
+	case "", wire.MountBind, wire.MountRBind:
+		info, err := os.Stat(m.Host)
+		if err != nil {
+			if m.SkipMissing && errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		if err := createMountpoint(target, info); err != nil {
+			return err
+		}
+
+		bindFlags := uintptr(syscall.MS_BIND)
+		if m.Type == wire.MountRBind {
+			bindFlags |= syscall.MS_REC
+		}
+		if err := syscall.Mount(m.Host, target, "", bindFlags, ""); err != nil {
+			return errors.WithStack(err)
+		}
+
+		// Flags are ignored when bind mount is created, so remount is required to apply them.
+		if flags != 0 {
+			if err := remount(target, flags); err != nil {
+				return err
+			}
+		}
+	case wire.MountTmpfs:
+		var options []string
+		if m.TmpfsSize > 0 {
+			options = append(options, fmt.Sprintf("size=%d", m.TmpfsSize))
+		}
+		if m.TmpfsMode != 0 {
+			options = append(options, fmt.Sprintf("mode=%o", m.TmpfsMode.Perm()))
+		}
+		if err := mountFS(target, "tmpfs", flags, strings.Join(options, ",")); err != nil {
+			return err
+		}
+	case wire.MountOverlay:
+		if len(m.OverlayLower) == 0 {
+			return errors.New("overlay requires at least one lower directory")
+		}
+		if (m.OverlayUpper == "") != (m.OverlayWork == "") {
+			return errors.New("overlay requires both upper and work directories to be set")
+		}
+
+		// Inside user namespace extended attributes of overlay can't be stored in the trusted namespace.
+		options := []string{"lowerdir=" + strings.Join(m.OverlayLower, ":"), "userxattr"}
+		if m.OverlayUpper != "" {
+			options = append(options, "upperdir="+m.OverlayUpper, "workdir="+m.OverlayWork)
+		}
+		if err := mountFS(target, "overlay", flags, strings.Join(options, ",")); err != nil {
+			return err
+		}
+	case wire.MountProc, wire.MountSysfs, wire.MountMqueue:
+		if err := mountFS(target, string(m.Type), flags, ""); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("unsupported mount type %q", m.Type)
+	}
+
+	return errors.WithStack(syscall.Mount("", target, "", propagation, ""))
+}
+
+// mountFlags returns flags of the mount. Bind and overlay mounts expose content of the host, so they are read-only
+// unless they are writable explicitly. Other filesystems are created for the container, so they are writable unless
+// they are read-only explicitly.
+func mountFlags(m wire.Mount) uintptr {
+	var flags uintptr
+	if m.NoSuid {
+		flags |= syscall.MS_NOSUID
+	}
+	if m.NoDev {
+		flags |= syscall.MS_NODEV
+	}
+	if m.NoExec {
+		flags |= syscall.MS_NOEXEC
+	}
+
+	switch m.Type {
+	case "", wire.MountBind, wire.MountRBind, wire.MountOverlay:
+		if !m.Writable {
+			flags |= syscall.MS_RDONLY
+		}
+	default:
+		if m.ReadOnly {
+			flags |= syscall.MS_RDONLY
+		}
+	}
+	return flags
+}
+
+func mountFS(target, fsType string, flags uintptr, options string) error {
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(syscall.Mount(fsType, target, fsType, flags, options))
+}
+
+func createMountpoint(target string, info os.FileInfo) error {
+	if info.IsDir() {
+		return errors.WithStack(os.MkdirAll(target, 0o700))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, info.Mode())
+	if err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.Close())
+}
@@ -0,0 +1,58 @@
+package executor
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/isolator/wire"
+)
+
+func TestMountFlags(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Mount    wire.Mount
+		Expected uintptr
+	}{
+		{Name: "bind", Mount: wire.Mount{}, Expected: syscall.MS_RDONLY},
+		{Name: "bindWritable", Mount: wire.Mount{Type: wire.MountBind, Writable: true}},
+		{Name: "rbind", Mount: wire.Mount{Type: wire.MountRBind}, Expected: syscall.MS_RDONLY},
+		{Name: "overlay", Mount: wire.Mount{Type: wire.MountOverlay}, Expected: syscall.MS_RDONLY},
+		{Name: "overlayWritable", Mount: wire.Mount{Type: wire.MountOverlay, Writable: true}},
+		{Name: "tmpfs", Mount: wire.Mount{Type: wire.MountTmpfs}},
+		{Name: "tmpfsReadOnly", Mount: wire.Mount{Type: wire.MountTmpfs, ReadOnly: true}, Expected: syscall.MS_RDONLY},
+		{Name: "proc", Mount: wire.Mount{Type: wire.MountProc}},
+		{Name: "mqueue", Mount: wire.Mount{Type: wire.MountMqueue}},
+		{
+			Name:     "flags",
+			Mount:    wire.Mount{Type: wire.MountTmpfs, NoSuid: true, NoDev: true, NoExec: true},
+			Expected: syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			assert.Equal(t, test.Expected, mountFlags(test.Mount))
+		})
+	}
+}
+
+func TestMountTmpfsWritable(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "tmp")
+	if err := mount(wire.Mount{Type: wire.MountTmpfs}, target); err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			t.Skip("mounting requires privileges")
+		}
+		require.NoError(t, err)
+	}
+	t.Cleanup(func() {
+		require.NoError(t, syscall.Unmount(target, 0))
+	})
+
+	require.NoError(t, os.WriteFile(filepath.Join(target, "file"), []byte("data"), 0o600))
+}
@@ -0,0 +1,159 @@
+package executor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultMaskedPaths is the list of paths hidden inside namespace if not configured otherwise.
+// It follows the defaults of OCI runtimes.
+var DefaultMaskedPaths = []string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/proc/sysrq-trigger",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/sys/devices/virtual/powercap",
+	"/sys/firmware",
+}
+
+// DefaultReadOnlyPaths is the list of paths made read-only inside namespace if not configured otherwise.
+var DefaultReadOnlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+}
+
+// Flags of mount returned by statfs. They are not defined in unix package.
+const (
+	stNoSuid     = 0x2
+	stNoDev      = 0x4
+	stNoExec     = 0x8
+	stNoAtime    = 0x400
+	stNoDirAtime = 0x800
+	stRelAtime   = 0x1000
+)
+
+// mountInfoUnescaper decodes characters escaped in /proc/self/mountinfo.
+var mountInfoUnescaper = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// preservedFlags maps flags reported by statfs to mount flags which must be preserved on remount. Kernel refuses
+// to clear the ones locked by the parent user namespace.
+var preservedFlags = map[int64]uintptr{
+	stNoSuid:     syscall.MS_NOSUID,
+	stNoDev:      syscall.MS_NODEV,
+	stNoExec:     syscall.MS_NOEXEC,
+	stNoAtime:    syscall.MS_NOATIME,
+	stNoDirAtime: syscall.MS_NODIRATIME,
+	stRelAtime:   syscall.MS_RELATIME,
+}
+
+// maskPaths hides paths inside namespace. Directories are covered by empty read-only tmpfs and files by /dev/null.
+// Paths which don't exist are skipped. It must be called after pivoting, so paths are resolved inside new root.
+func maskPaths(paths []string) error {
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return errors.WithStack(err)
+		}
+
+		if info.IsDir() {
+			if err := syscall.Mount("none", p, "tmpfs", syscall.MS_RDONLY, ""); err != nil {
+				return errors.Wrapf(err, "masking %s failed", p)
+			}
+			continue
+		}
+		if err := syscall.Mount("/dev/null", p, "", syscall.MS_BIND, ""); err != nil {
+			return errors.Wrapf(err, "masking %s failed", p)
+		}
+	}
+	return nil
+}
+
+// makeReadOnly makes paths read-only inside namespace by binding them to themselves and remounting read-only.
+// Paths which don't exist are skipped. It must be called after pivoting, so paths are resolved inside new root.
+func makeReadOnly(paths []string) error {
+	for _, p := range paths {
+		if _, err := os.Stat(p); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return errors.WithStack(err)
+		}
+
+		if err := syscall.Mount(p, p, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return errors.Wrapf(err, "binding %s failed", p)
+		}
+		if err := remountReadOnly(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remountReadOnly remounts existing mount read-only, preserving its other flags.
+func remountReadOnly(path string) error {
+	return remount(path, syscall.MS_RDONLY)
+}
+
+// remountReadOnlyRecursive remounts the mount and all the mounts below it read-only.
+func remountReadOnlyRecursive(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	content, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Parents are listed before their children, so they are remounted first.
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		mountPoint := mountInfoUnescaper.Replace(fields[4])
+		if mountPoint != path && !strings.HasPrefix(mountPoint, path+"/") {
+			continue
+		}
+		if err := remountReadOnly(mountPoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remount adds flags to the existing mount, preserving its other flags.
+func remount(path string, flags uintptr) error {
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(path, &statfs); err != nil {
+		return errors.WithStack(err)
+	}
+
+	flags |= syscall.MS_BIND | syscall.MS_REMOUNT
+	for st, ms := range preservedFlags {
+		if int64(statfs.Flags)&st != 0 {
+			flags |= ms
+		}
+	}
+	if err := syscall.Mount("", path, "", flags, ""); err != nil {
+		return errors.Wrapf(err, "remounting %s failed", path)
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+package executor
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+
+	"github.com/outofforest/isolator/initprocess"
+	"github.com/outofforest/isolator/wire"
+	"github.com/outofforest/logger"
+	"github.com/outofforest/parallel"
+)
+
+// defaultStopTimeout is the time given to the process to exit after receiving the stop signal.
+const defaultStopTimeout = 10 * time.Second
+
+type requestKey struct{}
+
+// request stores the state of running request.
+type request struct {
+	stdin *inputBuffer
+
+	mu       sync.Mutex
+	proc     *os.Process
+	process  *wire.ProcessState
+	terminal *terminal
+}
+
+func newRequest() *request {
+	return &request{
+		stdin: newInputBuffer(),
+	}
+}
+
+func withRequest(ctx context.Context, r *request) context.Context {
+	return context.WithValue(ctx, requestKey{}, r)
+}
+
+func requestFromContext(ctx context.Context) *request {
+	r, _ := ctx.Value(requestKey{}).(*request)
+	return r
+}
+
+func (r *request) setProcess(process *wire.ProcessState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.process = process
+}
+
+func (r *request) processState() *wire.ProcessState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.process
+}
+
+func (r *request) setProc(proc *os.Process) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.proc = proc
+}
+
+func (r *request) signal(sig syscall.Signal, group bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.proc == nil {
+		return errors.New("no process is running in the request")
+	}
+	if group {
+		// Process is always started as the leader of its own process group.
+		return errors.WithStack(syscall.Kill(-r.proc.Pid, sig))
+	}
+	return errors.WithStack(r.proc.Signal(sig))
+}
+
+func (r *request) setTerminal(term *terminal) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.terminal = term
+}
+
+func (r *request) resizeTerminal(rows, cols uint16) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.terminal == nil {
+		return errors.New("no terminal is attached to the request")
+	}
+	return r.terminal.Resize(rows, cols)
+}
+
+// execConfig defines how command is executed.
+type execConfig struct {
+	// Stdin connects standard input of the command to the data streamed by the client.
+	Stdin bool
+
+	// Terminal is the pseudo-terminal attached to the command. Data streamed by the client are written to it.
+	Terminal *terminal
+
+	// TerminalOutput receives raw data printed by the command to the terminal.
+	TerminalOutput io.Writer
+
+	// StopSignal is sent to the process when request is canceled. If zero, SIGTERM is used.
+	StopSignal syscall.Signal
+
+	// StopTimeout is the time given to the process to exit after receiving the stop signal. Once it passes,
+	// process is killed. If zero, defaultStopTimeout is used.
+	StopTimeout time.Duration
+
+	// Capabilities is the set of capabilities granted to the process. If nil, capabilities of the environment are
+	// granted.
+	Capabilities []string
+
+	// Rlimits is the list of resource limits set for the process.
+	Rlimits []wire.Rlimit
+}
+
+// execCommand runs the command and reports the state of exited process in the result of the request.
+func execCommand(ctx context.Context, cmd *exec.Cmd, config execConfig) error {
+	r := requestFromContext(ctx)
+	if r == nil {
+		return errors.New("command must be executed in the context of the request")
+	}
+
+	privs, err := privilegesFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	if config.Capabilities != nil {
+		privs, err = privs.restrictCapabilities(config.Capabilities)
+		if err != nil {
+			return err
+		}
+	}
+	limits, err := parseRlimits(config.Rlimits)
+	if err != nil {
+		return err
+	}
+
+	if config.StopSignal == 0 {
+		config.StopSignal = syscall.SIGTERM
+	}
+	if config.StopTimeout == 0 {
+		config.StopTimeout = defaultStopTimeout
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if !cmd.SysProcAttr.Setsid {
+		// New session makes the process the group leader already.
+		cmd.SysProcAttr.Setpgid = true
+	}
+
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		var stdinR, stdinW *os.File
+		if config.Stdin {
+			var err error
+			stdinR, stdinW, err = os.Pipe()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			cmd.Stdin = stdinR
+
+			spawn("stdin", parallel.Continue, func(ctx context.Context) error {
+				defer stdinW.Close()
+
+				// Error is ignored because it means that process closed its standard input or exited.
+				_, _ = io.Copy(stdinW, r.stdin)
+				return nil
+			})
+		}
+
+		if config.Terminal != nil {
+			r.setTerminal(config.Terminal)
+			defer r.setTerminal(nil)
+
+			spawn("terminal.input", parallel.Continue, func(ctx context.Context) error {
+				// Errors are ignored because they mean that terminal has been closed.
+				_, _ = io.Copy(config.Terminal.master, r.stdin)
+				_, _ = config.Terminal.master.Write([]byte{endOfTransmission})
+				return nil
+			})
+			spawn("terminal.output", parallel.Continue, func(ctx context.Context) error {
+				_, err := io.Copy(config.TerminalOutput, config.Terminal.master)
+				// EIO is returned once all the processes using the terminal exit.
+				if err != nil && !errors.Is(err, syscall.EIO) && !errors.Is(err, os.ErrDeadlineExceeded) &&
+					!errors.Is(err, os.ErrClosed) {
+					return errors.WithStack(err)
+				}
+				return nil
+			})
+		}
+
+		spawn("command", parallel.Exit, func(ctx context.Context) error {
+			defer func() {
+				// Once command exits, nobody is going to consume the standard input anymore.
+				_ = r.stdin.Close()
+				if stdinR != nil {
+					_ = stdinR.Close()
+				}
+				if config.Terminal != nil {
+					// Output left in the terminal is still transmitted, but processes started in the background
+					// must not keep the request running forever.
+					_ = config.Terminal.slave.Close()
+					_ = config.Terminal.master.SetDeadline(time.Now().Add(time.Second))
+				}
+			}()
+
+			return runProcess(ctx, r, cmd, privs, limits, config.StopSignal, config.StopTimeout)
+		})
+
+		return nil
+	})
+}
+
+// runProcess starts the process and waits until it exits. When context is canceled, stop signal is sent to
+// the process and if it does not exit within the stop timeout, it is killed.
+// Process is started and awaited using the init process, so its exit status is not consumed by the reaper.
+func runProcess(
+	ctx context.Context,
+	r *request,
+	cmd *exec.Cmd,
+	privs privileges,
+	limits map[int]unix.Rlimit,
+	stopSignal syscall.Signal,
+	stopTimeout time.Duration,
+) error {
+	// Privileges are dropped on the thread starting the process only. Thread is never unlocked, so it is terminated
+	// once goroutine exits, instead of being reused by other goroutines.
+	runtime.LockOSThread()
+	if err := privs.apply(); err != nil {
+		return err
+	}
+
+	startTime := time.Now().UTC()
+	if err := startProcess(ctx, cmd, limits); err != nil {
+		return err
+	}
+	r.setProc(cmd.Process)
+
+	exitedCh := make(chan struct{})
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("wait", parallel.Exit, func(ctx context.Context) error {
+			defer close(exitedCh)
+
+			exit, err := initprocess.Wait(ctx, cmd)
+			// Once process is awaited, its PID might be reused, so signals can't be delivered anymore.
+			r.setProc(nil)
+			if err != nil {
+				return err
+			}
+
+			r.setProcess(newProcessState(exit, startTime, time.Now().UTC()))
+			return exitError(exit.Status)
+		})
+		spawn("watchdog", parallel.Continue, func(ctx context.Context) error {
+			<-ctx.Done()
+			select {
+			case <-exitedCh:
+				return nil
+			default:
+			}
+
+			log := logger.Get(ctx)
+			log.Info("Stopping process", zap.Stringer("signal", stopSignal))
+
+			if err := r.signal(stopSignal, false); err != nil {
+				return nil
+			}
+
+			select {
+			case <-exitedCh:
+			case <-time.After(stopTimeout):
+				log.Warn("Process didn't exit in time, killing it")
+				_ = r.signal(syscall.SIGKILL, true)
+			}
+			return nil
+		})
+
+		return nil
+	})
+}
+
+func exitError(status syscall.WaitStatus) error {
+	switch {
+	case status.Signaled():
+		return errors.Errorf("process terminated by signal: %s", status.Signal())
+	case status.ExitStatus() != 0:
+		return errors.Errorf("process exited with status %d", status.ExitStatus())
+	default:
+		return nil
+	}
+}
+
+func newProcessState(exit initprocess.Exit, startTime, endTime time.Time) *wire.ProcessState {
+	process := &wire.ProcessState{
+		ExitCode:   exit.Status.ExitStatus(),
+		StartTime:  startTime,
+		EndTime:    endTime,
+		UserTime:   time.Duration(exit.Rusage.Utime.Nano()),
+		SystemTime: time.Duration(exit.Rusage.Stime.Nano()),
+		// on linux ru_maxrss is expressed in kilobytes
+		MaxRSS: exit.Rusage.Maxrss * 1024,
+	}
+	if exit.Status.Signaled() {
+		process.Signal = exit.Status.Signal()
+		process.CoreDumped = exit.Status.CoreDump()
+	}
+	return process
+}
+
+func newInputBuffer() *inputBuffer {
+	return &inputBuffer{
+		notifyCh: make(chan struct{}, 1),
+	}
+}
+
+// inputBuffer stores data received from the client until they are consumed by the single reader.
+// Writes never block, so receiving messages for other requests is not affected by the slow reader.
+type inputBuffer struct {
+	notifyCh chan struct{}
+
+	mu     sync.Mutex
+	buf    []byte
+	closed bool
+}
+
+func (b *inputBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return 0, errors.WithStack(io.ErrClosedPipe)
+	}
+	b.buf = append(b.buf, data...)
+	b.mu.Unlock()
+
+	b.notify()
+	return len(data), nil
+}
+
+func (b *inputBuffer) Read(data []byte) (int, error) {
+	for {
+		b.mu.Lock()
+		if len(b.buf) > 0 {
+			n := copy(data, b.buf)
+			b.buf = b.buf[n:]
+			b.mu.Unlock()
+			return n, nil
+		}
+		closed := b.closed
+		b.mu.Unlock()
+
+		if closed {
+			return 0, io.EOF
+		}
+		<-b.notifyCh
+	}
+}
+
+func (b *inputBuffer) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+
+	b.notify()
+	return nil
+}
+
+func (b *inputBuffer) notify() {
+	select {
+	case b.notifyCh <- struct{}{}:
+	default:
+	}
+}
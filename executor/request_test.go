@@ -0,0 +1,117 @@
+package executor
+
+import (
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/isolator/initprocess"
+	"github.com/outofforest/isolator/wire"
+)
+
+func TestNewProcessState(t *testing.T) {
+	startTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	endTime := startTime.Add(time.Second)
+	rusage := syscall.Rusage{
+		Utime:  syscall.Timeval{Sec: 1, Usec: 500},
+		Stime:  syscall.Timeval{Usec: 200},
+		Maxrss: 10,
+	}
+
+	tests := []struct {
+		Name     string
+		Status   syscall.WaitStatus
+		Expected wire.ProcessState
+		Error    string
+	}{
+		{
+			Name:     "success",
+			Status:   0,
+			Expected: wire.ProcessState{},
+		},
+		{
+			Name:     "exitCode",
+			Status:   3 << 8,
+			Expected: wire.ProcessState{ExitCode: 3},
+			Error:    "process exited with status 3",
+		},
+		{
+			Name:     "signal",
+			Status:   syscall.WaitStatus(syscall.SIGKILL),
+			Expected: wire.ProcessState{ExitCode: -1, Signal: syscall.SIGKILL},
+			Error:    "process terminated by signal: killed",
+		},
+		{
+			Name:     "coreDumped",
+			Status:   syscall.WaitStatus(syscall.SIGSEGV) | 0x80,
+			Expected: wire.ProcessState{ExitCode: -1, Signal: syscall.SIGSEGV, CoreDumped: true},
+			Error:    "process terminated by signal: segmentation fault",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			expected := test.Expected
+			expected.StartTime = startTime
+			expected.EndTime = endTime
+			expected.UserTime = time.Second + 500*time.Microsecond
+			expected.SystemTime = 200 * time.Microsecond
+			expected.MaxRSS = 10 * 1024
+
+			process := newProcessState(initprocess.Exit{Status: test.Status, Rusage: rusage}, startTime, endTime)
+			assert.Equal(t, expected, *process)
+
+			err := exitError(test.Status)
+			if test.Error == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, test.Error)
+			}
+		})
+	}
+}
+
+func TestInputBuffer(t *testing.T) {
+	b := newInputBuffer()
+
+	// Writes never block, even if nothing reads the data.
+	for _, data := range []string{"a", "bc", "def"} {
+		n, err := b.Write([]byte(data))
+		require.NoError(t, err)
+		assert.Equal(t, len(data), n)
+	}
+
+	buf := make([]byte, 2)
+	n, err := b.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ab", string(buf[:n]))
+
+	// Reader waits for data written later.
+	dataCh := make(chan []byte, 1)
+	go func() {
+		// Buffer never returns errors other than EOF.
+		data, _ := io.ReadAll(b)
+		dataCh <- data
+	}()
+
+	_, err = b.Write([]byte("g"))
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+	assert.Equal(t, "cdefg", string(<-dataCh))
+
+	_, err = b.Write([]byte("h"))
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+}
+
+func TestRequestWithoutProcess(t *testing.T) {
+	r := newRequest()
+
+	require.Error(t, r.signal(syscall.SIGTERM, false))
+	require.Error(t, r.signal(syscall.SIGTERM, true))
+	require.Error(t, r.resizeTerminal(24, 80))
+	assert.Nil(t, r.processState())
+}
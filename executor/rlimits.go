@@ -0,0 +1,168 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/outofforest/isolator/initprocess"
+	"github.com/outofforest/isolator/wire"
+)
+
+// rlimits maps names of resources to their numbers.
+var rlimits = map[string]int{
+	"RLIMIT_AS":         unix.RLIMIT_AS,
+	"RLIMIT_CORE":       unix.RLIMIT_CORE,
+	"RLIMIT_CPU":        unix.RLIMIT_CPU,
+	"RLIMIT_DATA":       unix.RLIMIT_DATA,
+	"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+	"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+	"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"RLIMIT_NICE":       unix.RLIMIT_NICE,
+	"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+	"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+	"RLIMIT_RSS":        unix.RLIMIT_RSS,
+	"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+	"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"RLIMIT_STACK":      unix.RLIMIT_STACK,
+}
+
+// rlimitShim is the name the executor binary is started with to apply resource limits before executing the command.
+const rlimitShim = "isolator-rlimits"
+
+// rlimitShimFailure is the exit code of the shim if it fails to execute the command.
+const rlimitShimFailure = 127
+
+type procDirKey struct{}
+
+// withProcDir stores the directory procfs is mounted at inside the new root.
+func withProcDir(ctx context.Context, procDir string) context.Context {
+	return context.WithValue(ctx, procDirKey{}, procDir)
+}
+
+// rlimitShimPath returns the path the executor binary is started from as the shim. It is resolved using procfs
+// mounted by the executor, which is not mounted at /proc if system is not configured. /proc is used if procfs
+// directory is not defined in the context.
+func rlimitShimPath(ctx context.Context) string {
+	procDir, ok := ctx.Value(procDirKey{}).(string)
+	if !ok {
+		procDir = "/proc"
+	}
+	return filepath.Join(procDir, "self", "exe")
+}
+
+func init() {
+	if len(os.Args) == 0 || os.Args[0] != rlimitShim {
+		return
+	}
+	if err := execWithRlimits(os.Args[1:]); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", rlimitShim, err)
+		os.Exit(rlimitShimFailure)
+	}
+}
+
+// parseRlimits parses resource limits. Names are case-insensitive, RLIMIT_ prefix is optional.
+func parseRlimits(limits []wire.Rlimit) (map[int]unix.Rlimit, error) {
+	result := map[int]unix.Rlimit{}
+	for _, l := range limits {
+		name := strings.ToUpper(l.Type)
+		if !strings.HasPrefix(name, "RLIMIT_") {
+			name = "RLIMIT_" + name
+		}
+		resource, exists := rlimits[name]
+		if !exists {
+			return nil, errors.Errorf("unknown resource limit %s", name)
+		}
+		if l.Soft > l.Hard {
+			return nil, errors.Errorf("soft limit of %s exceeds the hard one", name)
+		}
+		result[resource] = unix.Rlimit{Cur: l.Soft, Max: l.Hard}
+	}
+	return result, nil
+}
+
+// encodeRlimits encodes resource limits passed to the shim.
+func encodeRlimits(limits map[int]unix.Rlimit) string {
+	resources := make([]int, 0, len(limits))
+	for resource := range limits {
+		resources = append(resources, resource)
+	}
+	sort.Ints(resources)
+
+	items := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		items = append(items, fmt.Sprintf("%d=%d:%d", resource, limits[resource].Cur, limits[resource].Max))
+	}
+	return strings.Join(items, ",")
+}
+
+// decodeRlimits decodes resource limits encoded by encodeRlimits.
+func decodeRlimits(data string) (map[int]unix.Rlimit, error) {
+	limits := map[int]unix.Rlimit{}
+	if data == "" {
+		return limits, nil
+	}
+	for _, item := range strings.Split(data, ",") {
+		var resource int
+		var limit unix.Rlimit
+		if _, err := fmt.Sscanf(item, "%d=%d:%d", &resource, &limit.Cur, &limit.Max); err != nil {
+			return nil, errors.Wrapf(err, "invalid resource limit %q", item)
+		}
+		limits[resource] = limit
+	}
+	return limits, nil
+}
+
+// startProcess starts the process with resource limits applied before exec. Limits are process-wide, so instead of
+// setting them on the executor, the executor binary is started as a shim which sets them on itself and then executes
+// the command.
+func startProcess(ctx context.Context, cmd *exec.Cmd, limits map[int]unix.Rlimit) error {
+	if len(limits) == 0 {
+		return initprocess.Start(ctx, cmd)
+	}
+
+	for resource, limit := range limits {
+		var current unix.Rlimit
+		if err := unix.Getrlimit(resource, &current); err != nil {
+			return errors.WithStack(err)
+		}
+		// Raising the hard limit requires CAP_SYS_RESOURCE in the initial user namespace, so it is never possible.
+		if limit.Max > current.Max {
+			return errors.Errorf("hard limit of resource %d can't be raised above %d", resource, current.Max)
+		}
+	}
+
+	cmd.Args = append([]string{rlimitShim, encodeRlimits(limits), cmd.Path}, cmd.Args...)
+	cmd.Path = rlimitShimPath(ctx)
+	return initprocess.Start(ctx, cmd)
+}
+
+// execWithRlimits is run by the shim. It applies resource limits and replaces the shim with the command.
+// Arguments are the encoded limits, path to the executable and arguments of the command.
+func execWithRlimits(args []string) error {
+	if len(args) < 3 {
+		return errors.New("limits, path and arguments of the command are required")
+	}
+
+	limits, err := decodeRlimits(args[0])
+	if err != nil {
+		return err
+	}
+	for resource, limit := range limits {
+		// syscall.Setrlimit is used, because otherwise Go restores the original limit of open files on exec.
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: limit.Cur, Max: limit.Max}); err != nil {
+			return errors.Wrapf(err, "setting resource limit %d failed", resource)
+		}
+	}
+	return errors.WithStack(syscall.Exec(args[1], args[2:], os.Environ()))
+}
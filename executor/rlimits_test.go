@@ -0,0 +1,139 @@
+package executor
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/outofforest/isolator/wire"
+)
+
+func TestParseRlimits(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Rlimits  []wire.Rlimit
+		Expected map[int]unix.Rlimit
+	}{
+		{
+			Name:     "none",
+			Expected: map[int]unix.Rlimit{},
+		},
+		{
+			Name: "names",
+			Rlimits: []wire.Rlimit{
+				{Type: "nofile", Soft: 1024, Hard: 4096},
+				{Type: "RLIMIT_CORE"},
+				{Type: "Nproc", Soft: 10, Hard: 10},
+			},
+			Expected: map[int]unix.Rlimit{
+				unix.RLIMIT_NOFILE: {Cur: 1024, Max: 4096},
+				unix.RLIMIT_CORE:   {},
+				unix.RLIMIT_NPROC:  {Cur: 10, Max: 10},
+			},
+		},
+		{
+			Name:    "lastWins",
+			Rlimits: []wire.Rlimit{{Type: "nofile", Soft: 1, Hard: 1}, {Type: "nofile", Soft: 2, Hard: 2}},
+			Expected: map[int]unix.Rlimit{
+				unix.RLIMIT_NOFILE: {Cur: 2, Max: 2},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			limits, err := parseRlimits(test.Rlimits)
+			require.NoError(t, err)
+			assert.Equal(t, test.Expected, limits)
+
+			decoded, err := decodeRlimits(encodeRlimits(limits))
+			require.NoError(t, err)
+			assert.Equal(t, limits, decoded)
+		})
+	}
+}
+
+func TestParseRlimitsInvalid(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Rlimit wire.Rlimit
+	}{
+		{Name: "unknown", Rlimit: wire.Rlimit{Type: "files"}},
+		{Name: "prefixOnly", Rlimit: wire.Rlimit{Type: "RLIMIT_"}},
+		{Name: "softAboveHard", Rlimit: wire.Rlimit{Type: "nofile", Soft: 2, Hard: 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			_, err := parseRlimits([]wire.Rlimit{test.Rlimit})
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestRlimitShim(t *testing.T) {
+	var original unix.Rlimit
+	require.NoError(t, unix.Getrlimit(unix.RLIMIT_NOFILE, &original))
+
+	// Test binary contains the executor package, so it acts as the shim too.
+	cmd := &exec.Cmd{
+		Path: "/proc/self/exe",
+		Args: []string{
+			rlimitShim,
+			encodeRlimits(map[int]unix.Rlimit{
+				unix.RLIMIT_NOFILE: {Cur: 100, Max: 200},
+				unix.RLIMIT_CORE:   {},
+			}),
+			"/bin/sh", "sh", "-c", "ulimit -S -n; ulimit -H -n; ulimit -c",
+		},
+	}
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "100\n200\n0\n", string(output))
+
+	// Limits of the parent are not modified.
+	var current unix.Rlimit
+	require.NoError(t, unix.Getrlimit(unix.RLIMIT_NOFILE, &current))
+	assert.Equal(t, original, current)
+}
+
+func TestRlimitShimProcDir(t *testing.T) {
+	assert.Equal(t, "/proc/self/exe", rlimitShimPath(context.Background()))
+
+	// Procfs mounted somewhere else is simulated by the symlink.
+	procDir := t.TempDir()
+	require.NoError(t, os.Symlink("/proc/self", filepath.Join(procDir, "self")))
+	ctx := withProcDir(context.Background(), procDir)
+	assert.Equal(t, filepath.Join(procDir, "self", "exe"), rlimitShimPath(ctx))
+
+	cmd := &exec.Cmd{
+		Path: rlimitShimPath(ctx),
+		Args: []string{
+			rlimitShim,
+			encodeRlimits(map[int]unix.Rlimit{unix.RLIMIT_CORE: {}}),
+			"/bin/sh", "sh", "-c", "ulimit -c",
+		},
+	}
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "0\n", string(output))
+}
+
+func TestStartProcessHardLimitAboveCurrent(t *testing.T) {
+	var current unix.Rlimit
+	require.NoError(t, unix.Getrlimit(unix.RLIMIT_NOFILE, &current))
+	if current.Max == unix.RLIM_INFINITY {
+		t.Skip("hard limit is infinite")
+	}
+
+	err := startProcess(context.Background(), exec.Command("/bin/true"), map[int]unix.Rlimit{
+		unix.RLIMIT_NOFILE: {Cur: current.Cur, Max: current.Max + 1},
+	})
+	require.Error(t, err)
+}
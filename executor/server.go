@@ -6,13 +6,16 @@ import (
 	"io"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
 	"syscall"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
 	"github.com/outofforest/isolator/initprocess"
+	"github.com/outofforest/isolator/lib/seccomp"
 	"github.com/outofforest/isolator/network"
 	"github.com/outofforest/isolator/wire"
 	"github.com/outofforest/logger"
@@ -32,7 +35,8 @@ func runServer(ctx context.Context, config Config, rootDir string) error {
 			return errors.WithStack(ctx.Err())
 		})
 		spawn("executor.environment", parallel.Exit, func(ctx context.Context) error {
-			decode := wire.NewDecoder(os.Stdin, append(config.Router.Types(), wire.Config{}))
+			decode := wire.NewDecoder(os.Stdin, append(config.Router.Types(), wire.Config{}, wire.Stdin{},
+				wire.StdinClose{}, wire.TerminalResize{}, wire.Signal{}))
 			encode := wire.NewEncoder(os.Stdout)
 
 			content, err := decode()
@@ -44,21 +48,59 @@ func runServer(ctx context.Context, config Config, rootDir string) error {
 				return errors.Errorf("expected Config message but got: %T", content)
 			}
 
-			if err := prepareNewRoot(rootDir); err != nil {
+			if runtimeConfig.StopSignal != 0 {
+				spawn("executor.stopSignal", parallel.Exit, func(ctx context.Context) error {
+					sigCh := make(chan os.Signal, 1)
+					signal.Notify(sigCh, runtimeConfig.StopSignal)
+					defer signal.Stop(sigCh)
+
+					select {
+					case <-ctx.Done():
+						return errors.WithStack(ctx.Err())
+					case sig := <-sigCh:
+						log.Info("Stop signal received", zap.Stringer("signal", sig))
+						return nil
+					}
+				})
+			}
+
+			if err := prepareNewRoot(rootDir, runtimeConfig.Root); err != nil {
 				return err
 			}
 
+			procDir := ".proc"
+
 			//nolint:nestif
 			if runtimeConfig.ConfigureSystem {
-				if err := mountProc("proc"); err != nil {
+				procDir = "proc"
+				if err := mountProc(procDir); err != nil {
 					return err
 				}
 				if err := mountTmp(); err != nil {
 					return err
 				}
-				if err := populateDev(); err != nil {
+				devices := runtimeConfig.Devices
+				if devices == nil {
+					devices = DefaultDevices
+				}
+				if err := populateDev(devices, runtimeConfig.ShmSize, runtimeConfig.HostDevices); err != nil {
 					return err
 				}
+				if runtimeConfig.MountSysfs {
+					if err := mountSysfs(runtimeConfig.UseHostNetwork); err != nil {
+						return err
+					}
+				}
+				if runtimeConfig.MountCgroup {
+					if err := mountCgroup(); err != nil {
+						return err
+					}
+				}
+				if runtimeConfig.MountMqueue {
+					if err := mountMqueue(); err != nil {
+						return err
+					}
+				}
 				if err := configureDNS(runtimeConfig.DNS); err != nil {
 					return err
 				}
@@ -66,11 +108,16 @@ func runServer(ctx context.Context, config Config, rootDir string) error {
 					return err
 				}
 			} else {
-				if err := mountProc(".proc"); err != nil {
+				if err := mountProc(procDir); err != nil {
 					return err
 				}
 			}
 
+			// Sysctls are set before /proc/sys is made read-only.
+			if err := applySysctls(runtimeConfig.Sysctls, runtimeConfig.UseHostNetwork, procDir); err != nil {
+				return err
+			}
+
 			if err := applyMounts(runtimeConfig.Mounts); err != nil {
 				return err
 			}
@@ -79,6 +126,40 @@ func runServer(ctx context.Context, config Config, rootDir string) error {
 				return err
 			}
 
+			maskedPaths := runtimeConfig.MaskedPaths
+			if maskedPaths == nil {
+				maskedPaths = DefaultMaskedPaths
+			}
+			if err := maskPaths(maskedPaths); err != nil {
+				return err
+			}
+			readOnlyPaths := runtimeConfig.ReadOnlyPaths
+			if readOnlyPaths == nil {
+				readOnlyPaths = DefaultReadOnlyPaths
+			}
+			if err := makeReadOnly(readOnlyPaths); err != nil {
+				return err
+			}
+			if runtimeConfig.ReadOnlyRoot {
+				if err := remountReadOnly("/"); err != nil {
+					return err
+				}
+			}
+
+			capNames := runtimeConfig.Capabilities
+			if capNames == nil {
+				capNames = DefaultCapabilities
+			}
+			caps, err := parseCapabilities(capNames)
+			if err != nil {
+				return err
+			}
+			ctx = withPrivileges(ctx, privileges{
+				Capabilities: caps,
+				NoNewPrivs:   !runtimeConfig.AllowNewPrivileges,
+			})
+			ctx = withProcDir(ctx, filepath.Join("/", procDir))
+
 			if runtimeConfig.Hostname != "" {
 				if err := syscall.Sethostname([]byte(runtimeConfig.Hostname)); err != nil {
 					return errors.WithStack(err)
@@ -91,55 +172,169 @@ func runServer(ctx context.Context, config Config, rootDir string) error {
 				}
 			}
 
+			// Filter is installed after environment is configured, because setup requires syscalls denied by it.
+			if err := installSeccomp(runtimeConfig.Seccomp); err != nil {
+				return err
+			}
+
 			return run.WithFlavours(ctx, []run.FlavourFunc{
 				initprocess.Flavour,
 			}, func(ctx context.Context) error {
-				log := logger.Get(ctx)
+				return handleRequests(ctx, config.Router, decode, encode)
+			})
+		})
+		return nil
+	})
+}
 
-				for {
-					content, err := decode()
-					if err != nil {
-						if ctx.Err() != nil {
-							return errors.WithStack(ctx.Err())
-						}
-						if errors.Is(err, io.EOF) {
-							return nil
+// handleRequests runs requests received from the client concurrently. Once input is closed by the client, requests
+// already running are finished, but nothing more is sent to them, so their standard input is closed.
+func handleRequests(ctx context.Context, router Router, decode wire.DecoderFunc, encode wire.EncoderFunc) error {
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("receiver", parallel.Continue, func(ctx context.Context) error {
+			var mu sync.Mutex
+			running := map[uint64]*request{}
+
+			for {
+				content, err := decode()
+				if err != nil {
+					if ctx.Err() != nil {
+						return errors.WithStack(ctx.Err())
+					}
+					if errors.Is(err, io.EOF) {
+						mu.Lock()
+						defer mu.Unlock()
+
+						for _, r := range running {
+							_ = r.stdin.Close()
 						}
-						return err
+						return nil
 					}
+					return err
+				}
 
-					handler, err := config.Router.Handler(content)
-					if err != nil {
-						return err
+				id := wire.ContentToID(content)
+
+				switch content.(type) {
+				case wire.Stdin, wire.StdinClose, wire.TerminalResize, wire.Signal:
+					mu.Lock()
+					r := running[id]
+					mu.Unlock()
+
+					if r == nil {
+						logger.Get(ctx).Warn("Message received for request which is not running",
+							zap.Uint64("requestID", id))
+						continue
 					}
 
-					var errStr string
-					if err := handler(ctx, content, encode); err != nil {
-						log.Error("Command returned error", zap.Any("content", content), zap.Error(err))
-						errStr = err.Error()
+					var err error
+					switch m := content.(type) {
+					case wire.Stdin:
+						_, err = r.stdin.Write(m.Data)
+					case wire.StdinClose:
+						err = r.stdin.Close()
+					case wire.TerminalResize:
+						err = r.resizeTerminal(m.Rows, m.Cols)
+					case wire.Signal:
+						err = r.signal(m.Signal, m.Group)
+					}
+					if err != nil {
+						logger.Get(ctx).Warn("Forwarding message failed", zap.Uint64("requestID", id),
+							zap.Error(err))
 					}
+					continue
+				}
+
+				handler, err := router.Handler(content)
+				if err != nil {
+					return err
+				}
+
+				r := newRequest()
+
+				mu.Lock()
+				_, exists := running[id]
+				if !exists {
+					running[id] = r
+				}
+				mu.Unlock()
+
+				if exists {
 					if err := encode(wire.Result{
-						Error: errStr,
+						ID:    id,
+						Error: fmt.Sprintf("request %d is already running", id),
 					}); err != nil {
 						return err
 					}
+					continue
 				}
-			})
+
+				spawn(fmt.Sprintf("request-%d", id), parallel.Continue, func(ctx context.Context) error {
+					ctx = withRequest(logger.With(ctx, zap.Uint64("requestID", id)), r)
+					log := logger.Get(ctx)
+
+					var errStr string
+					if err := handler(ctx, content, wire.WithID(encode, id)); err != nil {
+						log.Error("Command returned error", zap.Any("content", content), zap.Error(err))
+						errStr = err.Error()
+					}
+
+					// ID is released before result is sent, so client may reuse it once result is received.
+					mu.Lock()
+					delete(running, id)
+					mu.Unlock()
+
+					return encode(wire.Result{
+						ID:      id,
+						Error:   errStr,
+						Process: r.processState(),
+					})
+				})
+			}
 		})
 		return nil
 	})
 }
 
-func prepareNewRoot(rootDir string) error {
+func installSeccomp(config *wire.Seccomp) error {
+	if config == nil {
+		// Default profile can't be applied on platforms not supporting seccomp, custom one is rejected there.
+		if !seccomp.Supported() {
+			return nil
+		}
+		config = &wire.Seccomp{}
+	}
+	if config.Unconfined {
+		return nil
+	}
+
+	profile := seccomp.DefaultProfile()
+	if len(config.Profile) > 0 {
+		var err error
+		profile, err = seccomp.Parse(config.Profile)
+		if err != nil {
+			return err
+		}
+	}
+	return seccomp.Install(profile)
+}
+
+func prepareNewRoot(rootDir string, root *wire.Mount) error {
 	// systemd remounts everything as MS_SHARED, to prevent mess let's remount everything back to
 	// MS_PRIVATE inside namespace
 	if err := syscall.Mount("", "/", "", syscall.MS_SLAVE|syscall.MS_REC, ""); err != nil {
 		return errors.WithStack(err)
 	}
 
-	// PivotRoot requires new root to be on different mountpoint, so let's bind it to itself
-	if err := syscall.Mount(rootDir, rootDir, "", syscall.MS_BIND|syscall.MS_PRIVATE, ""); err != nil {
-		return errors.WithStack(err)
+	if root != nil {
+		if err := mount(*root, rootDir); err != nil {
+			return errors.Wrap(err, "mounting root failed")
+		}
+	} else {
+		// PivotRoot requires new root to be on different mountpoint, so let's bind it to itself
+		if err := syscall.Mount(rootDir, rootDir, "", syscall.MS_BIND|syscall.MS_PRIVATE, ""); err != nil {
+			return errors.WithStack(err)
+		}
 	}
 
 	// Let's assume that new filesystem is the current working dir even before pivoting to make life easier
@@ -168,91 +363,44 @@ func mountTmp() error {
 	return nil
 }
 
-func populateDev() error {
-	devDir := "dev"
-	if err := os.Mkdir(devDir, 0o755); err != nil && !os.IsExist(err) {
-		return errors.WithStack(err)
-	}
-	if err := syscall.Mount("none", devDir, "tmpfs", 0, ""); err != nil {
+func mountSysfs(hostNetwork bool) error {
+	const targetDir = "sys"
+
+	if err := os.Mkdir(targetDir, 0o755); err != nil && !os.IsExist(err) {
 		return errors.WithStack(err)
 	}
-	for _, dev := range []string{"console", "null", "zero", "random", "urandom"} {
-		devPath := filepath.Join(devDir, dev)
 
-		f, err := os.OpenFile(devPath, os.O_CREATE|os.O_RDONLY, 0o644)
-		if err != nil {
-			return errors.WithStack(err)
-		}
-		if err := f.Close(); err != nil {
-			return errors.WithStack(err)
-		}
-		if err := syscall.Mount(filepath.Join("/", devPath), devPath, "",
-			syscall.MS_BIND|syscall.MS_PRIVATE, ""); err != nil {
+	// Sysfs may be mounted only by the owner of the network namespace, so sysfs of host is bound if host network
+	// is used. Its submounts are locked, so they have to be bound too.
+	if hostNetwork {
+		if err := syscall.Mount("/sys", targetDir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
 			return errors.WithStack(err)
 		}
+		return remountReadOnlyRecursive(targetDir)
 	}
-	links := map[string]string{
-		"fd":     "/proc/self/fd",
-		"stdin":  "fd/0",
-		"stdout": "fd/1",
-		"stderr": "fd/2",
-	}
-	for newName, oldName := range links {
-		if err := os.Symlink(oldName, devDir+"/"+newName); err != nil {
-			return errors.WithStack(err)
-		}
-	}
-	return nil
+
+	return errors.WithStack(syscall.Mount("sysfs", targetDir, "sysfs",
+		syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""))
 }
 
-func applyMounts(mounts []wire.Mount) error {
-	// To mount readonly, trick is required:
-	// 1. mount dir normally
-	// 2. remount it using read-only option
-	for _, m := range mounts {
-		// force path in container should be relative to the new filesystem to prevent hacks (we haven't pivoted yet)
-		m.Namespace = filepath.Join(".", m.Namespace)
+func mountCgroup() error {
+	targetDir := filepath.Join("sys", "fs", "cgroup")
 
-		info, err := os.Stat(m.Host)
-		if err != nil {
-			return errors.WithStack(err)
-		}
+	if err := os.MkdirAll(targetDir, 0o755); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(syscall.Mount("cgroup2", targetDir, "cgroup2",
+		syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""))
+}
 
-		//nolint:nestif
-		if info.IsDir() {
-			if err := os.MkdirAll(m.Namespace, 0o700); err != nil {
-				return errors.WithStack(err)
-			}
-		} else {
-			if err := os.MkdirAll(filepath.Dir(m.Namespace), 0o700); err != nil {
-				return errors.WithStack(err)
-			}
-			err := func() error {
-				f, err := os.OpenFile(m.Namespace, os.O_CREATE|os.O_WRONLY|os.O_EXCL, info.Mode())
-				if err != nil {
-					if os.IsExist(err) {
-						return nil
-					}
-					return errors.WithStack(err)
-				}
-				return errors.WithStack(f.Close())
-			}()
-			if err != nil {
-				return err
-			}
-		}
-		if err := syscall.Mount(m.Host, m.Namespace, "",
-			syscall.MS_BIND|syscall.MS_PRIVATE, ""); err != nil {
-			return errors.WithStack(err)
-		}
-		if !m.Writable {
-			if err := syscall.Mount(m.Host, m.Namespace, "",
-				syscall.MS_BIND|syscall.MS_PRIVATE|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
-				return errors.WithStack(err)
-			}
-		}
+func mountMqueue() error {
+	targetDir := filepath.Join("dev", "mqueue")
+
+	if err := os.Mkdir(targetDir, 0o755); err != nil && !os.IsExist(err) {
+		return errors.WithStack(err)
 	}
-	return nil
+	return errors.WithStack(syscall.Mount("mqueue", targetDir, "mqueue",
+		syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""))
 }
 
 func pivotRoot() error {
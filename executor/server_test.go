@@ -0,0 +1,199 @@
+package executor
+
+import (
+	"context"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/isolator/lib/test"
+	"github.com/outofforest/isolator/wire"
+)
+
+// testConn delivers messages to handleRequests and collects the ones sent by it.
+type testConn struct {
+	inCh  chan interface{}
+	outCh chan interface{}
+}
+
+func newTestConn() *testConn {
+	return &testConn{
+		inCh:  make(chan interface{}),
+		outCh: make(chan interface{}, 100),
+	}
+}
+
+func (c *testConn) decode() (interface{}, error) {
+	content, ok := <-c.inCh
+	if !ok {
+		return nil, errors.WithStack(io.EOF)
+	}
+	return content, nil
+}
+
+func (c *testConn) encode(content interface{}) error {
+	c.outCh <- content
+	return nil
+}
+
+func (c *testConn) receive(t *testing.T) interface{} {
+	select {
+	case content := <-c.outCh:
+		return content
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for message")
+		return nil
+	}
+}
+
+func TestHandleRequestsConcurrent(t *testing.T) {
+	conn := newTestConn()
+	router := NewRouter().RegisterHandler(wire.Execute{},
+		func(ctx context.Context, content interface{}, encode wire.EncoderFunc) error {
+			// Handler echoes standard input, so request finishes once input of that request is closed.
+			data, err := io.ReadAll(requestFromContext(ctx).stdin)
+			if err != nil {
+				return err
+			}
+			if err := encode(wire.Log{Content: data}); err != nil {
+				return err
+			}
+			if content.(wire.Execute).Command == "fail" {
+				return errors.New("failed")
+			}
+			return nil
+		})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- handleRequests(test.Context(t), router, conn.decode, conn.encode)
+	}()
+
+	conn.inCh <- wire.Execute{ID: 1}
+	conn.inCh <- wire.Execute{ID: 2, Command: "fail"}
+	conn.inCh <- wire.Stdin{ID: 2, Data: []byte("second")}
+	conn.inCh <- wire.Stdin{ID: 1, Data: []byte("first")}
+	conn.inCh <- wire.StdinClose{ID: 2}
+
+	assert.Equal(t, wire.Log{ID: 2, Content: []byte("second")}, conn.receive(t))
+	assert.Equal(t, wire.Result{ID: 2, Error: "failed"}, conn.receive(t))
+
+	conn.inCh <- wire.StdinClose{ID: 1}
+
+	assert.Equal(t, wire.Log{ID: 1, Content: []byte("first")}, conn.receive(t))
+	assert.Equal(t, wire.Result{ID: 1}, conn.receive(t))
+
+	close(conn.inCh)
+	require.NoError(t, <-errCh)
+}
+
+func TestHandleRequestsDuplicateID(t *testing.T) {
+	conn := newTestConn()
+	router := NewRouter().RegisterHandler(wire.Execute{},
+		func(ctx context.Context, content interface{}, encode wire.EncoderFunc) error {
+			_, err := io.ReadAll(requestFromContext(ctx).stdin)
+			return err
+		})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- handleRequests(test.Context(t), router, conn.decode, conn.encode)
+	}()
+
+	conn.inCh <- wire.Execute{}
+	conn.inCh <- wire.Execute{}
+
+	assert.Equal(t, wire.Result{Error: "request 0 is already running"}, conn.receive(t))
+
+	conn.inCh <- wire.StdinClose{}
+	assert.Equal(t, wire.Result{}, conn.receive(t))
+
+	// ID may be reused once previous request finishes.
+	conn.inCh <- wire.Execute{}
+	conn.inCh <- wire.StdinClose{}
+	assert.Equal(t, wire.Result{}, conn.receive(t))
+
+	close(conn.inCh)
+	require.NoError(t, <-errCh)
+}
+
+func TestHandleRequestsFinishedAfterEOF(t *testing.T) {
+	conn := newTestConn()
+	router := NewRouter().RegisterHandler(wire.Execute{},
+		func(ctx context.Context, content interface{}, encode wire.EncoderFunc) error {
+			data, err := io.ReadAll(requestFromContext(ctx).stdin)
+			if err != nil {
+				return err
+			}
+			return encode(wire.Log{Content: data})
+		})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- handleRequests(test.Context(t), router, conn.decode, conn.encode)
+	}()
+
+	conn.inCh <- wire.Execute{ID: 1}
+	conn.inCh <- wire.Stdin{ID: 1, Data: []byte("data")}
+	close(conn.inCh)
+
+	// Request is not canceled, it reads the input sent before it was closed.
+	assert.Equal(t, wire.Log{ID: 1, Content: []byte("data")}, conn.receive(t))
+	assert.Equal(t, wire.Result{ID: 1}, conn.receive(t))
+	require.NoError(t, <-errCh)
+}
+
+func TestHandleRequestsMessagesForNotRunningRequest(t *testing.T) {
+	conn := newTestConn()
+	router := NewRouter().RegisterHandler(wire.Execute{},
+		func(ctx context.Context, content interface{}, encode wire.EncoderFunc) error {
+			_, err := io.ReadAll(requestFromContext(ctx).stdin)
+			if err != nil {
+				return err
+			}
+			// No process is started by the handler, so signals and resizes can't be delivered.
+			return requestFromContext(ctx).signal(syscall.SIGTERM, false)
+		})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- handleRequests(test.Context(t), router, conn.decode, conn.encode)
+	}()
+
+	// Messages for requests which are not running are ignored.
+	for _, content := range []interface{}{
+		wire.Stdin{ID: 1, Data: []byte("data")},
+		wire.StdinClose{ID: 1},
+		wire.TerminalResize{ID: 1, Rows: 24, Cols: 80},
+		wire.Signal{ID: 1, Signal: syscall.SIGTERM},
+	} {
+		conn.inCh <- content
+	}
+
+	// Failed delivery of message does not affect the request.
+	conn.inCh <- wire.Execute{ID: 1}
+	conn.inCh <- wire.TerminalResize{ID: 1, Rows: 24, Cols: 80}
+	conn.inCh <- wire.Signal{ID: 1, Signal: syscall.SIGTERM}
+	conn.inCh <- wire.StdinClose{ID: 1}
+	assert.Equal(t, wire.Result{ID: 1, Error: "no process is running in the request"}, conn.receive(t))
+
+	close(conn.inCh)
+	require.NoError(t, <-errCh)
+}
+
+func TestHandleRequestsUnknownType(t *testing.T) {
+	conn := newTestConn()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- handleRequests(test.Context(t), NewRouter(), conn.decode, conn.encode)
+	}()
+
+	conn.inCh <- wire.Execute{ID: 1}
+	require.Error(t, <-errCh)
+}
@@ -0,0 +1,69 @@
+package executor
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// namespacedSysctls is the set of kernel parameters isolated by IPC and UTS namespaces.
+var namespacedSysctls = map[string]bool{
+	"kernel.domainname":      true,
+	"kernel.msgmax":          true,
+	"kernel.msgmnb":          true,
+	"kernel.msgmni":          true,
+	"kernel.sem":             true,
+	"kernel.shmall":          true,
+	"kernel.shmmax":          true,
+	"kernel.shmmni":          true,
+	"kernel.shm_rmid_forced": true,
+}
+
+const (
+	// sysctlPrefixIPC is the prefix of parameters of message queues isolated by IPC namespace.
+	sysctlPrefixIPC = "fs.mqueue."
+
+	// sysctlPrefixNet is the prefix of parameters isolated by network namespace.
+	sysctlPrefixNet = "net."
+)
+
+// validateSysctl verifies that kernel parameter is isolated by namespaces, so setting it does not affect host.
+func validateSysctl(key string, hostNetwork bool) error {
+	if strings.Contains(key, "/") || strings.Contains(key, "..") {
+		return errors.Errorf("invalid sysctl %q", key)
+	}
+	switch {
+	case namespacedSysctls[key], strings.HasPrefix(key, sysctlPrefixIPC):
+		return nil
+	case strings.HasPrefix(key, sysctlPrefixNet):
+		if hostNetwork {
+			return errors.Errorf("sysctl %q can't be set if host network is used", key)
+		}
+		return nil
+	default:
+		return errors.Errorf("sysctl %q is not namespaced", key)
+	}
+}
+
+// applySysctls writes kernel parameters to sys directory of proc filesystem mounted at procDir.
+func applySysctls(sysctls map[string]string, hostNetwork bool, procDir string) error {
+	keys := make([]string, 0, len(sysctls))
+	for key := range sysctls {
+		if err := validateSysctl(key, hostNetwork); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		path := filepath.Join(append([]string{procDir, "sys"}, strings.Split(key, ".")...)...)
+		if err := os.WriteFile(path, []byte(sysctls[key]), 0o644); err != nil {
+			return errors.Wrapf(err, "setting sysctl %s failed", key)
+		}
+	}
+	return nil
+}
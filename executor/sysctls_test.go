@@ -0,0 +1,38 @@
+package executor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSysctl(t *testing.T) {
+	tests := []struct {
+		Key         string
+		HostNetwork bool
+		Valid       bool
+	}{
+		{Key: "kernel.shmmax", Valid: true},
+		{Key: "kernel.msgmnb", HostNetwork: true, Valid: true},
+		{Key: "fs.mqueue.msg_max", Valid: true},
+		{Key: "net.core.somaxconn", Valid: true},
+		{Key: "net.ipv4.ip_forward", HostNetwork: true},
+		{Key: "kernel.hostname"},
+		{Key: "kernel.panic"},
+		{Key: "vm.overcommit_memory"},
+		{Key: "fs.file-max"},
+		{Key: "net/core/somaxconn"},
+		{Key: "net...kernel.panic"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Key, func(t *testing.T) {
+			err := validateSysctl(test.Key, test.HostNetwork)
+			if test.Valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+
+	"github.com/outofforest/isolator/wire"
+	"github.com/outofforest/logger"
+)
+
+// endOfTransmission is the character which makes the terminal report the end of file to the reader.
+const endOfTransmission = 0x04
+
+// ExecuteTerminalHandler is a standard handler handling ExecuteTerminal command.
+func ExecuteTerminalHandler(ctx context.Context, content interface{}, encode wire.EncoderFunc) error {
+	m, ok := content.(wire.ExecuteTerminal)
+	if !ok {
+		return errors.Errorf("unexpected type %T", content)
+	}
+
+	term, err := openTerminal()
+	if err != nil {
+		return err
+	}
+	defer term.Close()
+
+	if err := term.Resize(m.Rows, m.Cols); err != nil {
+		return err
+	}
+
+	termVar := m.Term
+	if termVar == "" {
+		termVar = "xterm"
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", m.Command)
+	cmd.Env = append(os.Environ(), "TERM="+termVar)
+	cmd.Stdin = term.slave
+	cmd.Stdout = term.slave
+	cmd.Stderr = term.slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:  true,
+		Setctty: true,
+		// Ctty is the descriptor number in the child process, 0 means stdin.
+		Ctty: 0,
+	}
+
+	log := logger.Get(ctx)
+	log.Info("Starting terminal command")
+
+	if err := execCommand(ctx, cmd, execConfig{
+		Terminal:       term,
+		TerminalOutput: terminalTransmitter{encode: encode},
+	}); err != nil {
+		log.Error("Terminal command exited with error", zap.Error(err))
+		return err
+	}
+
+	log.Info("Terminal command exited")
+	return nil
+}
+
+type terminalTransmitter struct {
+	encode wire.EncoderFunc
+}
+
+func (tt terminalTransmitter) Write(data []byte) (int, error) {
+	if err := tt.encode(wire.TerminalOutput{Data: data}); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// terminal is the pseudo-terminal allocated inside the namespace.
+type terminal struct {
+	master *os.File
+	slave  *os.File
+}
+
+func openTerminal() (*terminal, error) {
+	// Master is not switched to blocking mode so deadlines may be used to stop reading from it.
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var ptyNum uint32
+	err = control(master, func(fd int) error {
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			return errors.WithStack(err)
+		}
+		var err error
+		ptyNum, err = unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		_ = master.Close()
+		return nil, err
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", ptyNum), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		_ = master.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	return &terminal{
+		master: master,
+		slave:  slave,
+	}, nil
+}
+
+// Resize sets the size of the terminal window.
+func (t *terminal) Resize(rows, cols uint16) error {
+	if rows == 0 || cols == 0 {
+		return nil
+	}
+	return control(t.master, func(fd int) error {
+		return errors.WithStack(unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &unix.Winsize{
+			Row: rows,
+			Col: cols,
+		}))
+	})
+}
+
+// Close closes the terminal.
+func (t *terminal) Close() error {
+	_ = t.slave.Close()
+	return errors.WithStack(t.master.Close())
+}
+
+func control(f *os.File, fn func(fd int) error) error {
+	rawConn, err := f.SyscallConn()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var fnErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		fnErr = fn(int(fd))
+	}); err != nil {
+		return errors.WithStack(err)
+	}
+	return fnErr
+}
@@ -4,7 +4,6 @@ go 1.23
 
 require (
 	github.com/google/nftables v0.2.0
-	github.com/outofforest/libexec v0.3.9
 	github.com/outofforest/logger v0.4.0
 	github.com/outofforest/parallel v0.2.3
 	github.com/outofforest/run v0.6.0
@@ -13,6 +12,7 @@ require (
 	github.com/stretchr/testify v1.8.4
 	github.com/vishvananda/netlink v1.1.0
 	go.uber.org/zap v1.27.0
+	golang.org/x/net v0.22.0
 	golang.org/x/sys v0.28.0
 )
 
@@ -27,7 +27,6 @@ require (
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/vishvananda/netns v0.0.4 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
-	golang.org/x/net v0.22.0 // indirect
 	golang.org/x/sync v0.6.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
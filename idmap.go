@@ -0,0 +1,252 @@
+package isolator
+
+import (
+	"bufio"
+	"context"
+	"math"
+	"os"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	subUIDPath = "/etc/subuid"
+	subGIDPath = "/etc/subgid"
+
+	// maxIDMappings is the maximum number of lines accepted by the kernel in uid_map and gid_map files.
+	maxIDMappings = 340
+)
+
+// defaultIDMapping is used if mappings are not configured and rootless mode is disabled.
+var defaultIDMapping = IDMapping{
+	ContainerID: 0,
+	HostID:      0,
+	Size:        65535,
+}
+
+func idMappings(config Config) ([]IDMapping, []IDMapping, error) {
+	uidMappings := config.UIDMappings
+	gidMappings := config.GIDMappings
+
+	switch {
+	case config.Rootless:
+		u, err := user.Current()
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		if len(uidMappings) == 0 {
+			uidMappings, err = rootlessIDMappings(subUIDPath, u.Username, u.Uid)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if len(gidMappings) == 0 {
+			g, err := user.LookupGroupId(u.Gid)
+			if err != nil {
+				return nil, nil, errors.WithStack(err)
+			}
+			gidMappings, err = rootlessIDMappings(subGIDPath, g.Name, g.Gid)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	default:
+		if len(uidMappings) == 0 {
+			uidMappings = []IDMapping{defaultIDMapping}
+		}
+		if len(gidMappings) == 0 {
+			gidMappings = []IDMapping{defaultIDMapping}
+		}
+	}
+
+	if err := validateIDMappings(uidMappings); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid UID mappings")
+	}
+	if err := validateIDMappings(gidMappings); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid GID mappings")
+	}
+	return uidMappings, gidMappings, nil
+}
+
+// rootlessIDMappings maps root inside namespace to the invoking user or group, and the rest of IDs to
+// the subordinate ranges assigned to it.
+func rootlessIDMappings(subIDPath, name, id string) ([]IDMapping, error) {
+	hostID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ranges, err := subIDRanges(subIDPath, name, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		return nil, errors.Errorf("no subordinate ID range is defined for %s in %s", name, subIDPath)
+	}
+
+	mappings := []IDMapping{
+		{
+			ContainerID: 0,
+			HostID:      uint32(hostID),
+			Size:        1,
+		},
+	}
+	containerID := uint64(1)
+	for _, r := range ranges {
+		if containerID+uint64(r.Size) > math.MaxUint32 {
+			break
+		}
+		r.ContainerID = uint32(containerID)
+		mappings = append(mappings, r)
+		containerID += uint64(r.Size)
+	}
+	return mappings, nil
+}
+
+// subIDRanges reads subordinate ID ranges assigned to the name or ID from the file in /etc/subuid format.
+// ContainerID fields of returned mappings are not set.
+func subIDRanges(subIDPath, name, id string) ([]IDMapping, error) {
+	f, err := os.Open(subIDPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errors.Errorf("%s does not exist, it is required in rootless mode", subIDPath)
+		}
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	var ranges []IDMapping
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 {
+			return nil, errors.Errorf("invalid line in %s: %q", subIDPath, line)
+		}
+		if parts[0] != name && parts[0] != id {
+			continue
+		}
+
+		start, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid line in %s: %q", subIDPath, line)
+		}
+		count, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid line in %s: %q", subIDPath, line)
+		}
+		if count == 0 {
+			continue
+		}
+
+		ranges = append(ranges, IDMapping{
+			HostID: uint32(start),
+			Size:   uint32(count),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return ranges, nil
+}
+
+func validateIDMappings(mappings []IDMapping) error {
+	if len(mappings) > maxIDMappings {
+		return errors.Errorf("number of mappings %d exceeds the limit of %d", len(mappings), maxIDMappings)
+	}
+
+	sorted := append([]IDMapping{}, mappings...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ContainerID < sorted[j].ContainerID
+	})
+
+	for i, m := range sorted {
+		if m.Size == 0 {
+			return errors.Errorf("size of mapping %s is zero", m)
+		}
+		if uint64(m.ContainerID)+uint64(m.Size) > math.MaxUint32 ||
+			uint64(m.HostID)+uint64(m.Size) > math.MaxUint32 {
+			return errors.Errorf("mapping %s exceeds the range of IDs", m)
+		}
+		if i > 0 && sorted[i-1].ContainerID+sorted[i-1].Size > m.ContainerID {
+			return errors.Errorf("mapping %s overlaps with mapping %s", m, sorted[i-1])
+		}
+	}
+
+	if len(sorted) == 0 || sorted[0].ContainerID != 0 {
+		return errors.New("root must be mapped")
+	}
+	return nil
+}
+
+// hostID returns the host ID mapped to the ID inside namespace.
+func hostID(mappings []IDMapping, id uint32) (uint32, bool) {
+	for _, m := range mappings {
+		if id >= m.ContainerID && id-m.ContainerID < m.Size {
+			return m.HostID + id - m.ContainerID, true
+		}
+	}
+	return 0, false
+}
+
+// writeIDMappings writes mappings of the process using newuidmap and newgidmap, which are allowed to map
+// subordinate IDs of unprivileged user.
+func writeIDMappings(ctx context.Context, pid int, uidMappings, gidMappings []IDMapping) error {
+	for _, tool := range []struct {
+		Name     string
+		Mappings []IDMapping
+	}{
+		{Name: "newuidmap", Mappings: uidMappings},
+		{Name: "newgidmap", Mappings: gidMappings},
+	} {
+		args := []string{strconv.Itoa(pid)}
+		for _, m := range tool.Mappings {
+			args = append(args, strconv.FormatUint(uint64(m.ContainerID), 10),
+				strconv.FormatUint(uint64(m.HostID), 10), strconv.FormatUint(uint64(m.Size), 10))
+		}
+
+		if output, err := exec.CommandContext(ctx, tool.Name, args...).CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "%s failed: %s", tool.Name, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+func toSysProcIDMap(mappings []IDMapping) []syscall.SysProcIDMap {
+	result := make([]syscall.SysProcIDMap, 0, len(mappings))
+	for _, m := range mappings {
+		result = append(result, syscall.SysProcIDMap{
+			ContainerID: int(m.ContainerID),
+			HostID:      int(m.HostID),
+			Size:        int(m.Size),
+		})
+	}
+	return result
+}
+
+// allCapabilities returns all the capabilities supported by the kernel.
+func allCapabilities() []uintptr {
+	lastCap := uintptr(unix.CAP_LAST_CAP)
+	if content, err := os.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		if v, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 8); err == nil {
+			lastCap = uintptr(v)
+		}
+	}
+
+	caps := make([]uintptr, 0, lastCap+1)
+	for c := uintptr(0); c <= lastCap; c++ {
+		caps = append(caps, c)
+	}
+	return caps
+}
@@ -3,6 +3,7 @@ package initprocess
 import (
 	"context"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
 
 	"github.com/outofforest/logger"
 	"github.com/outofforest/parallel"
@@ -37,144 +39,118 @@ func Flavour(ctx context.Context, appFunc parallel.Task) error {
 
 	logger.Get(ctx).Info("Starting init process", zap.String("pid", pid))
 
+	if os.Getpid() != 1 {
+		// Orphaned descendants are reparented to the nearest subreaper, so they might be awaited here like it is done
+		// by the real init process.
+		if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	// Handler is installed before app is started, so no exited child is missed.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGCHLD)
+	defer signal.Stop(sigCh)
+
+	r := newReaper()
+
 	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
 		appTerminatedCh := make(chan struct{})
 		spawn("", parallel.Exit, func(ctx context.Context) error {
 			defer close(appTerminatedCh)
 
-			return appFunc(ctx)
+			return appFunc(withReaper(ctx, r))
 		})
 		spawn("init", parallel.Fail, func(ctx context.Context) error {
 			log := logger.Get(ctx)
 
-			defer func() {
-				// terminating all the processes may start after exit of the main logic, so we are sure
-				// that no new process is started by the app.
-				<-appTerminatedCh
-
-				runningErr := errors.New("children processes are still running")
-				timeout := time.After(time.Minute)
-				for {
-					err := func() error {
-						children, err := subProcesses(procFSPath, pid)
-						if err != nil {
-							return err
-						}
-
-						log.Info("Terminating leftover processes", zap.Int("count", len(children)))
-
-						var running uint32
-
-						//nolint:nestif
-						if len(children) > 0 {
-							for _, properties := range children {
-								childPID, err := strconv.Atoi(properties[pidIndex])
-								if err != nil {
-									return errors.WithStack(err)
-								}
-
-								proc, err := os.FindProcess(childPID)
-								if err != nil {
-									return errors.WithStack(err)
-								}
-
-								log := log.With(
-									zap.Int("pid", childPID),
-									zap.String("state", properties[stateIndex]),
-									zap.String("command", properties[commandIndex]),
-								)
-
-								if properties[stateIndex] == zombieState {
-									if _, err := proc.Wait(); err != nil {
-										return errors.WithStack(err)
-									}
-									log.Info("Zombie process deleted")
-									continue
-								}
-
-								running++
-								select {
-								case <-timeout:
-									log.Error("Killing process")
-									if err := proc.Signal(syscall.SIGKILL); err != nil &&
-										!errors.Is(err, os.ErrProcessDone) {
-										return errors.WithStack(err)
-									}
-								default:
-									log.Warn("Terminating process")
-									if err := proc.Signal(syscall.SIGTERM); err != nil &&
-										!errors.Is(err, os.ErrProcessDone) {
-										return errors.WithStack(err)
-									}
-									if err := proc.Signal(syscall.SIGINT); err != nil &&
-										!errors.Is(err, os.ErrProcessDone) {
-										return errors.WithStack(err)
-									}
-								}
-							}
-							return runningErr
-						}
-						return nil
-					}()
-
-					switch {
-					case err == nil:
-						log.Info("No more processes running. Exiting.")
-						return
-					case errors.Is(err, runningErr):
-					default:
-						log.Error("Error while terminating processes", zap.Error(err))
-					}
-
-					<-time.After(time.Second)
+			// Processes are reaped until app exits, even if context is canceled, because app might be still waiting
+			// for its processes to exit.
+			for {
+				if err := r.reap(log); err != nil {
+					log.Error("Reaping processes failed", zap.Error(err))
 				}
-			}()
 
-			var zombies map[int]string
-
-			for {
 				select {
-				case <-ctx.Done():
+				case <-appTerminatedCh:
+					// terminating all the processes may start after exit of the main logic, so we are sure
+					// that no new process is started by the app.
+					terminateChildren(log, r, procFSPath, pid, sigCh)
 					return errors.WithStack(ctx.Err())
-				case <-time.After(30 * time.Second):
+				case <-sigCh:
 				}
+			}
+		})
 
-				for zPID, command := range zombies {
-					proc, err := os.FindProcess(zPID)
-					if err != nil {
-						return errors.WithStack(err)
-					}
-					if _, err := proc.Wait(); err != nil {
-						return errors.WithStack(err)
-					}
+		return nil
+	})
+}
 
-					log.Info("Zombie process deleted", zap.Int("pid", zPID),
-						zap.String("command", command))
-				}
+func terminateChildren(log *zap.Logger, r *reaper, procFSPath, pid string, sigCh <-chan os.Signal) {
+	timeout := time.After(time.Minute)
+	terminated := map[int]bool{}
+	var kill bool
+
+	for {
+		if err := r.reap(log); err != nil {
+			log.Error("Reaping processes failed", zap.Error(err))
+		}
+
+		children, err := subProcesses(procFSPath, pid)
+		if err != nil {
+			log.Error("Error while terminating processes", zap.Error(err))
+			return
+		}
+
+		if len(children) == 0 {
+			log.Info("No more processes running. Exiting.")
+			return
+		}
 
-				zombies = map[int]string{}
+		log.Info("Terminating leftover processes", zap.Int("count", len(children)))
 
-				children, err := subProcesses(procFSPath, pid)
-				if err != nil {
-					return err
+		for _, properties := range children {
+			// zombie is reaped once SIGCHLD is received
+			if properties[stateIndex] == zombieState {
+				continue
+			}
+
+			childPID, err := strconv.Atoi(properties[pidIndex])
+			if err != nil {
+				log.Error("Error while terminating processes", zap.Error(err))
+				return
+			}
+
+			log := log.With(
+				zap.Int("pid", childPID),
+				zap.String("state", properties[stateIndex]),
+				zap.String("command", properties[commandIndex]),
+			)
+
+			switch {
+			case kill:
+				log.Error("Killing process")
+				if err := syscall.Kill(childPID, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+					log.Error("Killing process failed", zap.Error(err))
 				}
-				for _, properties := range children {
-					if properties[stateIndex] != zombieState {
-						continue
-					}
+			case !terminated[childPID]:
+				terminated[childPID] = true
 
-					zombiePID, err := strconv.Atoi(properties[pidIndex])
-					if err != nil {
-						return errors.WithStack(err)
+				log.Warn("Terminating process")
+				for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGINT} {
+					if err := syscall.Kill(childPID, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+						log.Error("Terminating process failed", zap.Error(err))
 					}
-
-					zombies[zombiePID] = properties[commandIndex]
 				}
 			}
-		})
+		}
 
-		return nil
-	})
+		select {
+		case <-sigCh:
+		case <-timeout:
+			kill = true
+		}
+	}
 }
 
 func findProcfs() (string, string, error) {
@@ -0,0 +1,196 @@
+package initprocess
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/parallel"
+)
+
+type reaperKey struct{}
+
+// Exit describes the process reaped by the init process.
+type Exit struct {
+	// PID is the PID of the process.
+	PID int
+
+	// Status is the exit status of the process.
+	Status syscall.WaitStatus
+
+	// Rusage is the resource usage of the process.
+	Rusage syscall.Rusage
+}
+
+// Start starts the command. Processes started by the app running inside init process must be started using this
+// function and awaited using Wait, otherwise their exit status might be consumed by the reaper.
+func Start(ctx context.Context, cmd *exec.Cmd) error {
+	r := reaperFromContext(ctx)
+	if r == nil {
+		return errors.WithStack(cmd.Start())
+	}
+
+	// Reaper can't run while process is being started, otherwise it might reap it before it is registered.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		return errors.WithStack(err)
+	}
+	r.waiters[cmd.Process.Pid] = make(chan Exit, 1)
+	return nil
+}
+
+// Wait waits until command started by Start exits and its I/O is completed.
+func Wait(ctx context.Context, cmd *exec.Cmd) (Exit, error) {
+	r := reaperFromContext(ctx)
+	if r == nil {
+		err := cmd.Wait()
+		if cmd.ProcessState == nil {
+			return Exit{}, errors.WithStack(err)
+		}
+		exit := Exit{
+			PID: cmd.ProcessState.Pid(),
+		}
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+			exit.Status = status
+		}
+		if rusage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok && rusage != nil {
+			exit.Rusage = *rusage
+		}
+		return exit, nil
+	}
+
+	pid := cmd.Process.Pid
+
+	r.mu.Lock()
+	waitCh, exists := r.waiters[pid]
+	r.mu.Unlock()
+
+	if !exists {
+		return Exit{}, errors.Errorf("process %d hasn't been started by the init process", pid)
+	}
+
+	exit := <-waitCh
+
+	r.mu.Lock()
+	delete(r.waiters, pid)
+	r.mu.Unlock()
+
+	// Process has been already reaped, so error is expected here. cmd.Wait is called only to wait until
+	// the I/O of the command is completed and to release its resources.
+	_ = cmd.Wait()
+
+	return exit, nil
+}
+
+// Exec runs the command using Start and Wait. Stop signal is sent to the process when context is canceled.
+func Exec(ctx context.Context, cmd *exec.Cmd, stopSignal syscall.Signal) error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	if cmd.Stdin == nil {
+		// Otherwise /dev/null is opened, which does not exist in the root not configured by the executor.
+		cmd.Stdin = bytes.NewReader(nil)
+	}
+
+	if err := Start(ctx, cmd); err != nil {
+		return err
+	}
+
+	exitedCh := make(chan struct{})
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("cmd", parallel.Exit, func(ctx context.Context) error {
+			defer close(exitedCh)
+
+			exit, err := Wait(ctx, cmd)
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return errors.WithStack(ctx.Err())
+			}
+			switch {
+			case exit.Status.Signaled():
+				return errors.Errorf("command %s terminated by signal: %s", cmd, exit.Status.Signal())
+			case exit.Status.ExitStatus() != 0:
+				return errors.Errorf("command %s exited with status %d", cmd, exit.Status.ExitStatus())
+			default:
+				return nil
+			}
+		})
+		spawn("ctx", parallel.Fail, func(ctx context.Context) error {
+			<-ctx.Done()
+			select {
+			case <-exitedCh:
+			default:
+				_ = cmd.Process.Signal(stopSignal)
+			}
+			return errors.WithStack(ctx.Err())
+		})
+		return nil
+	})
+}
+
+func withReaper(ctx context.Context, r *reaper) context.Context {
+	return context.WithValue(ctx, reaperKey{}, r)
+}
+
+func reaperFromContext(ctx context.Context) *reaper {
+	r, _ := ctx.Value(reaperKey{}).(*reaper)
+	return r
+}
+
+func newReaper() *reaper {
+	return &reaper{
+		waiters: map[int]chan Exit{},
+	}
+}
+
+// reaper awaits all the exited child processes and delivers exit statuses to the waiting ones.
+type reaper struct {
+	mu      sync.Mutex
+	waiters map[int]chan Exit
+}
+
+// reap awaits all the child processes which exited so far.
+func (r *reaper) reap(log *zap.Logger) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		var exit Exit
+		pid, err := syscall.Wait4(-1, &exit.Status, syscall.WNOHANG, &exit.Rusage)
+		switch {
+		case errors.Is(err, syscall.EINTR):
+			continue
+		case errors.Is(err, syscall.ECHILD):
+			return nil
+		case err != nil:
+			return errors.WithStack(err)
+		case pid <= 0:
+			return nil
+		}
+		exit.PID = pid
+
+		log := log.With(zap.Int("pid", pid))
+		if exit.Status.Signaled() {
+			log.Info("Process reaped", zap.Stringer("signal", exit.Status.Signal()))
+		} else {
+			log.Info("Process reaped", zap.Int("exitCode", exit.Status.ExitStatus()))
+		}
+
+		if waitCh, exists := r.waiters[pid]; exists {
+			waitCh <- exit
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package initprocess
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/outofforest/logger"
+	"github.com/outofforest/parallel"
+)
+
+func TestConcurrentExitCodes(t *testing.T) {
+	ctx := logger.WithLogger(context.Background(), zap.NewNop())
+
+	var mu sync.Mutex
+	codes := map[string]int{}
+	var execErr error
+	err := Flavour(ctx, func(ctx context.Context) error {
+		return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+			for name, script := range map[string]string{
+				"slow": "sleep 0.2; exit 3",
+				"fast": "exit 5",
+			} {
+				cmd := exec.Command("/bin/sh", "-c", script)
+				require.NoError(t, Start(ctx, cmd))
+
+				spawn(name, parallel.Continue, func(ctx context.Context) error {
+					exit, err := Wait(ctx, cmd)
+					if err != nil {
+						return err
+					}
+					mu.Lock()
+					defer mu.Unlock()
+
+					codes[name] = exit.Status.ExitStatus()
+					return nil
+				})
+			}
+			spawn("exec", parallel.Continue, func(ctx context.Context) error {
+				execErr = Exec(ctx, exec.Command("/bin/sh", "-c", "sleep 0.1; exit 7"), 0)
+				return nil
+			})
+			return nil
+		})
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]int{"slow": 3, "fast": 5}, codes)
+	require.Error(t, execErr)
+	assert.Contains(t, execErr.Error(), "exited with status 7")
+}
@@ -7,7 +7,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"syscall"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -15,24 +16,68 @@ import (
 	"golang.org/x/sys/unix"
 
 	"github.com/outofforest/isolator/executor"
+	"github.com/outofforest/isolator/lib/cgroup"
 	"github.com/outofforest/isolator/network"
 	"github.com/outofforest/isolator/wire"
 	"github.com/outofforest/logger"
 	"github.com/outofforest/parallel"
 )
 
+const defaultCgroupParent = "isolator"
+
+// cgroupCounter makes names of cgroups created by the process unique.
+var cgroupCounter atomic.Uint64
+
 // ClientFunc defines the client function for isolator.
 type ClientFunc func(ctx context.Context, incoming <-chan interface{}, outgoing chan<- interface{}) error
 
 // Run runs executor server and communication channel.
 //
 //nolint:gocyclo
-func Run(ctx context.Context, config Config, clientFunc ClientFunc) error {
+func Run(ctx context.Context, config Config, clientFunc ClientFunc) (retErr error) {
 	config, err := sanitizeConfig(config)
 	if err != nil {
 		return err
 	}
 
+	// Access to host devices is restricted by the device filter attached to the cgroup.
+	filterDevices := config.Executor.ConfigureSystem && len(config.Executor.HostDevices) > 0
+
+	var cg *cgroup.Cgroup
+	if config.Resources != (Resources{}) || config.StatsInterval > 0 || filterDevices {
+		cg, err = createCgroup(config)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := cg.Delete(); err != nil {
+				if retErr == nil {
+					retErr = err
+				}
+				logger.Get(ctx).Error("Deleting cgroup failed", zap.Error(err))
+			}
+		}()
+
+		// Subtree is delegated to root of the container, so workload may create its own child cgroups.
+		uid, uidMapped := hostID(config.UIDMappings, 0)
+		gid, gidMapped := hostID(config.GIDMappings, 0)
+		if uidMapped && gidMapped {
+			if err := cg.Delegate(int(uid), int(gid)); err != nil {
+				return err
+			}
+		}
+
+		if filterDevices {
+			rules, err := executor.DeviceRules(config.Executor)
+			if err != nil {
+				return err
+			}
+			if err := cg.AllowDevices(rules); err != nil {
+				return err
+			}
+		}
+	}
+
 	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
 		startCh := make(chan struct{})
 		startedCh := make(chan struct{})
@@ -66,6 +111,12 @@ func Run(ctx context.Context, config Config, clientFunc ClientFunc) error {
 				return errors.WithStack(err)
 			}
 
+			if cg != nil {
+				// Executor is started directly inside the cgroup, so limits apply to it from the very beginning.
+				cmd.SysProcAttr.UseCgroupFD = true
+				cmd.SysProcAttr.CgroupFD = cg.FD()
+			}
+
 			if err := cmd.Start(); err != nil {
 				return errors.WithStack(err)
 			}
@@ -86,7 +137,7 @@ func Run(ctx context.Context, config Config, clientFunc ClientFunc) error {
 			<-ctx.Done()
 
 			_ = inPipe.Close()
-			timeout := time.After(time.Minute)
+			timeout := time.After(config.StopTimeout)
 
 			select {
 			case <-startedCh:
@@ -97,6 +148,11 @@ func Run(ctx context.Context, config Config, clientFunc ClientFunc) error {
 					case <-timeout:
 						_ = cmd.Process.Signal(unix.SIGKILL)
 					case <-time.After(100 * time.Millisecond):
+						// Signal is sent repeatedly because executor ignores it until handler is installed.
+						if config.StopSignal != 0 {
+							_ = cmd.Process.Signal(config.StopSignal)
+							continue
+						}
 						_ = cmd.Process.Signal(unix.SIGTERM)
 						_ = cmd.Process.Signal(unix.SIGINT)
 					}
@@ -128,11 +184,22 @@ func Run(ctx context.Context, config Config, clientFunc ClientFunc) error {
 					serverStarted = true
 					close(startCh)
 
-					if config.Executor.IP != nil {
+					if config.Executor.IP != nil || config.Rootless {
+						var pid int
 						select {
 						case <-ctx.Done():
 							return errors.WithStack(ctx.Err())
-						case pid := <-cmdPIDCh:
+						case pid = <-cmdPIDCh:
+						}
+
+						// Executor waits for the config, so mappings are written before it does anything else.
+						if config.Rootless {
+							if err := writeIDMappings(ctx, pid, config.UIDMappings, config.GIDMappings); err != nil {
+								return err
+							}
+						}
+
+						if config.Executor.IP != nil {
 							exposedPorts := make([]network.ExposedPort, 0, len(config.ExposedPorts))
 							for _, p := range config.ExposedPorts {
 								exposedPorts = append(exposedPorts, network.ExposedPort{
@@ -181,18 +248,80 @@ func Run(ctx context.Context, config Config, clientFunc ClientFunc) error {
 		spawn("isolator.receiver", parallel.Fail, func(ctx context.Context) error {
 			defer close(incoming)
 
-			decode := wire.NewDecoder(outPipe, config.Types)
-			for {
-				content, err := decode()
-				if err != nil {
-					if errors.Is(err, io.EOF) {
-						return errors.WithStack(ctx.Err())
+			var oom *oomReporter
+			if cg != nil {
+				oom = &oomReporter{oomKills: cg.OOMKills, incoming: incoming}
+			}
+
+			return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+				spawn("decoder", parallel.Exit, func(ctx context.Context) error {
+					decode := wire.NewDecoder(outPipe, config.Types)
+					for {
+						content, err := decode()
+						if err != nil {
+							if errors.Is(err, io.EOF) {
+								return errors.WithStack(ctx.Err())
+							}
+							return errors.WithStack(err)
+						}
+
+						// Process killed by OOM killer is counted before its result is produced, so reporting kills
+						// here guarantees that OOM event is delivered before the result.
+						if _, ok := content.(wire.Result); ok && oom != nil {
+							if err := oom.Report(ctx); err != nil {
+								return err
+							}
+						}
+
+						incoming <- content
 					}
-					return errors.WithStack(err)
+				})
+				if oom != nil {
+					spawn("oom", parallel.Continue, func(ctx context.Context) error {
+						return cg.WatchOOMKills(ctx, func(uint64) error {
+							return oom.Report(ctx)
+						})
+					})
 				}
+				if cg != nil && config.StatsInterval > 0 {
+					spawn("stats", parallel.Continue, func(ctx context.Context) error {
+						ticker := time.NewTicker(config.StatsInterval)
+						defer ticker.Stop()
+
+						for {
+							select {
+							case <-ctx.Done():
+								return errors.WithStack(ctx.Err())
+							case <-ticker.C:
+							}
 
-				incoming <- content
-			}
+							stats, err := cg.Stats()
+							if err != nil {
+								return err
+							}
+
+							select {
+							case <-ctx.Done():
+								return errors.WithStack(ctx.Err())
+							case incoming <- wire.Stats{
+								Time:          time.Now().UTC(),
+								CPUUsage:      stats.CPUUsage,
+								CPUUser:       stats.CPUUser,
+								CPUSystem:     stats.CPUSystem,
+								MemoryCurrent: stats.MemoryCurrent,
+								MemoryPeak:    stats.MemoryPeak,
+								Pids:          stats.Pids,
+								IOReadBytes:   stats.IOReadBytes,
+								IOWriteBytes:  stats.IOWriteBytes,
+								OOMKills:      stats.OOMKills,
+							}:
+							}
+						}
+					})
+				}
+
+				return nil
+			})
 		})
 		spawn("isolator.client", parallel.Exit, func(ctx context.Context) error {
 			defer close(outgoing)
@@ -203,13 +332,67 @@ func Run(ctx context.Context, config Config, clientFunc ClientFunc) error {
 	})
 }
 
+// oomReporter sends OOM events reporting processes killed by OOM killer inside cgroup since the previous event.
+type oomReporter struct {
+	oomKills func() (uint64, error)
+	incoming chan<- interface{}
+
+	mu    sync.Mutex
+	kills uint64
+}
+
+// Report sends OOM event if any process has been killed since the previous report.
+func (r *oomReporter) Report(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kills, err := r.oomKills()
+	if err != nil {
+		return err
+	}
+	if kills <= r.kills {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	case r.incoming <- wire.OOMEvent{
+		Time:  time.Now().UTC(),
+		Kills: kills - r.kills,
+	}:
+	}
+	r.kills = kills
+	return nil
+}
+
 func sanitizeConfig(config Config) (Config, error) {
 	if config.ExecutorArg == "" {
 		config.ExecutorArg = executor.DefaultArg
 	}
+	if config.StopTimeout == 0 {
+		config.StopTimeout = time.Minute
+	}
+	if config.Rootless && config.Executor.IP != nil {
+		return Config{}, errors.New("network can't be configured in rootless mode")
+	}
+
+	var err error
+	config.UIDMappings, config.GIDMappings, err = idMappings(config)
+	if err != nil {
+		return Config{}, err
+	}
+	// Executor must know the stop signal to install the handler for it.
+	config.Executor.StopSignal = config.StopSignal
+	if config.Executor.Root != nil {
+		root, err := absMount(*config.Executor.Root)
+		if err != nil {
+			return Config{}, err
+		}
+		config.Executor.Root = &root
+	}
 	for i, m := range config.Executor.Mounts {
-		var err error
-		config.Executor.Mounts[i].Host, err = filepath.Abs(m.Host)
+		config.Executor.Mounts[i], err = absMount(m)
 		if err != nil {
 			return Config{}, err
 		}
@@ -217,6 +400,55 @@ func sanitizeConfig(config Config) (Config, error) {
 	return config, nil
 }
 
+// absMount converts host paths used by mount to absolute ones.
+func absMount(m wire.Mount) (wire.Mount, error) {
+	var err error
+	switch m.Type {
+	case "", wire.MountBind, wire.MountRBind:
+		if m.Host, err = filepath.Abs(m.Host); err != nil {
+			return wire.Mount{}, errors.WithStack(err)
+		}
+	case wire.MountOverlay:
+		lower := make([]string, 0, len(m.OverlayLower))
+		for _, dir := range m.OverlayLower {
+			dir, err := filepath.Abs(dir)
+			if err != nil {
+				return wire.Mount{}, errors.WithStack(err)
+			}
+			lower = append(lower, dir)
+		}
+		m.OverlayLower = lower
+		if m.OverlayUpper != "" {
+			if m.OverlayUpper, err = filepath.Abs(m.OverlayUpper); err != nil {
+				return wire.Mount{}, errors.WithStack(err)
+			}
+			if m.OverlayWork, err = filepath.Abs(m.OverlayWork); err != nil {
+				return wire.Mount{}, errors.WithStack(err)
+			}
+		}
+	}
+	return m, nil
+}
+
+func createCgroup(config Config) (*cgroup.Cgroup, error) {
+	parent := config.Resources.CgroupParent
+	if parent == "" {
+		parent = defaultCgroupParent
+	}
+
+	return cgroup.Create(filepath.Join(parent, fmt.Sprintf("%s-%d-%d", filepath.Base(config.Dir), os.Getpid(),
+		cgroupCounter.Add(1))), cgroup.Limits{
+		MemoryMax:     config.Resources.MemoryMax,
+		MemoryHigh:    config.Resources.MemoryHigh,
+		MemorySwapMax: config.Resources.MemorySwapMax,
+		CPUWeight:     config.Resources.CPUWeight,
+		CPUQuota:      config.Resources.CPUQuota,
+		CPUPeriod:     config.Resources.CPUPeriod,
+		PidsMax:       config.Resources.PidsMax,
+		IOWeight:      config.Resources.IOWeight,
+	})
+}
+
 func newExecutorServerCommand(config Config) *exec.Cmd {
 	cmd := exec.Command("/proc/self/exe", config.ExecutorArg, filepath.Base(config.Dir))
 	cmd.Dir = filepath.Dir(config.Dir)
@@ -232,21 +464,16 @@ func newExecutorServerCommand(config Config) *exec.Cmd {
 		AmbientCaps: []uintptr{
 			unix.CAP_SYS_ADMIN, // by adding CAP_SYS_ADMIN executor may mount /proc
 		},
-		UidMappings: []syscall.SysProcIDMap{
-			{
-				HostID:      0,
-				ContainerID: 0,
-				Size:        65535,
-			},
-		},
-		GidMappingsEnableSetgroups: true,
-		GidMappings: []syscall.SysProcIDMap{
-			{
-				HostID:      0,
-				ContainerID: 0,
-				Size:        65535,
-			},
-		},
+	}
+
+	if config.Rootless {
+		// Mappings are written by newuidmap and newgidmap after executor is started. Until then, executor is not
+		// root inside namespace, so capabilities are not granted to it on exec unless they are ambient.
+		cmd.SysProcAttr.AmbientCaps = allCapabilities()
+	} else {
+		cmd.SysProcAttr.UidMappings = toSysProcIDMap(config.UIDMappings)
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = true
+		cmd.SysProcAttr.GidMappings = toSysProcIDMap(config.GIDMappings)
 	}
 
 	if !config.Executor.UseHostNetwork {
@@ -0,0 +1,37 @@
+package isolator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/isolator/lib/test"
+	"github.com/outofforest/isolator/wire"
+)
+
+func TestOOMReporter(t *testing.T) {
+	ctx := test.Context(t)
+
+	var kills uint64
+	incoming := make(chan interface{}, 10)
+	oom := &oomReporter{
+		oomKills: func() (uint64, error) {
+			return kills, nil
+		},
+		incoming: incoming,
+	}
+
+	// Nothing is reported until processes are killed.
+	require.NoError(t, oom.Report(ctx))
+	assert.Empty(t, incoming)
+
+	// Only the processes killed since the previous report are reported.
+	for _, total := range []uint64{2, 2, 5} {
+		kills = total
+		require.NoError(t, oom.Report(ctx))
+	}
+	require.Len(t, incoming, 2)
+	assert.Equal(t, uint64(2), (<-incoming).(wire.OOMEvent).Kills)
+	assert.Equal(t, uint64(3), (<-incoming).(wire.OOMEvent).Kills)
+}
@@ -0,0 +1,464 @@
+package cgroup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/outofforest/parallel"
+)
+
+// Root is the path where cgroup v2 hierarchy is mounted.
+const Root = "/sys/fs/cgroup"
+
+var statsControllers = []string{"memory", "pids", "io"}
+
+// delegationFiles are the interface files which must be owned by the delegatee to manage subtree of the cgroup.
+var delegationFiles = []string{"cgroup.procs", "cgroup.subtree_control", "cgroup.threads"}
+
+// Limits defines resource limits applied to cgroup.
+type Limits struct {
+	// MemoryMax is the hard limit of memory usage in bytes. Zero means no limit.
+	MemoryMax int64
+
+	// MemoryHigh is the memory usage in bytes above which processes are throttled. Zero means no limit.
+	MemoryHigh int64
+
+	// MemorySwapMax is the limit of swap usage in bytes. Zero means no limit, negative value disables swap.
+	MemorySwapMax int64
+
+	// CPUWeight is the relative share of CPU time, in range 1-10000. Zero means default weight.
+	CPUWeight uint64
+
+	// CPUQuota is the CPU time available within each CPUPeriod. Zero means no limit.
+	CPUQuota time.Duration
+
+	// CPUPeriod is the period used by CPUQuota. Zero means 100ms.
+	CPUPeriod time.Duration
+
+	// PidsMax is the maximum number of processes. Zero means no limit.
+	PidsMax int64
+
+	// IOWeight is the relative share of block IO, in range 1-10000. Zero means default weight.
+	IOWeight uint64
+}
+
+// Validate validates limits.
+func (l Limits) Validate() error {
+	if l.MemoryMax < 0 || l.MemoryHigh < 0 || l.PidsMax < 0 || l.CPUQuota < 0 || l.CPUPeriod < 0 {
+		return errors.New("resource limits must not be negative")
+	}
+	if l.CPUWeight > 10000 {
+		return errors.Errorf("cpu weight %d is out of range 1-10000", l.CPUWeight)
+	}
+	if l.IOWeight > 10000 {
+		return errors.Errorf("io weight %d is out of range 1-10000", l.IOWeight)
+	}
+	if l.CPUPeriod != 0 && l.CPUQuota == 0 {
+		return errors.New("cpu period requires cpu quota to be set")
+	}
+	return nil
+}
+
+// Stats contains resource usage of cgroup. Values provided by controllers which are not enabled are zero.
+type Stats struct {
+	// CPUUsage is the total CPU time consumed.
+	CPUUsage time.Duration
+
+	// CPUUser is the CPU time consumed in user mode.
+	CPUUser time.Duration
+
+	// CPUSystem is the CPU time consumed in kernel mode.
+	CPUSystem time.Duration
+
+	// MemoryCurrent is the current memory usage in bytes.
+	MemoryCurrent int64
+
+	// MemoryPeak is the maximum memory usage in bytes.
+	MemoryPeak int64
+
+	// Pids is the number of running processes.
+	Pids int64
+
+	// IOReadBytes is the number of bytes read from block devices.
+	IOReadBytes uint64
+
+	// IOWriteBytes is the number of bytes written to block devices.
+	IOWriteBytes uint64
+
+	// OOMKills is the number of processes killed by OOM killer.
+	OOMKills uint64
+}
+
+// Cgroup represents created cgroup.
+type Cgroup struct {
+	path string
+	dir  *os.File
+}
+
+// Create creates cgroup under the path relative to the root of cgroup v2 hierarchy, enables required controllers
+// in all its ancestors and applies limits.
+func Create(path string, limits Limits) (*Cgroup, error) {
+	if err := limits.Validate(); err != nil {
+		return nil, err
+	}
+
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(Root, &statfs); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if statfs.Type != unix.CGROUP2_SUPER_MAGIC {
+		return nil, errors.Errorf("cgroup v2 is not mounted at %s", Root)
+	}
+
+	path = filepath.Join(Root, filepath.Clean("/"+path))
+	if path == Root {
+		return nil, errors.New("cgroup path must not be empty")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// Controllers must be enabled in subtree of every ancestor to be available in the created cgroup.
+	ancestors := []string{}
+	for dir := filepath.Dir(path); dir != Root; dir = filepath.Dir(dir) {
+		ancestors = append([]string{dir}, ancestors...)
+	}
+	required := limits.controllers()
+	for _, dir := range append([]string{Root}, ancestors...) {
+		if err := enableControllers(dir, required); err != nil {
+			return nil, err
+		}
+		// Other controllers are enabled to collect statistics, if possible.
+		for _, controller := range statsControllers {
+			_ = enableControllers(dir, []string{controller})
+		}
+	}
+
+	if err := os.Mkdir(path, 0o755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	cg := &Cgroup{path: path}
+	if err := cg.applyLimits(limits); err != nil {
+		_ = cg.Delete()
+		return nil, err
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		_ = cg.Delete()
+		return nil, errors.WithStack(err)
+	}
+	cg.dir = dir
+
+	return cg, nil
+}
+
+// Path returns the path of cgroup.
+func (c *Cgroup) Path() string {
+	return c.path
+}
+
+// FD returns the descriptor of cgroup directory, used to start process directly inside cgroup.
+func (c *Cgroup) FD() int {
+	return int(c.dir.Fd())
+}
+
+// Stats returns resource usage of cgroup.
+func (c *Cgroup) Stats() (Stats, error) {
+	var stats Stats
+
+	cpuStat, err := c.readKeyValues("cpu.stat")
+	if err != nil {
+		return Stats{}, err
+	}
+	stats.CPUUsage = time.Duration(cpuStat["usage_usec"]) * time.Microsecond
+	stats.CPUUser = time.Duration(cpuStat["user_usec"]) * time.Microsecond
+	stats.CPUSystem = time.Duration(cpuStat["system_usec"]) * time.Microsecond
+
+	if stats.MemoryCurrent, err = c.readInt("memory.current"); err != nil {
+		return Stats{}, err
+	}
+	if stats.MemoryPeak, err = c.readInt("memory.peak"); err != nil {
+		return Stats{}, err
+	}
+	if stats.Pids, err = c.readInt("pids.current"); err != nil {
+		return Stats{}, err
+	}
+	if stats.OOMKills, err = c.OOMKills(); err != nil {
+		return Stats{}, err
+	}
+
+	ioStat, err := os.ReadFile(filepath.Join(c.path, "io.stat"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Stats{}, errors.WithStack(err)
+	}
+	// Each line contains statistics of single device, e.g.: 8:16 rbytes=1459200 wbytes=314773504 rios=192 ...
+	for _, line := range strings.Split(string(ioStat), "\n") {
+		for _, field := range strings.Fields(line) {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return Stats{}, errors.WithStack(err)
+			}
+			switch key {
+			case "rbytes":
+				stats.IOReadBytes += v
+			case "wbytes":
+				stats.IOWriteBytes += v
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// OOMKills returns the number of processes killed by OOM killer inside cgroup.
+func (c *Cgroup) OOMKills() (uint64, error) {
+	events, err := c.readKeyValues("memory.events")
+	if err != nil {
+		return 0, err
+	}
+	return events["oom_kill"], nil
+}
+
+// WatchOOMKills calls the function whenever OOM killer kills processes inside cgroup, passing the number of processes
+// killed since the previous call. It returns once context is canceled. Nothing is watched if memory controller is not
+// enabled in cgroup.
+func (c *Cgroup) WatchOOMKills(ctx context.Context, onKills func(kills uint64) error) error {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// Descriptor is nonblocking, so reading is handled by the runtime poller and interrupted once file is closed.
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer f.Close()
+
+	// Modification of memory.events is reported by the kernel whenever any counter changes.
+	if _, err := unix.InotifyAddWatch(fd, filepath.Join(c.path, "memory.events"), unix.IN_MODIFY); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+
+	last, err := c.OOMKills()
+	if err != nil {
+		return err
+	}
+
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("watcher", parallel.Fail, func(ctx context.Context) error {
+			buf := make([]byte, 4096)
+			for {
+				if _, err := f.Read(buf); err != nil {
+					if ctx.Err() != nil {
+						return errors.WithStack(ctx.Err())
+					}
+					return errors.WithStack(err)
+				}
+
+				kills, err := c.OOMKills()
+				if err != nil {
+					return err
+				}
+				if kills <= last {
+					continue
+				}
+				if err := onKills(kills - last); err != nil {
+					return err
+				}
+				last = kills
+			}
+		})
+		spawn("closer", parallel.Fail, func(ctx context.Context) error {
+			<-ctx.Done()
+			_ = f.Close()
+			return errors.WithStack(ctx.Err())
+		})
+		return nil
+	})
+}
+
+// Delegate passes the ownership of cgroup to the user, so processes running as that user may create child cgroups and
+// move processes between them. Files setting limits of the cgroup itself are still owned by the creator. If hierarchy
+// is mounted with nsdelegate option, kernel additionally prevents processes inside cgroup namespace from writing to
+// interface files of its root.
+func (c *Cgroup) Delegate(uid, gid int) error {
+	if err := os.Chown(c.path, uid, gid); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, file := range delegationFiles {
+		// cgroup.threads does not exist on older kernels.
+		if err := os.Chown(filepath.Join(c.path, file), uid, gid); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// Delete kills all the processes remaining in cgroup and deletes it.
+func (c *Cgroup) Delete() error {
+	if c.dir != nil {
+		_ = c.dir.Close()
+	}
+
+	// cgroup.kill is not available on older kernels, in that case processes are expected to exit on their own.
+	if err := os.WriteFile(filepath.Join(c.path, "cgroup.kill"), []byte("1"), 0o600); err != nil &&
+		!errors.Is(err, os.ErrNotExist) {
+		return errors.WithStack(err)
+	}
+
+	// cgroup can't be deleted until killed processes exit.
+	timeout := time.After(10 * time.Second)
+	for {
+		err := syscall.Rmdir(c.path)
+		switch {
+		case err == nil, errors.Is(err, syscall.ENOENT):
+			return nil
+		case !errors.Is(err, syscall.EBUSY):
+			return errors.WithStack(err)
+		}
+
+		select {
+		case <-timeout:
+			return errors.Errorf("cgroup %s is still busy", c.path)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (c *Cgroup) applyLimits(limits Limits) error {
+	for file, value := range limits.values() {
+		if err := os.WriteFile(filepath.Join(c.path, file), []byte(value), 0o600); err != nil {
+			return errors.Wrapf(err, "setting %s to %q failed", file, value)
+		}
+	}
+	return nil
+}
+
+// values returns content of interface files setting limits.
+func (l Limits) values() map[string]string {
+	values := map[string]string{}
+	if l.MemoryMax > 0 {
+		values["memory.max"] = fmt.Sprintf("%d", l.MemoryMax)
+	}
+	if l.MemoryHigh > 0 {
+		values["memory.high"] = fmt.Sprintf("%d", l.MemoryHigh)
+	}
+	switch {
+	case l.MemorySwapMax > 0:
+		values["memory.swap.max"] = fmt.Sprintf("%d", l.MemorySwapMax)
+	case l.MemorySwapMax < 0:
+		values["memory.swap.max"] = "0"
+	}
+	if l.CPUWeight > 0 {
+		values["cpu.weight"] = fmt.Sprintf("%d", l.CPUWeight)
+	}
+	if l.CPUQuota > 0 {
+		period := l.CPUPeriod
+		if period == 0 {
+			period = 100 * time.Millisecond
+		}
+		values["cpu.max"] = fmt.Sprintf("%d %d", l.CPUQuota.Microseconds(), period.Microseconds())
+	}
+	if l.PidsMax > 0 {
+		values["pids.max"] = fmt.Sprintf("%d", l.PidsMax)
+	}
+	if l.IOWeight > 0 {
+		values["io.weight"] = fmt.Sprintf("default %d", l.IOWeight)
+	}
+	return values
+}
+
+// readInt reads file containing single integer. Zero is returned if file does not exist.
+func (c *Cgroup) readInt(file string) (int64, error) {
+	content, err := os.ReadFile(filepath.Join(c.path, file))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return 0, nil
+	case err != nil:
+		return 0, errors.WithStack(err)
+	}
+
+	v, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	return v, errors.WithStack(err)
+}
+
+// readKeyValues reads file containing lines in form of "key value". Empty map is returned if file does not exist.
+func (c *Cgroup) readKeyValues(file string) (map[string]uint64, error) {
+	content, err := os.ReadFile(filepath.Join(c.path, file))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return map[string]uint64{}, nil
+	case err != nil:
+		return nil, errors.WithStack(err)
+	}
+
+	values := map[string]uint64{}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		values[fields[0]] = v
+	}
+	return values, nil
+}
+
+func (l Limits) controllers() []string {
+	var controllers []string
+	if l.MemoryMax > 0 || l.MemoryHigh > 0 || l.MemorySwapMax != 0 {
+		controllers = append(controllers, "memory")
+	}
+	if l.CPUWeight > 0 || l.CPUQuota > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if l.PidsMax > 0 {
+		controllers = append(controllers, "pids")
+	}
+	if l.IOWeight > 0 {
+		controllers = append(controllers, "io")
+	}
+	return controllers
+}
+
+func enableControllers(dir string, controllers []string) error {
+	enabled, err := os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var toEnable []string
+	for _, c := range controllers {
+		if !slices.Contains(strings.Fields(string(enabled)), c) {
+			toEnable = append(toEnable, "+"+c)
+		}
+	}
+	if len(toEnable) == 0 {
+		return nil
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(toEnable, " ")),
+		0o600); err != nil {
+		return errors.Wrapf(err, "enabling controllers %v in %s failed", toEnable, dir)
+	}
+	return nil
+}
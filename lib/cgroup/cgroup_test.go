@@ -0,0 +1,210 @@
+package cgroup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/isolator/lib/test"
+)
+
+func TestLimitValues(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Limits   Limits
+		Expected map[string]string
+	}{
+		{
+			Name:     "none",
+			Expected: map[string]string{},
+		},
+		{
+			Name: "memory",
+			Limits: Limits{
+				MemoryMax:     512 * 1024 * 1024,
+				MemoryHigh:    256 * 1024 * 1024,
+				MemorySwapMax: 1024,
+			},
+			Expected: map[string]string{
+				"memory.max":      "536870912",
+				"memory.high":     "268435456",
+				"memory.swap.max": "1024",
+			},
+		},
+		{
+			Name:   "swapDisabled",
+			Limits: Limits{MemorySwapMax: -1},
+			Expected: map[string]string{
+				"memory.swap.max": "0",
+			},
+		},
+		{
+			Name:   "cpuDefaultPeriod",
+			Limits: Limits{CPUQuota: 50 * time.Millisecond, CPUWeight: 200},
+			Expected: map[string]string{
+				"cpu.max":    "50000 100000",
+				"cpu.weight": "200",
+			},
+		},
+		{
+			Name:   "cpuPeriod",
+			Limits: Limits{CPUQuota: 2 * time.Second, CPUPeriod: time.Second},
+			Expected: map[string]string{
+				"cpu.max": "2000000 1000000",
+			},
+		},
+		{
+			Name:   "pidsAndIO",
+			Limits: Limits{PidsMax: 100, IOWeight: 500},
+			Expected: map[string]string{
+				"pids.max":  "100",
+				"io.weight": "default 500",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			require.NoError(t, test.Limits.Validate())
+			assert.Equal(t, test.Expected, test.Limits.values())
+		})
+	}
+}
+
+func TestDelegate(t *testing.T) {
+	dir := t.TempDir()
+	// cgroup.threads is missing like on older kernels.
+	for _, file := range []string{"cgroup.procs", "cgroup.subtree_control"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, file), nil, 0o644))
+	}
+
+	cg := &Cgroup{path: dir}
+	require.NoError(t, cg.Delegate(os.Getuid(), os.Getgid()))
+}
+
+func TestStats(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Files    map[string]string
+		Expected Stats
+	}{
+		{
+			Name:     "noControllers",
+			Files:    map[string]string{},
+			Expected: Stats{},
+		},
+		{
+			Name: "all",
+			Files: map[string]string{
+				"cpu.stat": `usage_usec 1500000
+user_usec 1000000
+system_usec 500000
+nr_periods 0
+nr_throttled 0
+throttled_usec 0
+`,
+				"memory.current": "1048576\n",
+				"memory.peak":    "2097152\n",
+				"pids.current":   "3\n",
+				"memory.events": `low 0
+high 5
+max 10
+oom 2
+oom_kill 1
+oom_group_kill 0
+`,
+				"io.stat": `8:16 rbytes=1459200 wbytes=314773504 rios=192 wios=353 dbytes=0 dios=0
+8:0 rbytes=100 wbytes=200 rios=1 wios=2 dbytes=0 dios=0
+`,
+			},
+			Expected: Stats{
+				CPUUsage:      1500 * time.Millisecond,
+				CPUUser:       time.Second,
+				CPUSystem:     500 * time.Millisecond,
+				MemoryCurrent: 1048576,
+				MemoryPeak:    2097152,
+				Pids:          3,
+				IOReadBytes:   1459300,
+				IOWriteBytes:  314773704,
+				OOMKills:      1,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			for file, content := range test.Files {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, file), []byte(content), 0o644))
+			}
+
+			stats, err := (&Cgroup{path: dir}).Stats()
+			require.NoError(t, err)
+			assert.Equal(t, test.Expected, stats)
+		})
+	}
+}
+
+func TestStatsInvalid(t *testing.T) {
+	for file, content := range map[string]string{
+		"cpu.stat":       "usage_usec abc\n",
+		"memory.current": "max\n",
+		"memory.events":  "oom_kill -1\n",
+		"io.stat":        "8:0 rbytes=abc\n",
+	} {
+		t.Run(file, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, file), []byte(content), 0o644))
+
+			_, err := (&Cgroup{path: dir}).Stats()
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestWatchOOMKills(t *testing.T) {
+	dir := t.TempDir()
+	eventsFile := filepath.Join(dir, "memory.events")
+	require.NoError(t, os.WriteFile(eventsFile, []byte("oom 1\noom_kill 1\n"), 0o644))
+
+	ctx, cancel := context.WithCancel(test.Context(t))
+	defer cancel()
+
+	killsCh := make(chan uint64, 1000)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- (&Cgroup{path: dir}).WatchOOMKills(ctx, func(kills uint64) error {
+			killsCh <- kills
+			return nil
+		})
+	}()
+
+	// Counter is increased until watcher notices it, because watch might not be set up yet.
+	for i := 2; ; i++ {
+		require.NoError(t, os.WriteFile(eventsFile, []byte(fmt.Sprintf("oom %d\noom_kill %d\n", i, i)), 0o644))
+
+		select {
+		case kills := <-killsCh:
+			assert.Positive(t, kills)
+		case <-time.After(10 * time.Millisecond):
+			require.Less(t, i, 500, "OOM kills not reported")
+			continue
+		}
+		break
+	}
+
+	cancel()
+	require.ErrorIs(t, <-errCh, context.Canceled)
+}
+
+func TestWatchOOMKillsNoMemoryController(t *testing.T) {
+	require.NoError(t, (&Cgroup{path: t.TempDir()}).WatchOOMKills(test.Context(t), func(uint64) error {
+		return nil
+	}))
+}
@@ -0,0 +1,199 @@
+package cgroup
+
+import (
+	"math"
+	"runtime"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Device types.
+const (
+	DeviceChar  = 'c'
+	DeviceBlock = 'b'
+)
+
+// AnyDevice matches any major or minor number of device.
+const AnyDevice = -1
+
+// DeviceRule grants access to devices.
+type DeviceRule struct {
+	// Type is the type of device, DeviceChar or DeviceBlock.
+	Type rune
+
+	// Major is the major number of device, AnyDevice matches all of them.
+	Major int64
+
+	// Minor is the minor number of device, AnyDevice matches all of them.
+	Minor int64
+
+	// Access is the combination of r (read), w (write) and m (mknod).
+	Access string
+}
+
+// Registers of eBPF machine used by the device filter.
+const (
+	regResult = iota
+	regCtx
+	regAccess
+	regType
+	regMajor
+	regMinor
+)
+
+// Offsets of fields in struct bpf_cgroup_dev_ctx.
+const (
+	offsetAccessType = 0
+	offsetMajor      = 4
+	offsetMinor      = 8
+)
+
+// bpfInstruction is the eBPF instruction in the format of struct bpf_insn.
+type bpfInstruction struct {
+	Code uint8
+	Regs uint8
+	Off  int16
+	Imm  int32
+}
+
+func bpfInsn(code uint8, dst, src uint8, off int16, imm int32) bpfInstruction {
+	return bpfInstruction{Code: code, Regs: src<<4 | dst, Off: off, Imm: imm}
+}
+
+// AllowDevices attaches filter to cgroup, allowing access to the devices matching the rules only.
+func (c *Cgroup) AllowDevices(rules []DeviceRule) error {
+	program, err := compileDeviceFilter(rules)
+	if err != nil {
+		return err
+	}
+
+	license := []byte("GPL\x00")
+	loadAttr := struct {
+		ProgType uint32
+		InsnCnt  uint32
+		Insns    uint64
+		License  uint64
+	}{
+		ProgType: unix.BPF_PROG_TYPE_CGROUP_DEVICE,
+		InsnCnt:  uint32(len(program)),
+		Insns:    uint64(uintptr(unsafe.Pointer(&program[0]))),
+		License:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	progFD, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_LOAD, uintptr(unsafe.Pointer(&loadAttr)),
+		unsafe.Sizeof(loadAttr))
+	runtime.KeepAlive(program)
+	runtime.KeepAlive(license)
+	if errno != 0 {
+		return errors.Wrap(errno, "loading device filter failed")
+	}
+	// Cgroup keeps the reference to the attached program, so descriptor is not needed afterwards.
+	defer unix.Close(int(progFD))
+
+	attachAttr := struct {
+		TargetFD    uint32
+		AttachBPFFD uint32
+		AttachType  uint32
+		AttachFlags uint32
+	}{
+		TargetFD:    uint32(c.FD()),
+		AttachBPFFD: uint32(progFD),
+		AttachType:  unix.BPF_CGROUP_DEVICE,
+		AttachFlags: unix.BPF_F_ALLOW_MULTI,
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_ATTACH, uintptr(unsafe.Pointer(&attachAttr)),
+		unsafe.Sizeof(attachAttr)); errno != 0 {
+		return errors.Wrap(errno, "attaching device filter failed")
+	}
+	return nil
+}
+
+// compileDeviceFilter compiles rules into eBPF program returning 1 if access is allowed and 0 otherwise.
+func compileDeviceFilter(rules []DeviceRule) ([]bpfInstruction, error) {
+	const (
+		ldxw   = unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W
+		movImm = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K
+		movReg = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_X
+		andImm = unix.BPF_ALU64 | unix.BPF_AND | unix.BPF_K
+		rshImm = unix.BPF_ALU64 | unix.BPF_RSH | unix.BPF_K
+		jneImm = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K
+		jset   = unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K
+		exit   = unix.BPF_JMP | unix.BPF_EXIT
+	)
+
+	// Access type contains the type of device in lower 16 bits and the type of access in upper ones.
+	program := []bpfInstruction{
+		bpfInsn(ldxw, regAccess, regCtx, offsetAccessType, 0),
+		bpfInsn(movReg, regType, regAccess, 0, 0),
+		bpfInsn(andImm, regType, 0, 0, 0xffff),
+		bpfInsn(rshImm, regAccess, 0, 0, 16),
+		bpfInsn(ldxw, regMajor, regCtx, offsetMajor, 0),
+		bpfInsn(ldxw, regMinor, regCtx, offsetMinor, 0),
+	}
+
+	for _, rule := range rules {
+		var devType int32
+		switch rule.Type {
+		case DeviceChar:
+			devType = unix.BPF_DEVCG_DEV_CHAR
+		case DeviceBlock:
+			devType = unix.BPF_DEVCG_DEV_BLOCK
+		default:
+			return nil, errors.Errorf("invalid device type %q", rule.Type)
+		}
+
+		var access int32
+		for _, a := range rule.Access {
+			switch a {
+			case 'r':
+				access |= unix.BPF_DEVCG_ACC_READ
+			case 'w':
+				access |= unix.BPF_DEVCG_ACC_WRITE
+			case 'm':
+				access |= unix.BPF_DEVCG_ACC_MKNOD
+			default:
+				return nil, errors.Errorf("invalid device access %q", rule.Access)
+			}
+		}
+		if access == 0 {
+			continue
+		}
+
+		// Conditions jump to the next rule if they are not met, offsets are resolved once the block is complete.
+		block := []bpfInstruction{bpfInsn(jneImm, regType, 0, 0, devType)}
+		for _, cond := range []struct {
+			Reg   uint8
+			Value int64
+		}{
+			{Reg: regMajor, Value: rule.Major},
+			{Reg: regMinor, Value: rule.Minor},
+		} {
+			if cond.Value == AnyDevice {
+				continue
+			}
+			if cond.Value < 0 || cond.Value > math.MaxInt32 {
+				return nil, errors.Errorf("invalid device number %d", cond.Value)
+			}
+			block = append(block, bpfInsn(jneImm, cond.Reg, 0, 0, int32(uint32(cond.Value))))
+		}
+		const allAccess = unix.BPF_DEVCG_ACC_READ | unix.BPF_DEVCG_ACC_WRITE | unix.BPF_DEVCG_ACC_MKNOD
+		if denied := allAccess &^ access; denied != 0 {
+			block = append(block, bpfInsn(jset, regAccess, 0, 0, denied))
+		}
+		for i := range block {
+			block[i].Off = int16(len(block) + 1 - i)
+		}
+
+		program = append(program, block...)
+		program = append(program,
+			bpfInsn(movImm, regResult, 0, 0, 1),
+			bpfInsn(exit, 0, 0, 0, 0),
+		)
+	}
+
+	return append(program,
+		bpfInsn(movImm, regResult, 0, 0, 0),
+		bpfInsn(exit, 0, 0, 0, 0),
+	), nil
+}
@@ -0,0 +1,372 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/outofforest/logger"
+	"github.com/outofforest/parallel"
+)
+
+const (
+	// Port is the port DNS server listens on.
+	Port = 53
+
+	// resolvConf is the file nameservers of the host are read from.
+	resolvConf = "/etc/resolv.conf"
+
+	// maxMessageSize is the maximum size of DNS message.
+	maxMessageSize = 65535
+
+	// forwardTimeout is the time given to upstream server to respond.
+	forwardTimeout = 5 * time.Second
+
+	// tcpTimeout is the time after which idle TCP connection is closed.
+	tcpTimeout = 10 * time.Second
+)
+
+// defaultUpstream is the list of upstream servers used if host has no nameservers configured.
+var defaultUpstream = []net.IP{
+	net.IPv4(8, 8, 8, 8),
+	net.IPv4(1, 1, 1, 1),
+}
+
+// Config is the configuration of DNS server.
+type Config struct {
+	// Upstream is the list of servers queries for unknown names are forwarded to. If nil, nameservers of the host are
+	// used.
+	Upstream []net.IP
+}
+
+// host is the set of addresses resolved for the name.
+type host struct {
+	IPs []*net.IPNet
+}
+
+// Server resolves names of registered hosts and forwards other queries to upstream servers.
+// Host is visible only to clients connected to any of its networks.
+type Server struct {
+	upstream []net.IP
+
+	mu    sync.RWMutex
+	hosts map[string][]host
+
+	udpConns     []*net.UDPConn
+	tcpListeners []*net.TCPListener
+}
+
+// New creates new DNS server.
+func New(config Config) (*Server, error) {
+	upstream := config.Upstream
+	if upstream == nil {
+		var err error
+		upstream, err = hostNameservers()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(upstream) == 0 {
+		upstream = defaultUpstream
+	}
+
+	return &Server{
+		upstream: upstream,
+		hosts:    map[string][]host{},
+	}, nil
+}
+
+// Add registers host resolved to the addresses. IPv4 addresses are returned for A queries and IPv6 ones for
+// AAAA queries. Masks of addresses define networks host is visible in.
+func (s *Server) Add(name string, ips ...*net.IPNet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name = normalizeName(name)
+	s.hosts[name] = append(s.hosts[name], host{IPs: ips})
+}
+
+// Listen binds the server to UDP and TCP ports of the address. It must be called before Run.
+func (s *Server) Listen(ip net.IP) error {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: Port})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: Port})
+	if err != nil {
+		_ = udpConn.Close()
+		return errors.WithStack(err)
+	}
+
+	s.udpConns = append(s.udpConns, udpConn)
+	s.tcpListeners = append(s.tcpListeners, tcpListener)
+	return nil
+}
+
+// Run serves DNS requests until context is canceled.
+func (s *Server) Run(ctx context.Context) error {
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		for _, conn := range s.udpConns {
+			spawn("udp", parallel.Fail, func(ctx context.Context) error {
+				return s.serveUDP(ctx, conn, spawn)
+			})
+		}
+		for _, listener := range s.tcpListeners {
+			spawn("tcp", parallel.Fail, func(ctx context.Context) error {
+				return s.serveTCP(ctx, listener, spawn)
+			})
+		}
+		spawn("closer", parallel.Fail, func(ctx context.Context) error {
+			<-ctx.Done()
+			for _, conn := range s.udpConns {
+				_ = conn.Close()
+			}
+			for _, listener := range s.tcpListeners {
+				_ = listener.Close()
+			}
+			return errors.WithStack(ctx.Err())
+		})
+		return nil
+	})
+}
+
+func (s *Server) serveUDP(ctx context.Context, conn *net.UDPConn, spawn parallel.SpawnFn) error {
+	for {
+		buf := make([]byte, maxMessageSize)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return errors.WithStack(ctx.Err())
+			}
+			return errors.WithStack(err)
+		}
+
+		spawn("query", parallel.Continue, func(ctx context.Context) error {
+			resp, err := s.handle(ctx, "udp", buf[:n], addr.IP)
+			if err != nil {
+				logger.Get(ctx).Error("Handling DNS query failed", zap.Error(err))
+				return nil
+			}
+			_, _ = conn.WriteToUDP(resp, addr)
+			return nil
+		})
+	}
+}
+
+func (s *Server) serveTCP(ctx context.Context, listener *net.TCPListener, spawn parallel.SpawnFn) error {
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			if ctx.Err() != nil {
+				return errors.WithStack(ctx.Err())
+			}
+			return errors.WithStack(err)
+		}
+
+		spawn("conn", parallel.Continue, func(ctx context.Context) error {
+			defer conn.Close()
+
+			client := conn.RemoteAddr().(*net.TCPAddr).IP
+			for {
+				if err := conn.SetDeadline(time.Now().Add(tcpTimeout)); err != nil {
+					return nil
+				}
+				req, err := readTCPMessage(conn)
+				if err != nil {
+					// Connection closed by the client or being idle for too long.
+					return nil
+				}
+				resp, err := s.handle(ctx, "tcp", req, client)
+				if err != nil {
+					logger.Get(ctx).Error("Handling DNS query failed", zap.Error(err))
+					return nil
+				}
+				if err := writeTCPMessage(conn, resp); err != nil {
+					return nil
+				}
+			}
+		})
+	}
+}
+
+// handle answers the query if it asks for registered host, otherwise it is forwarded to upstream servers.
+func (s *Server) handle(ctx context.Context, network string, req []byte, client net.IP) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ips, exists := s.lookup(question.Name.String(), client)
+	if !exists {
+		return s.forward(ctx, network, req)
+	}
+
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			Authoritative:      true,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+	for _, ip := range ips {
+		var body dnsmessage.ResourceBody
+		ip4 := ip.IP.To4()
+		switch {
+		case question.Type == dnsmessage.TypeA && ip4 != nil:
+			body = &dnsmessage.AResource{A: [net.IPv4len]byte(ip4)}
+		case question.Type == dnsmessage.TypeAAAA && ip4 == nil:
+			body = &dnsmessage.AAAAResource{AAAA: [net.IPv6len]byte(ip.IP.To16())}
+		default:
+			continue
+		}
+
+		// Records are not cached, because addresses of apps may change when they are restarted.
+		resp.Answers = append(resp.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  question.Name,
+				Type:  question.Type,
+				Class: dnsmessage.ClassINET,
+			},
+			Body: body,
+		})
+	}
+
+	data, err := resp.Pack()
+	return data, errors.WithStack(err)
+}
+
+// lookup returns addresses of the hosts registered under the name and visible to the client.
+func (s *Server) lookup(name string, client net.IP) ([]*net.IPNet, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ips []*net.IPNet
+	var exists bool
+	for _, h := range s.hosts[normalizeName(name)] {
+		for _, ip := range h.IPs {
+			if ip.Contains(client) {
+				ips = append(ips, h.IPs...)
+				exists = true
+				break
+			}
+		}
+	}
+	return ips, exists
+}
+
+// forward sends the query to upstream servers and returns the first response received.
+func (s *Server) forward(ctx context.Context, network string, req []byte) ([]byte, error) {
+	err := errors.New("no upstream servers")
+	for _, ip := range s.upstream {
+		var resp []byte
+		resp, err = exchange(ctx, network, net.JoinHostPort(ip.String(), "53"), req)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, errors.Wrap(err, "forwarding query failed")
+}
+
+func exchange(ctx context.Context, network, address string, req []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, forwardTimeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, req); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	buf := make([]byte, maxMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buf[:n], nil
+}
+
+// readTCPMessage reads message prefixed by its length, as it is transmitted over TCP.
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return msg, nil
+}
+
+// writeTCPMessage writes message prefixed by its length, as it is transmitted over TCP.
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > maxMessageSize {
+		return errors.Errorf("message is too large: %d", len(msg))
+	}
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return errors.WithStack(err)
+}
+
+// hostNameservers returns nameservers configured on the host.
+func hostNameservers() ([]net.IP, error) {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	var nameservers []net.IP
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil {
+			nameservers = append(nameservers, ip)
+		}
+	}
+	return nameservers, errors.WithStack(scanner.Err())
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
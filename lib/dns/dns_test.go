@@ -0,0 +1,96 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestHandle(t *testing.T) {
+	s, err := New(Config{})
+	require.NoError(t, err)
+	s.upstream = nil
+
+	_, network4, err := net.ParseCIDR("10.0.1.0/24")
+	require.NoError(t, err)
+	_, network6, err := net.ParseCIDR("fd69:736f:6c61::a00:100/120")
+	require.NoError(t, err)
+
+	s.Add("db", &net.IPNet{IP: net.IPv4(10, 0, 1, 2), Mask: network4.Mask},
+		&net.IPNet{IP: net.ParseIP("fd69:736f:6c61::a00:102"), Mask: network6.Mask})
+	s.Add("Postgres", &net.IPNet{IP: net.IPv4(10, 0, 1, 2), Mask: network4.Mask})
+
+	tests := []struct {
+		Name     string
+		Type     dnsmessage.Type
+		Client   net.IP
+		Expected []string
+	}{
+		{Name: "db.", Type: dnsmessage.TypeA, Client: net.IPv4(10, 0, 1, 3), Expected: []string{"10.0.1.2"}},
+		{
+			Name:     "db.",
+			Type:     dnsmessage.TypeAAAA,
+			Client:   net.IPv4(10, 0, 1, 3),
+			Expected: []string{"fd69:736f:6c61::a00:102"},
+		},
+		{Name: "postgres.", Type: dnsmessage.TypeA, Client: net.IPv4(10, 0, 1, 3), Expected: []string{"10.0.1.2"}},
+		{Name: "postgres.", Type: dnsmessage.TypeAAAA, Client: net.IPv4(10, 0, 1, 3)},
+		{Name: "postgres.", Type: dnsmessage.TypeMX, Client: net.IPv4(10, 0, 1, 3)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name+test.Type.String(), func(t *testing.T) {
+			resp, err := s.handle(context.Background(), "udp", query(t, test.Name, test.Type), test.Client)
+			require.NoError(t, err)
+
+			var msg dnsmessage.Message
+			require.NoError(t, msg.Unpack(resp))
+			assert.Equal(t, uint16(1), msg.Header.ID)
+			assert.True(t, msg.Header.Response)
+			assert.Equal(t, dnsmessage.RCodeSuccess, msg.Header.RCode)
+
+			var ips []string
+			for _, answer := range msg.Answers {
+				switch body := answer.Body.(type) {
+				case *dnsmessage.AResource:
+					ips = append(ips, net.IP(body.A[:]).String())
+				case *dnsmessage.AAAAResource:
+					ips = append(ips, net.IP(body.AAAA[:]).String())
+				}
+			}
+			assert.Equal(t, test.Expected, ips)
+		})
+	}
+}
+
+func TestHandleOtherNetwork(t *testing.T) {
+	s, err := New(Config{})
+	require.NoError(t, err)
+	s.upstream = nil
+
+	s.Add("db", &net.IPNet{IP: net.IPv4(10, 0, 1, 2), Mask: net.CIDRMask(24, 32)})
+
+	// Host is not visible in other network, so query is forwarded to upstream servers and there are none.
+	_, err = s.handle(context.Background(), "udp", query(t, "db.", dnsmessage.TypeA), net.IPv4(10, 0, 2, 3))
+	require.Error(t, err)
+}
+
+func query(t *testing.T, name string, qType dnsmessage.Type) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{
+				Name:  dnsmessage.MustNewName(name),
+				Type:  qType,
+				Class: dnsmessage.ClassINET,
+			},
+		},
+	}
+	data, err := msg.Pack()
+	require.NoError(t, err)
+	return data
+}
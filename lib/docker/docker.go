@@ -14,7 +14,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,45 +26,81 @@ import (
 	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
 
+	"github.com/outofforest/isolator/initprocess"
+	"github.com/outofforest/isolator/lib/passwd"
 	"github.com/outofforest/isolator/lib/retry"
 	"github.com/outofforest/isolator/lib/task"
-	"github.com/outofforest/libexec"
 	"github.com/outofforest/logger"
 	"github.com/outofforest/parallel"
 )
 
-var userGroupRegExp = regexp.MustCompile("^[0-9]+(:[0-9]+)?$")
-
 // InflateImageConfig is the configuration of docker image inflation.
 type InflateImageConfig struct {
 	HTTPClient *http.Client
 	CacheDir   string
 	Image      string
 	Tag        string
+
+	// LayersDir is the directory of the layer store. If set, each layer is extracted once to its own
+	// content-addressed directory in overlayfs format, instead of inflating the image in the current directory.
+	LayersDir string
 }
 
 // RunContainerConfig is the configuration of running docker container.
 type RunContainerConfig struct {
-	CacheDir   string
-	Image      string
-	Tag        string
-	Name       string
-	EnvVars    map[string]string
-	User       string
+	CacheDir string
+	Image    string
+	Tag      string
+	Name     string
+	EnvVars  map[string]string
+
+	// User is the user[:group] the container is run as, both specified by names or IDs. Names are resolved using
+	// /etc/passwd and /etc/group of the image. If empty, the one defined by image is used, root otherwise.
+	User string
+
 	WorkingDir string
 	Entrypoint []string
 	Args       []string
 
+	// StopSignal is the name or number of the signal stopping the container. If empty, the one defined by image
+	// is used, SIGTERM otherwise.
+	StopSignal string
+
 	StdOut io.Writer
 	StdErr io.Writer
+
+	// Exec runs the command of the container, stopSignal should be sent to it when context is canceled.
+	// If nil, initprocess.Exec is used, so exit status of the command is not consumed by the reaper of the executor.
+	Exec func(ctx context.Context, cmd *exec.Cmd, stopSignal syscall.Signal) error
 }
 
-// InflateImage downloads and inflates docker image in the current directory.
+// InflateImage downloads and inflates docker image in the current directory or in the layer store.
 func InflateImage(ctx context.Context, config InflateImageConfig) error {
 	imageClient := newImageClient(config.HTTPClient, config.Image, config.Tag, config.CacheDir)
+	imageClient.layersDir = config.LayersDir
 	return imageClient.Inflate(ctx)
 }
 
+// ImageLayers returns digests of layers of the image downloaded to the cache directory, the bottom one goes first.
+func ImageLayers(cacheDir, image, tag string) ([]string, error) {
+	m, err := newImageClient(nil, image, tag, cacheDir).manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	layers := make([]string, 0, len(m.Layers))
+	for _, l := range m.Layers {
+		layers = append(layers, l.Digest)
+	}
+	return layers, nil
+}
+
+// LayerDir returns the directory of the layer inside the layer store.
+func LayerDir(layersDir, digest string) string {
+	// Colon is not allowed in paths of overlay layers, so algorithm becomes a separate directory.
+	return filepath.Join(layersDir, strings.Replace(digest, ":", "/", 1))
+}
+
 // RunContainer runs container based on docker image.
 func RunContainer(ctx context.Context, config RunContainerConfig) error {
 	imageClient := newImageClient(nil, config.Image, config.Tag, config.CacheDir)
@@ -90,14 +126,16 @@ type containerConfig struct {
 		Entrypoint []string
 		Cmd        []string
 		WorkingDir string
+		StopSignal string
 	} `json:"config"`
 }
 
 type imageClient struct {
-	c        *http.Client
-	image    string
-	tag      string
-	cacheDir string
+	c         *http.Client
+	image     string
+	tag       string
+	cacheDir  string
+	layersDir string
 
 	mu        sync.Mutex
 	authToken string
@@ -149,30 +187,9 @@ func (c *imageClient) Inflate(ctx context.Context) error {
 		case <-doneCh:
 		}
 
-		f, err := os.Open(manifestPath)
+		m, err := c.manifest()
 		if err != nil {
-			return errors.WithStack(err)
-		}
-		defer f.Close()
-
-		var r io.Reader = f
-		var hasher hash.Hash
-		if strings.HasPrefix(c.tag, "sha256:") {
-			hasher = sha256.New()
-			r = io.TeeReader(r, hasher)
-		}
-
-		var m manifest
-		if err := json.NewDecoder(r).Decode(&m); err != nil {
-			return errors.WithStack(err)
-		}
-
-		if hasher != nil {
-			computedDigest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
-			if computedDigest != c.tag {
-				return retry.Retriable(errors.Errorf("manifest digest doesn't match, expected: %s, got: %s",
-					c.tag, computedDigest))
-			}
+			return err
 		}
 
 		if m.MediaType != "application/vnd.oci.image.manifest.v1+json" {
@@ -244,32 +261,17 @@ func (c *imageClient) Inflate(ctx context.Context) error {
 							l := layers[0]
 
 							blobFile := filepath.Join(c.cacheDir, l.Digest+".tgz")
-							log.Info("Inflating blob", zap.String("blobFile", blobFile))
-
-							f, err := os.Open(blobFile)
-							if err != nil {
-								return errors.WithStack(err)
-							}
-							defer f.Close()
-
-							hasher := sha256.New()
-							gr, err := gzip.NewReader(io.TeeReader(f, hasher))
-							if err != nil {
-								return errors.WithStack(err)
+							if c.layersDir != "" {
+								if err := c.extractLayer(ctx, blobFile, l.Digest); err != nil {
+									return err
+								}
+							} else {
+								log.Info("Inflating blob", zap.String("blobFile", blobFile))
+								if err := inflateBlob(blobFile, l.Digest, ".", false); err != nil {
+									return err
+								}
+								log.Info("Blob inflated", zap.String("blobFile", blobFile))
 							}
-							defer gr.Close()
-
-							if err := untar(gr); err != nil {
-								return err
-							}
-
-							computedDigest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
-							if computedDigest != l.Digest {
-								return errors.Errorf("blob digest doesn't match, expected: %s, got: %s",
-									l.Digest, computedDigest)
-							}
-
-							log.Info("Blob inflated", zap.String("blobFile", blobFile))
 
 							layers = layers[1:]
 							tasks = tasks[1:]
@@ -287,20 +289,14 @@ func (c *imageClient) Inflate(ctx context.Context) error {
 	})
 }
 
-func (c *imageClient) RunContainer(ctx context.Context, config RunContainerConfig) error {
+// manifest reads the manifest of the image downloaded to the cache directory.
+func (c *imageClient) manifest() (manifest, error) {
 	fileName := strings.ReplaceAll(c.image, "/", ":")
 	manifestPath := filepath.Join(c.cacheDir, fmt.Sprintf("%s:%s:manifest.json", fileName, c.tag))
 
-	ctx = logger.With(ctx,
-		zap.String("containerName", config.Name),
-		zap.String("manifestPath", manifestPath),
-	)
-	log := logger.Get(ctx)
-	log.Info("Starting container")
-
 	f, err := os.Open(manifestPath)
 	if err != nil {
-		return errors.WithStack(err)
+		return manifest{}, errors.WithStack(err)
 	}
 	defer f.Close()
 
@@ -313,27 +309,113 @@ func (c *imageClient) RunContainer(ctx context.Context, config RunContainerConfi
 
 	var m manifest
 	if err := json.NewDecoder(r).Decode(&m); err != nil {
-		return errors.WithStack(err)
+		return manifest{}, errors.WithStack(err)
 	}
 
 	if hasher != nil {
 		computedDigest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
 		if computedDigest != c.tag {
-			return retry.Retriable(errors.Errorf("manifest digest doesn't match, expected: %s, got: %s", c.tag,
-				computedDigest))
+			return manifest{}, retry.Retriable(errors.Errorf("manifest digest doesn't match, expected: %s, got: %s",
+				c.tag, computedDigest))
+		}
+	}
+
+	return m, nil
+}
+
+// extractLayer extracts the layer to its directory in the layer store, unless it has been already extracted.
+// Layer is extracted to temporary directory first, so it is never seen partially extracted, even if many images
+// sharing it are inflated concurrently.
+func (c *imageClient) extractLayer(ctx context.Context, blobFile, digest string) error {
+	log := logger.Get(ctx).With(zap.String("blobFile", blobFile))
+
+	layerDir := LayerDir(c.layersDir, digest)
+	if _, err := os.Stat(layerDir); err == nil {
+		log.Info("Layer already extracted")
+		return nil
+	}
+
+	log.Info("Extracting layer")
+
+	if err := os.MkdirAll(filepath.Dir(layerDir), 0o700); err != nil {
+		return errors.WithStack(err)
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(layerDir), filepath.Base(layerDir)+".tmp-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := inflateBlob(blobFile, digest, tmpDir, true); err != nil {
+		return err
+	}
+	// Mode of the temporary directory is 0o700, it must be accessible by all the users of the container.
+	if err := os.Chmod(tmpDir, 0o755); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(tmpDir, layerDir); err != nil {
+		// Layer has been extracted by someone else in the meantime.
+		if errors.Is(err, syscall.EEXIST) || errors.Is(err, syscall.ENOTEMPTY) {
+			return nil
 		}
+		return errors.WithStack(err)
+	}
+
+	log.Info("Layer extracted")
+	return nil
+}
+
+// inflateBlob inflates the gzipped layer blob in the root directory and verifies its digest.
+// If layer is true, whiteouts are stored in overlayfs format instead of being applied.
+func inflateBlob(blobFile, digest, root string, layer bool) error {
+	f, err := os.Open(blobFile)
+	if err != nil {
+		return errors.WithStack(err)
 	}
+	defer f.Close()
 
-	f.Close()
+	hasher := sha256.New()
+	gr, err := gzip.NewReader(io.TeeReader(f, hasher))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer gr.Close()
+
+	if err := untar(gr, root, layer); err != nil {
+		return err
+	}
+
+	computedDigest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+	if computedDigest != digest {
+		return errors.Errorf("blob digest doesn't match, expected: %s, got: %s", digest, computedDigest)
+	}
+	return nil
+}
+
+func (c *imageClient) RunContainer(ctx context.Context, config RunContainerConfig) error {
+	fileName := strings.ReplaceAll(c.image, "/", ":")
+	manifestPath := filepath.Join(c.cacheDir, fmt.Sprintf("%s:%s:manifest.json", fileName, c.tag))
+
+	ctx = logger.With(ctx,
+		zap.String("containerName", config.Name),
+		zap.String("manifestPath", manifestPath),
+	)
+	log := logger.Get(ctx)
+	log.Info("Starting container")
+
+	m, err := c.manifest()
+	if err != nil {
+		return err
+	}
 
 	configPath := filepath.Join(c.cacheDir, fmt.Sprintf("%s:%s:config.json", fileName, m.Config.Digest))
-	f, err = os.Open(configPath)
+	f, err := os.Open(configPath)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	defer f.Close()
 
-	hasher = sha256.New()
+	hasher := sha256.New()
 	var cc containerConfig
 	if err := json.NewDecoder(io.TeeReader(f, hasher)).Decode(&cc); err != nil {
 		return errors.WithStack(err)
@@ -366,22 +448,23 @@ func (c *imageClient) RunContainer(ctx context.Context, config RunContainerConfi
 		config.WorkingDir = cc.Config.WorkingDir
 	}
 
-	var userID int
-	var groupID int
-
-	//nolint:nestif
 	if config.User == "" {
 		config.User = cc.Config.User
-		if config.User != "" {
-			if !userGroupRegExp.MatchString(config.User) {
-				return errors.Errorf("invalid user: %s", config.User)
-			}
-			userParts := strings.SplitN(config.User, ":", 2)
-			userID, _ = strconv.Atoi(userParts[0])
+	}
+	userSpec, groupSpec, _ := strings.Cut(config.User, ":")
+	creds, err := passwd.Resolve("/", userSpec, groupSpec, nil)
+	if err != nil {
+		return err
+	}
 
-			if len(userParts) == 2 {
-				groupID, _ = strconv.Atoi(userParts[1])
-			}
+	if config.StopSignal == "" {
+		config.StopSignal = cc.Config.StopSignal
+	}
+	stopSignal := syscall.SIGTERM
+	if config.StopSignal != "" {
+		stopSignal, err = parseSignal(config.StopSignal)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -389,6 +472,9 @@ func (c *imageClient) RunContainer(ctx context.Context, config RunContainerConfi
 	for n, v := range config.EnvVars {
 		envVars = append(envVars, n+"="+v)
 	}
+	if !slices.ContainsFunc(envVars, func(v string) bool { return strings.HasPrefix(v, "HOME=") }) {
+		envVars = append(envVars, "HOME="+creds.Home)
+	}
 
 	cmd := &exec.Cmd{
 		Path:   args[0],
@@ -399,13 +485,19 @@ func (c *imageClient) RunContainer(ctx context.Context, config RunContainerConfi
 		Stderr: config.StdErr,
 		SysProcAttr: &syscall.SysProcAttr{
 			Credential: &syscall.Credential{
-				Uid: uint32(userID),
-				Gid: uint32(groupID),
+				Uid:    creds.UID,
+				Gid:    creds.GID,
+				Groups: creds.Groups,
 			},
 		},
 	}
 
-	if err := libexec.Exec(ctx, cmd); err != nil {
+	execFunc := config.Exec
+	if execFunc == nil {
+		execFunc = initprocess.Exec
+	}
+
+	if err := execFunc(ctx, cmd, stopSignal); err != nil {
 		log.Error("Container exited with error", zap.Error(err))
 		return err
 	}
@@ -666,7 +758,9 @@ func (c *imageClient) fetchBlob(ctx context.Context, digest, dstFile string) (re
 	})
 }
 
-func untar(r io.Reader) error {
+// untar extracts the archive in the root directory. If layer is true, whiteouts are stored in overlayfs format,
+// otherwise they are applied to the content extracted earlier.
+func untar(r io.Reader, root string, layer bool) error {
 	tr := tar.NewReader(r)
 	del := map[string]bool{}
 	added := map[string]bool{}
@@ -684,15 +778,36 @@ loop:
 		// We take mode from header.FileInfo().Mode(), not from header.Mode because they may be in different formats
 		// (meaning of bits may be different). header.FileInfo().Mode() returns compatible value.
 		mode := header.FileInfo().Mode()
+		name, err := resolvePath(root, header.Name)
+		if err != nil {
+			return err
+		}
 
 		switch {
-		case filepath.Base(header.Name) == ".wh..wh..plnk":
+		case filepath.Base(name) == ".wh..wh..plnk":
 			// just ignore this
 			continue
-		case filepath.Base(header.Name) == ".wh..wh..opq":
+		case layer && filepath.Base(name) == ".wh..wh..opq":
+			// Overlayfs hides content of lower layers in the directory marked as opaque.
+			dir := filepath.Dir(name)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return errors.WithStack(err)
+			}
+			if err := unix.Setxattr(dir, "user.overlay.opaque", []byte("y"), 0); err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		case layer && strings.HasPrefix(filepath.Base(name), ".wh."):
+			// Overlayfs hides file of lower layers if character device 0/0 exists under its name.
+			whiteout := filepath.Join(filepath.Dir(name), strings.TrimPrefix(filepath.Base(name), ".wh."))
+			if err := unix.Mknod(whiteout, unix.S_IFCHR, 0); err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		case filepath.Base(name) == ".wh..wh..opq":
 			// It means that content in this directory created by earlier layers should not be visible,
 			// so content created earlier should be deleted
-			dir := filepath.Dir(header.Name)
+			dir := filepath.Dir(name)
 			files, err := os.ReadDir(dir)
 			if err != nil {
 				return errors.WithStack(err)
@@ -707,9 +822,9 @@ loop:
 				}
 			}
 			continue
-		case strings.HasPrefix(filepath.Base(header.Name), ".wh."):
+		case strings.HasPrefix(filepath.Base(name), ".wh."):
 			// delete or mark to delete corresponding file
-			toDelete := filepath.Join(filepath.Dir(header.Name), strings.TrimPrefix(filepath.Base(header.Name), ".wh."))
+			toDelete := filepath.Join(filepath.Dir(name), strings.TrimPrefix(filepath.Base(name), ".wh."))
 			delete(added, toDelete)
 			if err := os.RemoveAll(toDelete); err != nil {
 				if os.IsNotExist(err) {
@@ -719,16 +834,22 @@ loop:
 				return errors.WithStack(err)
 			}
 			continue
-		case del[header.Name]:
-			delete(del, header.Name)
-			delete(added, header.Name)
+		case del[name]:
+			delete(del, name)
+			delete(added, name)
 			continue
 		case header.Typeflag == tar.TypeDir:
-			if err := os.MkdirAll(header.Name, mode); err != nil {
+			if err := replaceEntry(name, header.Typeflag); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(name, mode); err != nil {
 				return errors.WithStack(err)
 			}
 		case header.Typeflag == tar.TypeReg:
-			f, err := os.OpenFile(header.Name, os.O_CREATE|os.O_WRONLY, mode)
+			if err := replaceEntry(name, header.Typeflag); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|unix.O_NOFOLLOW, mode)
 			if err != nil {
 				return errors.WithStack(err)
 			}
@@ -738,12 +859,23 @@ loop:
 				return errors.WithStack(err)
 			}
 		case header.Typeflag == tar.TypeSymlink:
-			if err := os.Symlink(header.Linkname, header.Name); err != nil {
+			// Symlink may point anywhere, it is resolved inside root when the path going through it is extracted.
+			if err := replaceEntry(name, header.Typeflag); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, name); err != nil {
 				return errors.WithStack(err)
 			}
 		case header.Typeflag == tar.TypeLink:
+			linkName, err := resolvePath(root, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := replaceEntry(name, header.Typeflag); err != nil {
+				return err
+			}
 			// linked file may not exist yet, so let's create it - i will be overwritten later
-			f, err := os.OpenFile(header.Linkname, os.O_CREATE|os.O_EXCL, mode)
+			f, err := os.OpenFile(linkName, os.O_CREATE|os.O_EXCL, mode)
 			if err != nil {
 				if !os.IsExist(err) {
 					return errors.WithStack(err)
@@ -751,27 +883,125 @@ loop:
 			} else {
 				_ = f.Close()
 			}
-			if err := os.Link(header.Linkname, header.Name); err != nil {
+			if err := os.Link(linkName, name); err != nil {
 				return errors.WithStack(err)
 			}
 		default:
 			return errors.Errorf("unsupported file type: %d", header.Typeflag)
 		}
 
-		added[header.Name] = true
-		if err := os.Lchown(header.Name, header.Uid, header.Gid); err != nil {
+		added[name] = true
+		if err := os.Lchown(name, header.Uid, header.Gid); err != nil {
 			return errors.WithStack(err)
 		}
 
 		// Unless CAP_FSETID capability is set for the process every operation modifying the file/dir will reset
 		// setuid, setgid nd sticky bits. After saving those files/dirs the mode has to be set once again to set those
 		// bits. This has to be the last operation on the file/dir.
-		// On linux mode is not supported for symlinks, mode is always taken from target location.
-		if header.Typeflag != tar.TypeSymlink {
-			if err := os.Chmod(header.Name, mode); err != nil {
+		// On linux mode is not supported for symlinks, mode is always taken from target location, so it must not be
+		// set for hardlinked symlink either.
+		info, err := os.Lstat(name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			if err := os.Chmod(name, mode); err != nil {
 				return errors.WithStack(err)
 			}
 		}
 	}
 	return nil
 }
+
+// maxSymlinks is the maximum number of symlinks followed while resolving the path inside root directory.
+const maxSymlinks = 255
+
+// resolvePath returns the path of the archive entry inside root directory. Symlinks in parent directories are
+// resolved as if root was the root of the filesystem, so created entry never lands outside it, even if symlink
+// extracted earlier points there. Last element is not resolved, because the entry replaces it.
+func resolvePath(root, name string) (string, error) {
+	cleanName := filepath.Clean(strings.TrimLeft(name, "/"))
+	if !filepath.IsLocal(cleanName) {
+		return "", errors.Errorf("path %s points outside root directory", name)
+	}
+	if cleanName == "." {
+		return root, nil
+	}
+
+	dir, base := filepath.Split(cleanName)
+	resolved := "/"
+	for links := 0; dir != ""; {
+		var part string
+		part, dir, _ = strings.Cut(dir, "/")
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		switch {
+		case os.IsNotExist(err):
+			resolved = next
+			continue
+		case err != nil:
+			return "", errors.WithStack(err)
+		case info.Mode()&os.ModeSymlink == 0:
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", errors.Errorf("too many symlinks in path %s", name)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		dir = target + "/" + dir
+	}
+
+	return filepath.Join(root, resolved, base), nil
+}
+
+// replaceEntry removes the existing entry replaced by the archive entry of different type, so symlink is never
+// followed while creating the new one. Directory and regular file are reused if entry is of the same type.
+func replaceEntry(name string, typeFlag byte) error {
+	info, err := os.Lstat(name)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return errors.WithStack(err)
+	case info.IsDir() && typeFlag == tar.TypeDir, info.Mode().IsRegular() && typeFlag == tar.TypeReg:
+		return nil
+	}
+	return errors.WithStack(os.RemoveAll(name))
+}
+
+// parseSignal parses signal specified in docker format, e.g. SIGTERM, TERM or 15.
+func parseSignal(signal string) (syscall.Signal, error) {
+	if num, err := strconv.Atoi(signal); err == nil {
+		if num <= 0 {
+			return 0, errors.Errorf("invalid signal: %s", signal)
+		}
+		return syscall.Signal(num), nil
+	}
+
+	name := strings.ToUpper(signal)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return 0, errors.Errorf("invalid signal: %s", signal)
+	}
+	return sig, nil
+}
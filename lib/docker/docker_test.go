@@ -0,0 +1,146 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolvePath(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "usr", "lib"), 0o755))
+	require.NoError(t, os.Symlink("usr/lib", filepath.Join(root, "lib")))
+	require.NoError(t, os.Symlink("/usr", filepath.Join(root, "abs")))
+	require.NoError(t, os.Symlink("../../../..", filepath.Join(root, "up")))
+
+	tests := []struct {
+		Name     string
+		Path     string
+		Expected string
+	}{
+		{Name: "root", Path: "./", Expected: root},
+		{Name: "file", Path: "etc/passwd", Expected: filepath.Join(root, "etc", "passwd")},
+		{Name: "absolute", Path: "/etc/passwd", Expected: filepath.Join(root, "etc", "passwd")},
+		{Name: "dotInside", Path: "./etc/../etc/passwd", Expected: filepath.Join(root, "etc", "passwd")},
+		{Name: "relativeSymlink", Path: "lib/libc.so", Expected: filepath.Join(root, "usr", "lib", "libc.so")},
+		{Name: "absoluteSymlink", Path: "abs/bin/sh", Expected: filepath.Join(root, "usr", "bin", "sh")},
+		{Name: "symlinkAboveRoot", Path: "up/etc/passwd", Expected: filepath.Join(root, "etc", "passwd")},
+		{Name: "lastSymlink", Path: "lib", Expected: filepath.Join(root, "lib")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			path, err := resolvePath(root, test.Path)
+			require.NoError(t, err)
+			assert.Equal(t, test.Expected, path)
+		})
+	}
+}
+
+func TestResolvePathInvalid(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.Symlink("loop", filepath.Join(root, "loop")))
+
+	for name, path := range map[string]string{
+		"parent":       "../etc/passwd",
+		"parentInside": "etc/../../etc/passwd",
+		"symlinkLoop":  "loop/file",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := resolvePath(root, path)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestUntarContained(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Entries []tar.Header
+	}{
+		{
+			Name:    "parent",
+			Entries: []tar.Header{{Name: "../outside", Typeflag: tar.TypeReg}},
+		},
+		{
+			Name:    "hardlinkTarget",
+			Entries: []tar.Header{{Name: "file", Typeflag: tar.TypeLink, Linkname: "../outside"}},
+		},
+		{
+			Name: "writeThroughSymlink",
+			Entries: []tar.Header{
+				{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+				{Name: "dir/outside", Typeflag: tar.TypeReg},
+			},
+		},
+		{
+			Name: "replaceSymlink",
+			Entries: []tar.Header{
+				{Name: "file", Typeflag: tar.TypeSymlink, Linkname: "../outside"},
+				{Name: "file", Typeflag: tar.TypeReg},
+			},
+		},
+		{
+			Name: "dirOverSymlink",
+			Entries: []tar.Header{
+				{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+				{Name: "dir", Typeflag: tar.TypeDir, Mode: 0o1777},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			root := filepath.Join(dir, "root")
+			require.NoError(t, os.Mkdir(root, 0o755))
+			dirInfo, err := os.Stat(dir)
+			require.NoError(t, err)
+
+			// Errors are allowed, the only requirement is nothing outside root is modified.
+			_ = untar(tarball(t, test.Entries), root, false)
+
+			_, err = os.Lstat(filepath.Join(dir, "outside"))
+			assert.True(t, os.IsNotExist(err))
+			info, err := os.Stat(dir)
+			require.NoError(t, err)
+			assert.Equal(t, dirInfo.Mode(), info.Mode())
+		})
+	}
+}
+
+func TestUntarHardlink(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, untar(tarball(t, []tar.Header{
+		{Name: "dir", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "/dir"},
+		{Name: "lib/link", Typeflag: tar.TypeLink, Linkname: "lib/file", Mode: 0o644},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0o644, Size: 4},
+	}), root, false))
+
+	content, err := os.ReadFile(filepath.Join(root, "dir", "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(content))
+}
+
+// tarball returns the archive containing entries, content of regular files is filled with the data of their size.
+func tarball(t *testing.T, entries []tar.Header) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, header := range entries {
+		header.Uid = os.Getuid()
+		header.Gid = os.Getgid()
+		require.NoError(t, tw.WriteHeader(&header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte("data")[:header.Size])
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	return buf
+}
@@ -1,7 +1,6 @@
 package firewall
 
 import (
-	"math"
 	"net"
 
 	"github.com/google/nftables/binaryutil"
@@ -31,6 +30,16 @@ func Accept() []expr.Any {
 	}
 }
 
+// Drop drops packets.
+func Drop() []expr.Any {
+	return []expr.Any{
+		&expr.Counter{},
+		&expr.Verdict{
+			Kind: expr.VerdictDrop,
+		},
+	}
+}
+
 // Masquerade masquerades packets.
 func Masquerade() []expr.Any {
 	return []expr.Any{
@@ -39,23 +48,48 @@ func Masquerade() []expr.Any {
 	}
 }
 
-// DestinationNAT redirects packets to IP and port.
+// DestinationNAT redirects packets to IP and port. Packets of the IP family are redirected only.
 func DestinationNAT(ip net.IP, port uint16) []expr.Any {
+	family, addr := byte(unix.NFPROTO_IPV4), ip.To4()
+	if addr == nil {
+		family, addr = unix.NFPROTO_IPV6, ip.To16()
+	}
+
+	return Expressions(
+		Family(ip),
+		[]expr.Any{
+			&expr.Immediate{
+				Register: 1,
+				Data:     addr,
+			},
+			&expr.Immediate{
+				Register: 2,
+				Data:     binaryutil.BigEndian.PutUint16(port),
+			},
+			&expr.Counter{},
+			&expr.NAT{
+				Type:        expr.NATTypeDestNAT,
+				Family:      uint32(family),
+				RegAddrMin:  1,
+				RegProtoMin: 2,
+			},
+		},
+	)
+}
+
+// Family filters packets of the IP family.
+func Family(ip net.IP) []expr.Any {
+	family := byte(unix.NFPROTO_IPV4)
+	if ip.To4() == nil {
+		family = unix.NFPROTO_IPV6
+	}
+
 	return []expr.Any{
-		&expr.Immediate{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
 			Register: 1,
-			Data:     ip.To4(),
-		},
-		&expr.Immediate{
-			Register: 2,
-			Data:     binaryutil.BigEndian.PutUint16(port),
-		},
-		&expr.Counter{},
-		&expr.NAT{
-			Type:        expr.NATTypeDestNAT,
-			Family:      unix.NFPROTO_IPV4,
-			RegAddrMin:  1,
-			RegProtoMin: 2,
+			Data:     []byte{family},
 		},
 	}
 }
@@ -133,72 +167,89 @@ func LocalDestinationAddress() []expr.Any {
 
 // SourceNetwork filters traffic coming from network.
 func SourceNetwork(network *net.IPNet) []expr.Any {
-	if network.IP.Equal(net.IPv4zero) {
+	if isAny(network.IP) {
 		return nil
 	}
 
-	return []expr.Any{
-		&expr.Payload{
-			DestRegister: 1,
-			Base:         expr.PayloadBaseNetworkHeader,
-			Offset:       12,
-			Len:          4,
-		},
-		&expr.Bitwise{
-			SourceRegister: 1,
-			DestRegister:   1,
-			Len:            4,
-			Mask:           ipMask(network),
-			Xor:            binaryutil.NativeEndian.PutUint32(0),
-		},
-		&expr.Cmp{
-			Op:       expr.CmpOpEq,
-			Register: 1,
-			Data:     netIP(network),
+	offset, _ := addressOffsets(network.IP)
+	addr := ipBytes(network.IP)
+	ones, bits := network.Mask.Size()
+	mask := net.CIDRMask(ones-bits+8*len(addr), 8*len(addr))
+	return Expressions(
+		Family(network.IP),
+		[]expr.Any{
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       offset,
+				Len:          uint32(len(addr)),
+			},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            uint32(len(addr)),
+				Mask:           mask,
+				Xor:            make([]byte, len(addr)),
+			},
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     addr.Mask(mask),
+			},
 		},
-	}
+	)
 }
 
 // NotSourceAddress filters out packets coming from IP.
 func NotSourceAddress(ip net.IP) []expr.Any {
-	if ip.Equal(net.IPv4zero) {
+	if isAny(ip) {
 		return nil
 	}
 
-	return []expr.Any{
-		&expr.Payload{
-			DestRegister: 1,
-			Base:         expr.PayloadBaseNetworkHeader,
-			Offset:       12,
-			Len:          4,
+	offset, _ := addressOffsets(ip)
+	addr := ipBytes(ip)
+	return Expressions(
+		Family(ip),
+		[]expr.Any{
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       offset,
+				Len:          uint32(len(addr)),
+			},
+			&expr.Cmp{
+				Op:       expr.CmpOpNeq,
+				Register: 1,
+				Data:     addr,
+			},
 		},
-		&expr.Cmp{
-			Op:       expr.CmpOpNeq,
-			Register: 1,
-			Data:     ip.To4(),
-		},
-	}
+	)
 }
 
 // DestinationAddress filters destination address.
 func DestinationAddress(ip net.IP) []expr.Any {
-	if ip.Equal(net.IPv4zero) {
+	if isAny(ip) {
 		return nil
 	}
 
-	return []expr.Any{
-		&expr.Payload{
-			DestRegister: 1,
-			Base:         expr.PayloadBaseNetworkHeader,
-			Offset:       16,
-			Len:          4,
-		},
-		&expr.Cmp{
-			Op:       expr.CmpOpEq,
-			Register: 1,
-			Data:     ip.To4(),
+	_, offset := addressOffsets(ip)
+	addr := ipBytes(ip)
+	return Expressions(
+		Family(ip),
+		[]expr.Any{
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       offset,
+				Len:          uint32(len(addr)),
+			},
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     addr,
+			},
 		},
-	}
+	)
 }
 
 // Protocol filters protocol.
@@ -209,6 +260,8 @@ func Protocol(protocol string) []expr.Any {
 		proto = unix.IPPROTO_TCP
 	case "udp":
 		proto = unix.IPPROTO_UDP
+	case "icmpv6":
+		proto = unix.IPPROTO_ICMPV6
 	default:
 		panic(errors.Errorf("unknown proto %q", protocol))
 	}
@@ -240,21 +293,23 @@ func DestinationPort(port uint16) []expr.Any {
 	}
 }
 
-func ip4ToUint32(ip net.IP) uint32 {
-	ip = ip.To4()
-	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
-}
-
-func uint32ToIP4(val uint32) net.IP {
-	return net.IPv4(byte(val>>24), byte(val>>16), byte(val>>8), byte(val)).To4()
+// isAny returns true if IP matches any address.
+func isAny(ip net.IP) bool {
+	return len(ip) == 0 || ip.IsUnspecified()
 }
 
-func netIP(network *net.IPNet) net.IP {
-	ones, bits := network.Mask.Size()
-	return uint32ToIP4(ip4ToUint32(network.IP) & (uint32(math.MaxUint32) << (bits - ones)))
+// addressOffsets returns offsets of source and destination addresses in the header of IP packet.
+func addressOffsets(ip net.IP) (uint32, uint32) {
+	if ip.To4() != nil {
+		return 12, 16
+	}
+	return 8, 24
 }
 
-func ipMask(ip *net.IPNet) []byte {
-	ones, bits := ip.Mask.Size()
-	return binaryutil.BigEndian.PutUint32(math.MaxUint32 << (bits - ones))
+// ipBytes returns the IP address in the form used by the packet, 4 bytes for IPv4 and 16 bytes for IPv6.
+func ipBytes(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
 }
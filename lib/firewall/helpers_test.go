@@ -0,0 +1,158 @@
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSourceNetwork(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Network  string
+		Family   byte
+		Offset   uint32
+		Mask     []byte
+		Expected []byte
+	}{
+		{
+			Name:     "ipv4",
+			Network:  "10.0.1.2/24",
+			Family:   unix.NFPROTO_IPV4,
+			Offset:   12,
+			Mask:     []byte{0xff, 0xff, 0xff, 0x00},
+			Expected: []byte{10, 0, 1, 0},
+		},
+		{
+			Name:    "ipv6",
+			Network: "fd69:736f:6c61::a00:102/120",
+			Family:  unix.NFPROTO_IPV6,
+			Offset:  8,
+			Mask: []byte{
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00,
+			},
+			Expected: []byte{0xfd, 0x69, 0x73, 0x6f, 0x6c, 0x61, 0, 0, 0, 0, 0, 0, 0x0a, 0x00, 0x01, 0x00},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			ip, network, err := net.ParseCIDR(test.Network)
+			require.NoError(t, err)
+			network.IP = ip
+
+			length := uint32(len(test.Expected))
+			assert.Equal(t, []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{test.Family}},
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseNetworkHeader,
+					Offset:       test.Offset,
+					Len:          length,
+				},
+				&expr.Bitwise{
+					SourceRegister: 1,
+					DestRegister:   1,
+					Len:            length,
+					Mask:           test.Mask,
+					Xor:            make([]byte, length),
+				},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: net.IP(test.Expected)},
+			}, SourceNetwork(network))
+		})
+	}
+}
+
+func TestDestinationAddress(t *testing.T) {
+	tests := []struct {
+		Name     string
+		IP       net.IP
+		Family   byte
+		Offset   uint32
+		Expected []byte
+	}{
+		{
+			Name:     "ipv4",
+			IP:       net.IPv4(10, 0, 1, 2),
+			Family:   unix.NFPROTO_IPV4,
+			Offset:   16,
+			Expected: []byte{10, 0, 1, 2},
+		},
+		{
+			Name:     "ipv6",
+			IP:       net.ParseIP("fd69:736f:6c61::a00:102"),
+			Family:   unix.NFPROTO_IPV6,
+			Offset:   24,
+			Expected: []byte{0xfd, 0x69, 0x73, 0x6f, 0x6c, 0x61, 0, 0, 0, 0, 0, 0, 0x0a, 0x00, 0x01, 0x02},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			assert.Equal(t, []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{test.Family}},
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseNetworkHeader,
+					Offset:       test.Offset,
+					Len:          uint32(len(test.Expected)),
+				},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: net.IP(test.Expected)},
+			}, DestinationAddress(test.IP))
+		})
+	}
+}
+
+func TestDestinationNAT(t *testing.T) {
+	tests := []struct {
+		Name     string
+		IP       net.IP
+		Family   byte
+		Expected []byte
+	}{
+		{
+			Name:     "ipv4",
+			IP:       net.IPv4(10, 0, 1, 2),
+			Family:   unix.NFPROTO_IPV4,
+			Expected: []byte{10, 0, 1, 2},
+		},
+		{
+			Name:     "ipv6",
+			IP:       net.ParseIP("fd69:736f:6c61::a00:102"),
+			Family:   unix.NFPROTO_IPV6,
+			Expected: []byte{0xfd, 0x69, 0x73, 0x6f, 0x6c, 0x61, 0, 0, 0, 0, 0, 0, 0x0a, 0x00, 0x01, 0x02},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			assert.Equal(t, []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{test.Family}},
+				&expr.Immediate{Register: 1, Data: net.IP(test.Expected)},
+				&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(8080)},
+				&expr.Counter{},
+				&expr.NAT{
+					Type:        expr.NATTypeDestNAT,
+					Family:      uint32(test.Family),
+					RegAddrMin:  1,
+					RegProtoMin: 2,
+				},
+			}, DestinationNAT(test.IP, 8080))
+		})
+	}
+}
+
+func TestAnyAddress(t *testing.T) {
+	assert.Empty(t, SourceNetwork(&net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}))
+	assert.Empty(t, NotSourceAddress(net.IPv4zero))
+	assert.Empty(t, DestinationAddress(nil))
+}
@@ -0,0 +1,213 @@
+package passwd
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Credentials are the credentials of the process resolved from names or IDs of user and group.
+type Credentials struct {
+	// UID is the ID of the user.
+	UID uint32
+
+	// GID is the ID of the primary group.
+	GID uint32
+
+	// Groups is the list of supplementary group IDs.
+	Groups []uint32
+
+	// Home is the home directory of the user.
+	Home string
+}
+
+type user struct {
+	Name string
+	UID  uint32
+	GID  uint32
+	Home string
+}
+
+type group struct {
+	Name    string
+	GID     uint32
+	Members []string
+}
+
+// Resolve resolves credentials using /etc/passwd and /etc/group files of the root filesystem. User and groups are
+// specified by names or IDs. Missing files are treated as empty ones, so numeric IDs are accepted even if they are
+// not defined there. Rules follow the ones used by Docker:
+// - if user is empty, root is used,
+// - if group is empty, primary group of the user is used and groups listing the user as a member become
+// supplementary ones,
+// - additional groups are always added to the supplementary ones.
+func Resolve(root, userSpec, groupSpec string, additionalGroups []string) (Credentials, error) {
+	users, err := readFile(filepath.Join(root, "etc", "passwd"), parseUsers)
+	if err != nil {
+		return Credentials{}, err
+	}
+	groups, err := readFile(filepath.Join(root, "etc", "group"), parseGroups)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return resolve(users, groups, userSpec, groupSpec, additionalGroups)
+}
+
+func resolve(users []user, groups []group, userSpec, groupSpec string, additionalGroups []string) (Credentials,
+	error) {
+	if userSpec == "" {
+		userSpec = "0"
+	}
+
+	creds := Credentials{Home: "/"}
+
+	uid, err := parseID(userSpec)
+	numeric := err == nil
+	i := slices.IndexFunc(users, func(u user) bool {
+		return u.Name == userSpec || (numeric && u.UID == uid)
+	})
+	var userName string
+	switch {
+	case i >= 0:
+		creds.UID = users[i].UID
+		creds.GID = users[i].GID
+		creds.Home = users[i].Home
+		userName = users[i].Name
+	case numeric:
+		creds.UID = uid
+	default:
+		return Credentials{}, errors.Errorf("unable to find user %s: no matching entries in passwd file", userSpec)
+	}
+
+	if groupSpec != "" {
+		if creds.GID, err = resolveGroup(groups, groupSpec); err != nil {
+			return Credentials{}, err
+		}
+	} else if userName != "" {
+		// Supplementary groups are taken from the group file only if group is not specified explicitly.
+		for _, g := range groups {
+			if slices.Contains(g.Members, userName) && !slices.Contains(creds.Groups, g.GID) {
+				creds.Groups = append(creds.Groups, g.GID)
+			}
+		}
+	}
+
+	for _, spec := range additionalGroups {
+		gid, err := resolveGroup(groups, spec)
+		if err != nil {
+			return Credentials{}, err
+		}
+		if !slices.Contains(creds.Groups, gid) {
+			creds.Groups = append(creds.Groups, gid)
+		}
+	}
+
+	return creds, nil
+}
+
+func resolveGroup(groups []group, spec string) (uint32, error) {
+	gid, err := parseID(spec)
+	numeric := err == nil
+	i := slices.IndexFunc(groups, func(g group) bool {
+		return g.Name == spec || (numeric && g.GID == gid)
+	})
+	switch {
+	case i >= 0:
+		return groups[i].GID, nil
+	case numeric:
+		return gid, nil
+	default:
+		return 0, errors.Errorf("unable to find group %s: no matching entries in group file", spec)
+	}
+}
+
+func readFile[T any](path string, parse func(r io.Reader) ([]T, error)) ([]T, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	entries, err := parse(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s failed", path)
+	}
+	return entries, nil
+}
+
+// parseUsers parses file in /etc/passwd format: name:password:UID:GID:GECOS:directory:shell.
+func parseUsers(r io.Reader) ([]user, error) {
+	var users []user
+	err := parseLines(r, 7, func(fields []string) {
+		uid, err := parseID(fields[2])
+		if err != nil {
+			return
+		}
+		gid, err := parseID(fields[3])
+		if err != nil {
+			return
+		}
+		users = append(users, user{
+			Name: fields[0],
+			UID:  uid,
+			GID:  gid,
+			Home: fields[5],
+		})
+	})
+	return users, err
+}
+
+// parseGroups parses file in /etc/group format: name:password:GID:user_list.
+func parseGroups(r io.Reader) ([]group, error) {
+	var groups []group
+	err := parseLines(r, 4, func(fields []string) {
+		gid, err := parseID(fields[2])
+		if err != nil {
+			return
+		}
+		var members []string
+		for _, m := range strings.Split(fields[3], ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				members = append(members, m)
+			}
+		}
+		groups = append(groups, group{
+			Name:    fields[0],
+			GID:     gid,
+			Members: members,
+		})
+	})
+	return groups, err
+}
+
+// parseLines calls the function for each line having the expected number of fields. Other lines, including
+// comments and entries used by NIS, are skipped.
+func parseLines(r io.Reader, numOfFields int, fn func(fields []string)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < numOfFields {
+			continue
+		}
+		fn(fields)
+	}
+	return errors.WithStack(scanner.Err())
+}
+
+func parseID(id string) (uint32, error) {
+	v, err := strconv.ParseUint(id, 10, 32)
+	return uint32(v), errors.WithStack(err)
+}
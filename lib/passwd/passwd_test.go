@@ -0,0 +1,88 @@
+package passwd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const passwdFile = `root:x:0:0:root:/root:/bin/bash
+# comment
+nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin
+invalid:x:abc:0:invalid:/invalid:/bin/sh
+postgres:x:999:999::/var/lib/postgresql:/bin/bash
++nis
+`
+
+const groupFile = `root:x:0:
+tty:x:5:postgres
+nogroup:x:65534:
+postgres:x:999:
+ssl-cert:x:101:postgres,nobody
+`
+
+func TestResolve(t *testing.T) {
+	users, err := parseUsers(strings.NewReader(passwdFile))
+	require.NoError(t, err)
+	groups, err := parseGroups(strings.NewReader(groupFile))
+	require.NoError(t, err)
+
+	tests := []struct {
+		User             string
+		Group            string
+		AdditionalGroups []string
+		Expected         Credentials
+	}{
+		{
+			Expected: Credentials{UID: 0, GID: 0, Home: "/root"},
+		},
+		{
+			User:     "postgres",
+			Expected: Credentials{UID: 999, GID: 999, Groups: []uint32{5, 101}, Home: "/var/lib/postgresql"},
+		},
+		{
+			User:     "999",
+			Expected: Credentials{UID: 999, GID: 999, Groups: []uint32{5, 101}, Home: "/var/lib/postgresql"},
+		},
+		{
+			User:     "nobody",
+			Group:    "nogroup",
+			Expected: Credentials{UID: 65534, GID: 65534, Home: "/nonexistent"},
+		},
+		{
+			User:     "1234",
+			Group:    "4321",
+			Expected: Credentials{UID: 1234, GID: 4321, Home: "/"},
+		},
+		{
+			User:             "postgres",
+			Group:            "0",
+			AdditionalGroups: []string{"nogroup", "2000"},
+			Expected:         Credentials{UID: 999, GID: 0, Groups: []uint32{65534, 2000}, Home: "/var/lib/postgresql"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.User+":"+test.Group, func(t *testing.T) {
+			creds, err := resolve(users, groups, test.User, test.Group, test.AdditionalGroups)
+			require.NoError(t, err)
+			assert.Equal(t, test.Expected, creds)
+		})
+	}
+}
+
+func TestResolveUnknownNames(t *testing.T) {
+	users, err := parseUsers(strings.NewReader(passwdFile))
+	require.NoError(t, err)
+	groups, err := parseGroups(strings.NewReader(groupFile))
+	require.NoError(t, err)
+
+	_, err = resolve(users, groups, "invalid", "", nil)
+	require.Error(t, err)
+	_, err = resolve(users, groups, "postgres", "unknown", nil)
+	require.Error(t, err)
+	_, err = resolve(users, groups, "postgres", "", []string{"unknown"})
+	require.Error(t, err)
+}
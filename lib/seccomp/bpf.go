@@ -0,0 +1,265 @@
+package seccomp
+
+import (
+	"math"
+	"runtime"
+	"slices"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Offsets of fields in struct seccomp_data.
+const (
+	offsetNR   = 0
+	offsetArch = 4
+	offsetArgs = 16
+)
+
+// maxInstructions is the maximum length of BPF program accepted by the kernel.
+const maxInstructions = 4096
+
+// maxArgs is the number of syscall arguments available to the filter.
+const maxArgs = 6
+
+// label is the target of the conditional jump.
+type label int
+
+const (
+	// labelNext points to the next instruction.
+	labelNext label = iota
+
+	// labelPass points to the end of the condition, meaning that the condition is met.
+	labelPass
+
+	// labelFail points to the end of the rule, meaning that the rule does not match.
+	labelFail
+)
+
+type instruction struct {
+	filter unix.SockFilter
+	jt, jf label
+}
+
+func stmt(code uint16, k uint32) instruction {
+	return instruction{filter: unix.SockFilter{Code: code, K: k}}
+}
+
+func jump(code uint16, k uint32, jt, jf label) instruction {
+	return instruction{filter: unix.SockFilter{Code: code, K: k}, jt: jt, jf: jf}
+}
+
+func load(offset uint32) instruction {
+	return stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offset)
+}
+
+func ret(action uint32) unix.SockFilter {
+	return unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: action}
+}
+
+// compile compiles the profile into BPF program. Rules are evaluated in order and the first matching one decides.
+func compile(profile Profile) ([]unix.SockFilter, error) {
+	if !Supported() {
+		return nil, errors.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+
+	defaultAction, err := action(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	// Syscalls of other architectures have different numbers, so they are rejected.
+	program := []unix.SockFilter{
+		load(offsetArch).filter,
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: nativeArch, Jt: 1},
+		ret(unix.SECCOMP_RET_KILL_PROCESS),
+	}
+	if x32SyscallBit != 0 {
+		program = append(program,
+			load(offsetNR).filter,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, K: x32SyscallBit, Jf: 1},
+			ret(unix.SECCOMP_RET_KILL_PROCESS),
+		)
+	}
+
+	for _, s := range profile.Syscalls {
+		if !s.applies() {
+			continue
+		}
+
+		act, err := action(s.Action, s.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+
+		names := s.Names
+		if s.Name != "" {
+			names = append(append([]string{}, names...), s.Name)
+		}
+		for _, name := range names {
+			nr, exists := syscalls[name]
+			if !exists {
+				// Profiles cover many architectures, so syscalls unknown here are skipped.
+				continue
+			}
+
+			block, err := compileRule(nr, s.Args, act)
+			if err != nil {
+				return nil, errors.Wrapf(err, "compiling rule for syscall %s failed", name)
+			}
+			program = append(program, block...)
+		}
+	}
+
+	program = append(program, ret(defaultAction))
+	if len(program) > maxInstructions {
+		return nil, errors.Errorf("seccomp program is too long: %d instructions", len(program))
+	}
+	return program, nil
+}
+
+func compileRule(nr uint32, args []Arg, act uint32) ([]unix.SockFilter, error) {
+	block := []instruction{
+		load(offsetNR),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, labelNext, labelFail),
+	}
+	for _, arg := range args {
+		cond, err := compileCondition(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		// labelPass is resolved here, so only labelFail remains in the block.
+		for i, ins := range cond {
+			if ins.jt == labelPass {
+				ins.filter.Jt = uint8(len(cond) - i - 1)
+				ins.jt = labelNext
+			}
+			if ins.jf == labelPass {
+				ins.filter.Jf = uint8(len(cond) - i - 1)
+				ins.jf = labelNext
+			}
+			block = append(block, ins)
+		}
+	}
+
+	// Return instruction is the last one in the block, jumping over it means that the rule does not match.
+	result := make([]unix.SockFilter, 0, len(block)+1)
+	for i, ins := range block {
+		offset := len(block) - i
+		if offset > math.MaxUint8 {
+			return nil, errors.New("rule has too many conditions")
+		}
+		if ins.jt == labelFail {
+			ins.filter.Jt = uint8(offset)
+		}
+		if ins.jf == labelFail {
+			ins.filter.Jf = uint8(offset)
+		}
+		result = append(result, ins.filter)
+	}
+	return append(result, ret(act)), nil
+}
+
+// compileCondition compiles the condition on 64-bit argument by comparing its high and low halves.
+// Accumulator contains the syscall number on entry, and it is overwritten.
+func compileCondition(arg Arg) ([]instruction, error) {
+	if arg.Index >= maxArgs {
+		return nil, errors.Errorf("invalid argument index %d", arg.Index)
+	}
+
+	// Both supported architectures are little-endian.
+	lo := uint32(offsetArgs + 8*arg.Index)
+	hi := lo + 4
+	vLo := uint32(arg.Value)
+	vHi := uint32(arg.Value >> 32)
+
+	const (
+		jeq = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jgt = unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K
+		jge = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		and = unix.BPF_ALU | unix.BPF_AND | unix.BPF_K
+	)
+
+	switch arg.Op {
+	case OpEqualTo:
+		return []instruction{
+			load(hi), jump(jeq, vHi, labelNext, labelFail),
+			load(lo), jump(jeq, vLo, labelNext, labelFail),
+		}, nil
+	case OpNotEqual:
+		return []instruction{
+			load(hi), jump(jeq, vHi, labelNext, labelPass),
+			load(lo), jump(jeq, vLo, labelFail, labelNext),
+		}, nil
+	case OpMaskedEqual:
+		return []instruction{
+			load(hi), stmt(and, vHi), jump(jeq, uint32(arg.ValueTwo>>32), labelNext, labelFail),
+			load(lo), stmt(and, vLo), jump(jeq, uint32(arg.ValueTwo), labelNext, labelFail),
+		}, nil
+	case OpGreaterThan, OpGreaterEqual:
+		last := jgt
+		if arg.Op == OpGreaterEqual {
+			last = jge
+		}
+		return []instruction{
+			load(hi), jump(jgt, vHi, labelPass, labelNext), jump(jeq, vHi, labelNext, labelFail),
+			load(lo), jump(uint16(last), vLo, labelNext, labelFail),
+		}, nil
+	case OpLessThan, OpLessEqual:
+		last := jge
+		if arg.Op == OpLessEqual {
+			last = jgt
+		}
+		return []instruction{
+			load(hi), jump(jgt, vHi, labelFail, labelNext), jump(jeq, vHi, labelNext, labelPass),
+			load(lo), jump(uint16(last), vLo, labelFail, labelNext),
+		}, nil
+	default:
+		return nil, errors.Errorf("unsupported operator %q", arg.Op)
+	}
+}
+
+func action(name string, errnoRet *uint) (uint32, error) {
+	switch name {
+	case ActAllow:
+		return unix.SECCOMP_RET_ALLOW, nil
+	case ActErrno:
+		errno := uint(unix.EPERM)
+		if errnoRet != nil {
+			errno = *errnoRet
+		}
+		return unix.SECCOMP_RET_ERRNO | (uint32(errno) & unix.SECCOMP_RET_DATA), nil
+	case ActKill, ActKillThread:
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case ActKillProcess:
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case ActTrap:
+		return unix.SECCOMP_RET_TRAP, nil
+	case ActTrace:
+		errno := uint(unix.EPERM)
+		if errnoRet != nil {
+			errno = *errnoRet
+		}
+		return unix.SECCOMP_RET_TRACE | (uint32(errno) & unix.SECCOMP_RET_DATA), nil
+	case ActLog:
+		return unix.SECCOMP_RET_LOG, nil
+	default:
+		return 0, errors.Errorf("unsupported seccomp action %q", name)
+	}
+}
+
+// applies decides if rule should be applied on the current platform. Processes are assumed to have no
+// additional capabilities, so rules requiring them are skipped.
+func (s Syscall) applies() bool {
+	if len(s.Includes.Caps) > 0 {
+		return false
+	}
+	if len(s.Includes.Arches) > 0 && !slices.Contains(s.Includes.Arches, runtime.GOARCH) {
+		return false
+	}
+	if len(s.Excludes.Arches) > 0 && slices.Contains(s.Excludes.Arches, runtime.GOARCH) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,220 @@
+package seccomp
+
+import (
+	"encoding/json"
+	"runtime"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Actions taken when syscall matches the rule.
+const (
+	ActAllow       = "SCMP_ACT_ALLOW"
+	ActErrno       = "SCMP_ACT_ERRNO"
+	ActKill        = "SCMP_ACT_KILL"
+	ActKillThread  = "SCMP_ACT_KILL_THREAD"
+	ActKillProcess = "SCMP_ACT_KILL_PROCESS"
+	ActTrap        = "SCMP_ACT_TRAP"
+	ActTrace       = "SCMP_ACT_TRACE"
+	ActLog         = "SCMP_ACT_LOG"
+)
+
+// Operators used to compare syscall arguments.
+const (
+	OpNotEqual     = "SCMP_CMP_NE"
+	OpLessThan     = "SCMP_CMP_LT"
+	OpLessEqual    = "SCMP_CMP_LE"
+	OpEqualTo      = "SCMP_CMP_EQ"
+	OpGreaterEqual = "SCMP_CMP_GE"
+	OpGreaterThan  = "SCMP_CMP_GT"
+	OpMaskedEqual  = "SCMP_CMP_MASKED_EQ"
+)
+
+// namespaceFlags are the flags of clone creating new namespaces.
+const namespaceFlags = unix.CLONE_NEWNS | unix.CLONE_NEWUTS | unix.CLONE_NEWIPC | unix.CLONE_NEWUSER |
+	unix.CLONE_NEWPID | unix.CLONE_NEWNET | unix.CLONE_NEWCGROUP
+
+// deniedSyscalls are the syscalls denied by the default profile. The list follows the default profile of Docker.
+var deniedSyscalls = []string{
+	"acct",
+	"add_key",
+	"bpf",
+	"clock_adjtime",
+	"clock_settime",
+	"create_module",
+	"delete_module",
+	"finit_module",
+	"fsconfig",
+	"fsmount",
+	"fsopen",
+	"fspick",
+	"get_kernel_syms",
+	"get_mempolicy",
+	"init_module",
+	"ioperm",
+	"iopl",
+	"kcmp",
+	"kexec_file_load",
+	"kexec_load",
+	"keyctl",
+	"lookup_dcookie",
+	"mbind",
+	"mount",
+	"mount_setattr",
+	"move_mount",
+	"move_pages",
+	"name_to_handle_at",
+	"nfsservctl",
+	"open_by_handle_at",
+	"open_tree",
+	"perf_event_open",
+	"pivot_root",
+	"process_vm_readv",
+	"process_vm_writev",
+	"ptrace",
+	"query_module",
+	"quotactl",
+	"reboot",
+	"request_key",
+	"set_mempolicy",
+	"setns",
+	"settimeofday",
+	"stime",
+	"swapoff",
+	"swapon",
+	"sysfs",
+	"_sysctl",
+	"umount",
+	"umount2",
+	"unshare",
+	"uselib",
+	"userfaultfd",
+	"ustat",
+	"vm86",
+	"vm86old",
+}
+
+// allowedPersonalities are the execution domains which might be set by the processes.
+var allowedPersonalities = []uint64{0x0, 0x8, 0x20000, 0x20008, 0xffffffff}
+
+// Profile is the seccomp profile in Docker or OCI format.
+type Profile struct {
+	DefaultAction   string    `json:"defaultAction"`
+	DefaultErrnoRet *uint     `json:"defaultErrnoRet,omitempty"`
+	Syscalls        []Syscall `json:"syscalls"`
+}
+
+// Syscall defines the action taken when one of the syscalls is called with matching arguments.
+type Syscall struct {
+	Names    []string `json:"names"`
+	Name     string   `json:"name,omitempty"`
+	Action   string   `json:"action"`
+	ErrnoRet *uint    `json:"errnoRet,omitempty"`
+	Args     []Arg    `json:"args,omitempty"`
+	Includes Filter   `json:"includes"`
+	Excludes Filter   `json:"excludes"`
+}
+
+// Filter decides if rule is applied on the current platform.
+type Filter struct {
+	Caps   []string `json:"caps,omitempty"`
+	Arches []string `json:"arches,omitempty"`
+}
+
+// Arg defines the condition on syscall argument. All the conditions of the rule must be met.
+type Arg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo"`
+	Op       string `json:"op"`
+}
+
+// DefaultProfile returns the profile denying syscalls which are dangerous to be called by untrusted processes.
+func DefaultProfile() Profile {
+	syscalls := []Syscall{
+		// Threads and processes may be created, but new namespaces can't.
+		{
+			Names:  []string{"clone"},
+			Action: ActAllow,
+			Args: []Arg{
+				{Index: 0, Value: namespaceFlags, ValueTwo: 0, Op: OpMaskedEqual},
+			},
+		},
+		{
+			Names:  []string{"clone"},
+			Action: ActErrno,
+		},
+		// Flags of clone3 can't be inspected, so libc is forced to fall back to clone.
+		{
+			Names:    []string{"clone3"},
+			Action:   ActErrno,
+			ErrnoRet: errnoRet(unix.ENOSYS),
+		},
+	}
+	for _, persona := range allowedPersonalities {
+		syscalls = append(syscalls, Syscall{
+			Names:  []string{"personality"},
+			Action: ActAllow,
+			Args: []Arg{
+				{Index: 0, Value: persona, Op: OpEqualTo},
+			},
+		})
+	}
+	syscalls = append(syscalls, Syscall{
+		Names:  append([]string{"personality"}, deniedSyscalls...),
+		Action: ActErrno,
+	})
+
+	return Profile{
+		DefaultAction: ActAllow,
+		Syscalls:      syscalls,
+	}
+}
+
+// Supported returns true if seccomp filters are supported on the current platform.
+func Supported() bool {
+	return len(syscalls) > 0
+}
+
+// Parse parses the profile in Docker or OCI JSON format.
+func Parse(data []byte) (Profile, error) {
+	var profile Profile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return Profile{}, errors.Wrap(err, "parsing seccomp profile failed")
+	}
+	if profile.DefaultAction == "" {
+		return Profile{}, errors.New("default action of seccomp profile is not defined")
+	}
+	return profile, nil
+}
+
+// Install compiles the profile and installs it in all the threads of the current process.
+// Rules depending on capabilities are applied as if process had no additional capabilities.
+func Install(profile Profile) error {
+	filter, err := compile(profile)
+	if err != nil {
+		return err
+	}
+
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	tid, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC,
+		uintptr(unsafe.Pointer(&prog)))
+	runtime.KeepAlive(filter)
+	if errno != 0 {
+		return errors.Wrap(errno, "installing seccomp filter failed")
+	}
+	if tid != 0 {
+		return errors.Errorf("seccomp filter can't be synchronized with thread %d", tid)
+	}
+	return nil
+}
+
+func errnoRet(errno unix.Errno) *uint {
+	v := uint(errno)
+	return &v
+}
@@ -0,0 +1,235 @@
+package seccomp
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+const testProfile = `{
+	"defaultAction": "SCMP_ACT_ERRNO",
+	"defaultErrnoRet": 1,
+	"syscalls": [
+		{
+			"names": ["read", "write", "unknown_syscall"],
+			"action": "SCMP_ACT_ALLOW"
+		},
+		{
+			"names": ["personality"],
+			"action": "SCMP_ACT_ALLOW",
+			"args": [
+				{"index": 0, "value": 8, "valueTwo": 0, "op": "SCMP_CMP_EQ"}
+			]
+		},
+		{
+			"names": ["ptrace"],
+			"action": "SCMP_ACT_ALLOW",
+			"includes": {"caps": ["CAP_SYS_PTRACE"]}
+		},
+		{
+			"names": ["kill"],
+			"action": "SCMP_ACT_ERRNO",
+			"errnoRet": 3
+		}
+	]
+}`
+
+func TestParse(t *testing.T) {
+	profile, err := Parse([]byte(testProfile))
+	require.NoError(t, err)
+
+	assert.Equal(t, ActErrno, profile.DefaultAction)
+	require.Len(t, profile.Syscalls, 4)
+	assert.Equal(t, []string{"read", "write", "unknown_syscall"}, profile.Syscalls[0].Names)
+	assert.Equal(t, []Arg{{Index: 0, Value: 8, Op: OpEqualTo}}, profile.Syscalls[1].Args)
+	assert.Equal(t, []string{"CAP_SYS_PTRACE"}, profile.Syscalls[2].Includes.Caps)
+	require.NotNil(t, profile.Syscalls[3].ErrnoRet)
+	assert.Equal(t, uint(3), *profile.Syscalls[3].ErrnoRet)
+}
+
+func TestParseInvalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"invalidJSON":     `{"defaultAction":`,
+		"noDefaultAction": `{"syscalls": []}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse([]byte(data))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestCompileRuleArg(t *testing.T) {
+	const (
+		nr  = 135
+		act = unix.SECCOMP_RET_ALLOW
+	)
+
+	block, err := compileRule(nr, []Arg{{Index: 1, Value: 0x200000008, Op: OpEqualTo}}, act)
+	require.NoError(t, err)
+
+	// Each failed comparison jumps over the rest of the block, including the return instruction.
+	assert.Equal(t, []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offsetNR},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: nr, Jf: 5},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offsetArgs + 8 + 4},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 2, Jf: 3},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: offsetArgs + 8},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 8, Jf: 1},
+		{Code: unix.BPF_RET | unix.BPF_K, K: act},
+	}, block)
+}
+
+func TestCompileInvalid(t *testing.T) {
+	if !Supported() {
+		t.Skip("seccomp is not supported")
+	}
+
+	for name, profile := range map[string]Profile{
+		"defaultAction": {DefaultAction: "SCMP_ACT_UNKNOWN"},
+		"action": {
+			DefaultAction: ActAllow,
+			Syscalls:      []Syscall{{Names: []string{"read"}, Action: "SCMP_ACT_UNKNOWN"}},
+		},
+		"operator": {
+			DefaultAction: ActAllow,
+			Syscalls: []Syscall{
+				{Names: []string{"read"}, Action: ActErrno, Args: []Arg{{Op: "SCMP_CMP_UNKNOWN"}}},
+			},
+		},
+		"argIndex": {
+			DefaultAction: ActAllow,
+			Syscalls: []Syscall{
+				{Names: []string{"read"}, Action: ActErrno, Args: []Arg{{Index: maxArgs, Op: OpEqualTo}}},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := compile(profile)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestDefaultProfile(t *testing.T) {
+	if !Supported() {
+		t.Skip("seccomp is not supported")
+	}
+
+	program, err := compile(DefaultProfile())
+	require.NoError(t, err)
+
+	eperm := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM))
+	enosys := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS))
+	tests := []struct {
+		Name     string
+		Arch     uint32
+		Syscall  string
+		Args     [maxArgs]uint64
+		Expected uint32
+	}{
+		{Name: "read", Syscall: "read", Expected: unix.SECCOMP_RET_ALLOW},
+		{Name: "foreignArch", Arch: nativeArch + 1, Syscall: "read", Expected: unix.SECCOMP_RET_KILL_PROCESS},
+		{Name: "mount", Syscall: "mount", Expected: eperm},
+		{Name: "unshare", Syscall: "unshare", Expected: eperm},
+		{Name: "cloneThread", Syscall: "clone", Args: [maxArgs]uint64{unix.CLONE_VM | unix.CLONE_THREAD},
+			Expected: unix.SECCOMP_RET_ALLOW},
+		{Name: "cloneNamespace", Syscall: "clone", Args: [maxArgs]uint64{unix.CLONE_NEWUSER}, Expected: eperm},
+		{Name: "clone3", Syscall: "clone3", Expected: enosys},
+		{Name: "personalityLinux", Syscall: "personality", Args: [maxArgs]uint64{0x0}, Expected: unix.SECCOMP_RET_ALLOW},
+		{Name: "personalityQuery", Syscall: "personality", Args: [maxArgs]uint64{0xffffffff},
+			Expected: unix.SECCOMP_RET_ALLOW},
+		{Name: "personalityOther", Syscall: "personality", Args: [maxArgs]uint64{0x0400000}, Expected: eperm},
+		{Name: "personalityHighBits", Syscall: "personality", Args: [maxArgs]uint64{0x100000000}, Expected: eperm},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			nr, exists := syscalls[test.Syscall]
+			require.True(t, exists)
+
+			arch := test.Arch
+			if arch == 0 {
+				arch = nativeArch
+			}
+			assert.Equal(t, test.Expected, evaluate(t, program, nr, arch, test.Args))
+		})
+	}
+}
+
+func TestCustomProfile(t *testing.T) {
+	if !Supported() {
+		t.Skip("seccomp is not supported")
+	}
+
+	profile, err := Parse([]byte(testProfile))
+	require.NoError(t, err)
+	program, err := compile(profile)
+	require.NoError(t, err)
+
+	eperm := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM))
+	tests := []struct {
+		Name     string
+		Syscall  string
+		Args     [maxArgs]uint64
+		Expected uint32
+	}{
+		{Name: "read", Syscall: "read", Expected: unix.SECCOMP_RET_ALLOW},
+		{Name: "write", Syscall: "write", Expected: unix.SECCOMP_RET_ALLOW},
+		{Name: "default", Syscall: "mount", Expected: eperm},
+		{Name: "argMatches", Syscall: "personality", Args: [maxArgs]uint64{8}, Expected: unix.SECCOMP_RET_ALLOW},
+		{Name: "argDiffers", Syscall: "personality", Args: [maxArgs]uint64{9}, Expected: eperm},
+		// Process has no additional capabilities, so the rule requiring one is skipped.
+		{Name: "capability", Syscall: "ptrace", Expected: eperm},
+		{Name: "errnoRet", Syscall: "kill", Expected: unix.SECCOMP_RET_ERRNO | uint32(unix.ESRCH)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			assert.Equal(t, test.Expected, evaluate(t, program, syscalls[test.Syscall], nativeArch, test.Args))
+		})
+	}
+}
+
+// evaluate runs the BPF program against seccomp data, supporting the instructions produced by the compiler.
+func evaluate(t *testing.T, program []unix.SockFilter, nr, arch uint32, args [maxArgs]uint64) uint32 {
+	data := make([]byte, offsetArgs+8*maxArgs)
+	binary.LittleEndian.PutUint32(data[offsetNR:], nr)
+	binary.LittleEndian.PutUint32(data[offsetArch:], arch)
+	for i, arg := range args {
+		binary.LittleEndian.PutUint64(data[offsetArgs+8*i:], arg)
+	}
+
+	var acc uint32
+	for pc := 0; pc < len(program); pc++ {
+		ins := program[pc]
+		switch ins.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			acc = binary.LittleEndian.Uint32(data[ins.K:])
+		case unix.BPF_ALU | unix.BPF_AND | unix.BPF_K:
+			acc &= ins.K
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+			pc += jumpOffset(acc == ins.K, ins)
+		case unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K:
+			pc += jumpOffset(acc > ins.K, ins)
+		case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			pc += jumpOffset(acc >= ins.K, ins)
+		case unix.BPF_RET | unix.BPF_K:
+			return ins.K
+		default:
+			t.Fatalf("unexpected instruction %#x", ins.Code)
+		}
+	}
+	t.Fatal("program does not return")
+	return 0
+}
+
+func jumpOffset(cond bool, ins unix.SockFilter) int {
+	if cond {
+		return int(ins.Jt)
+	}
+	return int(ins.Jf)
+}
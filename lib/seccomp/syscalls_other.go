@@ -0,0 +1,12 @@
+//go:build !amd64 && !arm64
+
+package seccomp
+
+// nativeArch is zero because seccomp filters are not supported on this architecture.
+const nativeArch = 0
+
+// x32SyscallBit is not used on this architecture.
+const x32SyscallBit = 0
+
+// syscalls is empty because seccomp filters are not supported on this architecture.
+var syscalls = map[string]uint32{}
@@ -0,0 +1,481 @@
+package network
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// defaultPrefix is the prefix length of network allocated from the pool if not configured otherwise.
+	defaultPrefix = 24
+
+	stateFileExt = ".json"
+	lockFile     = ".lock"
+	hostLockFile = "/run/isolator/network.lock"
+)
+
+var nameRegExp = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9_.-]*$")
+
+// Config is the configuration of named network.
+type Config struct {
+	// Name is the name of the network.
+	Name string
+
+	// StateDir is the directory where networks and leases are stored. Processes sharing networks must use the same
+	// directory.
+	StateDir string
+
+	// CIDR is the IPv4 subnet of the network. If nil, free subnet is allocated from the pool.
+	CIDR *net.IPNet
+
+	// Pool is the range subnet is allocated from if CIDR is not set. If nil, 10.0.0.0/8 is used.
+	Pool *net.IPNet
+
+	// Prefix is the prefix length of subnet allocated from the pool. If zero, 24 is used.
+	Prefix uint8
+}
+
+// Network is the named network which may be shared by many processes. It exists until it is removed explicitly.
+type Network struct {
+	name     string
+	stateDir string
+	cidr     *net.IPNet
+}
+
+// Lease is the address leased to the process.
+type Lease struct {
+	// PID is the ID of the process owning the lease.
+	PID int
+
+	// StartTime is the start time of the owning process in clock ticks since boot, used to detect reused PIDs.
+	StartTime uint64
+
+	// Created is the time when lease was created.
+	Created time.Time
+}
+
+// networkState is the state of the network stored in the state directory.
+type networkState struct {
+	Name   string
+	CIDR   string
+	Leases map[string]Lease
+}
+
+// Open opens the named network, creating it if it does not exist yet. Bridge and firewall rules are recreated
+// if they are missing, e.g. after reboot.
+func Open(config Config) (*Network, error) {
+	if !nameRegExp.MatchString(config.Name) {
+		return nil, errors.Errorf("invalid network name %q", config.Name)
+	}
+
+	stateDir, err := filepath.Abs(config.StateDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	unlockHost, err := lockHost()
+	if err != nil {
+		return nil, err
+	}
+	defer unlockHost()
+
+	unlock, err := lockState(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := prune(stateDir); err != nil {
+		return nil, err
+	}
+
+	states, err := loadStates(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	state, exists := states[config.Name]
+	if !exists {
+		reserved := make([]*net.IPNet, 0, len(states))
+		for _, s := range states {
+			_, cidr, err := net.ParseCIDR(s.CIDR)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			reserved = append(reserved, cidr)
+		}
+
+		cidr, err := allocateNetwork(config, reserved)
+		if err != nil {
+			return nil, err
+		}
+
+		state = networkState{
+			Name:   config.Name,
+			CIDR:   cidr.String(),
+			Leases: map[string]Lease{},
+		}
+		if err := saveState(stateDir, state); err != nil {
+			return nil, err
+		}
+	}
+
+	_, cidr, err := net.ParseCIDR(state.CIDR)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if config.CIDR != nil && cidr.String() != normalize(config.CIDR).String() {
+		return nil, errors.Errorf("network %s exists with different CIDR %s", config.Name, cidr)
+	}
+
+	owner, err := registerNetworkOwner(stateFile(stateDir, config.Name))
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureBridge(cidr, owner); err != nil {
+		return nil, err
+	}
+
+	return &Network{
+		name:     config.Name,
+		stateDir: stateDir,
+		cidr:     cidr,
+	}, nil
+}
+
+// Name returns the name of the network.
+func (n *Network) Name() string {
+	return n.name
+}
+
+// CIDR returns the IPv4 subnet of the network. IPv6 counterpart may be obtained using IPv6.
+func (n *Network) CIDR() *net.IPNet {
+	return n.cidr
+}
+
+// Lease leases free address of the network to the current process. Returned function releases it.
+// Address of the bridge is never leased.
+func (n *Network) Lease() (*net.IPNet, func() error, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	unlock, err := lockState(n.stateDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	state, err := n.loadState()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pid := os.Getpid()
+	startTime, err := processStartTime(pid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ones, bits := n.cidr.Mask.Size()
+	size := uint32(1) << (bits - ones)
+	// The first address is the network itself, the second one is used by bridge and the last one is broadcast.
+	for i := uint32(2); i < size-1; i++ {
+		ip := Addr(n.cidr, i)
+		if _, exists := state.Leases[ip.IP.String()]; exists {
+			continue
+		}
+
+		state.Leases[ip.IP.String()] = Lease{
+			PID:       pid,
+			StartTime: startTime,
+			Created:   time.Now().UTC(),
+		}
+		if err := saveState(n.stateDir, state); err != nil {
+			return nil, nil, err
+		}
+
+		return ip, func() error {
+			return n.release(ip)
+		}, nil
+	}
+
+	return nil, nil, errors.Errorf("no free address in network %s", n.name)
+}
+
+// Leases returns addresses leased in the network.
+func (n *Network) Leases() (map[string]Lease, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	unlock, err := lockState(n.stateDir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	state, err := n.loadState()
+	if err != nil {
+		return nil, err
+	}
+	return state.Leases, nil
+}
+
+// Remove removes the network together with its bridge and firewall rules. It fails if any address is leased.
+func (n *Network) Remove() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	unlockHost, err := lockHost()
+	if err != nil {
+		return err
+	}
+	defer unlockHost()
+
+	unlock, err := lockState(n.stateDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := n.loadState()
+	if err != nil {
+		return err
+	}
+	if len(state.Leases) > 0 {
+		return errors.Errorf("network %s has %d leased addresses", n.name, len(state.Leases))
+	}
+
+	if err := cleanFirewall(n.cidr); err != nil {
+		return err
+	}
+	if err := deleteBridge(n.cidr); err != nil {
+		return err
+	}
+	if err := os.Remove(stateFile(n.stateDir, n.name)); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return unregisterOwner(networkOwner(stateFile(n.stateDir, n.name)))
+}
+
+func (n *Network) release(ip *net.IPNet) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	unlock, err := lockState(n.stateDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := n.loadState()
+	if err != nil {
+		return err
+	}
+	delete(state.Leases, ip.IP.String())
+	return saveState(n.stateDir, state)
+}
+
+func (n *Network) loadState() (networkState, error) {
+	state, err := loadState(stateFile(n.stateDir, n.name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return networkState{}, errors.Errorf("network %s has been removed", n.name)
+		}
+		return networkState{}, err
+	}
+	return state, nil
+}
+
+func allocateNetwork(config Config, reserved []*net.IPNet) (*net.IPNet, error) {
+	if config.CIDR == nil {
+		pool := config.Pool
+		if pool == nil {
+			pool = defaultPool
+		}
+		if pool.IP.To4() == nil {
+			return nil, errors.Errorf("pool %s is not an IPv4 network", pool)
+		}
+		prefix := config.Prefix
+		if prefix == 0 {
+			prefix = defaultPrefix
+		}
+		return findFreeNetwork(normalize(pool), prefix, reserved)
+	}
+
+	cidr := normalize(config.CIDR)
+	if cidr.IP.To4() == nil {
+		return nil, errors.Errorf("CIDR %s is not an IPv4 network", cidr)
+	}
+	if ones, _ := cidr.Mask.Size(); ones > 30 {
+		return nil, errors.Errorf("network %s is too small", cidr)
+	}
+
+	networks, err := hostNetworks()
+	if err != nil {
+		return nil, err
+	}
+	if isTaken(cidr, append(networks, reserved...)) {
+		return nil, errors.Errorf("network %s overlaps with existing one", cidr)
+	}
+	return cidr, nil
+}
+
+// ensureBridge creates bridge and firewall rules of the network if they do not exist.
+func ensureBridge(network *net.IPNet, owner string) error {
+	_, err := netlink.LinkByName(bridgeName(network))
+	switch {
+	case err == nil:
+	case errors.As(err, &netlink.LinkNotFoundError{}):
+		if err := createBridge(network, owner); err != nil {
+			return err
+		}
+	default:
+		return errors.WithStack(err)
+	}
+
+	if err := ensureFirewall(network); err != nil {
+		return err
+	}
+	return enableForwarding(network)
+}
+
+// ensureFirewall recreates firewall rules of the network if any of them is missing, e.g. after reboot or after
+// other firewall reloaded its rules. Rules of containers are kept.
+func ensureFirewall(network *net.IPNet) error {
+	complete, err := firewallComplete(network)
+	if err != nil || complete {
+		return err
+	}
+
+	netAddr := netIP(network)
+	if err := deleteRules(func(ip net.IP) bool {
+		return ip.Equal(netAddr)
+	}); err != nil {
+		return err
+	}
+	return prepareFirewall(network)
+}
+
+// lockState locks the state directory, so it is not modified by other processes concurrently.
+func lockState(stateDir string) (func(), error) {
+	return lockPath(filepath.Join(stateDir, lockFile))
+}
+
+// lockHost locks network resources of the host, so links are not pruned by other processes while being created.
+func lockHost() (func(), error) {
+	return lockPath(hostLockFile)
+}
+
+func lockPath(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0o600)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		_ = f.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	return func() {
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
+
+func loadStates(stateDir string) (map[string]networkState, error) {
+	files, err := filepath.Glob(filepath.Join(stateDir, "*"+stateFileExt))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	states := map[string]networkState{}
+	for _, file := range files {
+		state, err := loadState(file)
+		if err != nil {
+			return nil, err
+		}
+		states[state.Name] = state
+	}
+	return states, nil
+}
+
+func loadState(file string) (networkState, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return networkState{}, errors.WithStack(err)
+	}
+
+	var state networkState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return networkState{}, errors.Wrapf(err, "parsing state file %s failed", file)
+	}
+	if state.Leases == nil {
+		state.Leases = map[string]Lease{}
+	}
+	return state, nil
+}
+
+// saveState stores the state atomically, so it is never read partially by other processes.
+func saveState(stateDir string, state networkState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	file := stateFile(stateDir, state.Name)
+	tmpFile := file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0o600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmpFile, file))
+}
+
+func stateFile(stateDir, name string) string {
+	return filepath.Join(stateDir, name+stateFileExt)
+}
+
+// processStartTime returns the start time of the process in clock ticks since boot.
+func processStartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	// Name of the process may contain spaces and parentheses, so fields are counted after the last parenthesis.
+	// Start time is the 22nd field and the first one after the name is the 3rd.
+	fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+	const startTimeIndex = 22 - 3
+	if len(fields) <= startTimeIndex {
+		return 0, errors.Errorf("invalid stat file of process %d", pid)
+	}
+	startTime, err := strconv.ParseUint(fields[startTimeIndex], 10, 64)
+	return startTime, errors.WithStack(err)
+}
+
+func normalize(network *net.IPNet) *net.IPNet {
+	ip := network.IP.To4()
+	if ip == nil {
+		return network
+	}
+	ones, _ := network.Mask.Size()
+	mask := net.CIDRMask(ones, 32)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
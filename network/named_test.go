@@ -0,0 +1,251 @@
+package network
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllocateNetworkCIDR(t *testing.T) {
+	cidr, err := allocateNetwork(Config{CIDR: mustCIDR(t, "10.234.1.17/24")}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10.234.1.0/24", cidr.String())
+	assert.Len(t, cidr.IP, net.IPv4len)
+}
+
+func TestAllocateNetworkCIDRInvalid(t *testing.T) {
+	tests := []struct {
+		Name     string
+		CIDR     string
+		Reserved []*net.IPNet
+	}{
+		{Name: "ipv6", CIDR: "fd00::/64"},
+		{Name: "tooSmall", CIDR: "10.234.1.0/31"},
+		{Name: "reserved", CIDR: "10.234.1.0/24", Reserved: []*net.IPNet{mustCIDR(t, "10.234.0.0/16")}},
+		{Name: "reservedInside", CIDR: "10.234.0.0/16", Reserved: []*net.IPNet{mustCIDR(t, "10.234.1.0/24")}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			_, err := allocateNetwork(Config{CIDR: mustCIDR(t, test.CIDR)}, test.Reserved)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestAllocateNetworkPool(t *testing.T) {
+	pool := mustCIDR(t, "10.234.0.0/16")
+	reserved := mustCIDR(t, "10.234.0.0/17")
+
+	for range 100 {
+		cidr, err := allocateNetwork(Config{Pool: pool, Prefix: 26}, []*net.IPNet{reserved})
+		require.NoError(t, err)
+
+		ones, _ := cidr.Mask.Size()
+		assert.Equal(t, 26, ones)
+		assert.True(t, pool.Contains(cidr.IP))
+		assert.False(t, reserved.Contains(cidr.IP))
+		assert.Equal(t, cidr.IP, netIP(cidr))
+	}
+}
+
+func TestAllocateNetworkPoolInvalid(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Config   Config
+		Reserved []*net.IPNet
+	}{
+		{Name: "ipv6", Config: Config{Pool: mustCIDR(t, "fd00::/48")}},
+		{Name: "prefixShorterThanPool", Config: Config{Pool: mustCIDR(t, "10.234.0.0/16"), Prefix: 12}},
+		{Name: "prefixTooLong", Config: Config{Pool: mustCIDR(t, "10.234.0.0/16"), Prefix: 31}},
+		{
+			Name:     "exhausted",
+			Config:   Config{Pool: mustCIDR(t, "10.234.1.0/24"), Prefix: 24},
+			Reserved: []*net.IPNet{mustCIDR(t, "10.234.1.0/24")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			_, err := allocateNetwork(test.Config, test.Reserved)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestLease(t *testing.T) {
+	n := newTestNetwork(t, "10.234.1.0/29")
+
+	startTime, err := processStartTime(os.Getpid())
+	require.NoError(t, err)
+
+	// Network, bridge and broadcast addresses are never leased.
+	expected := []string{"10.234.1.2/29", "10.234.1.3/29", "10.234.1.4/29", "10.234.1.5/29", "10.234.1.6/29"}
+	releases := map[string]func() error{}
+	for _, e := range expected {
+		ip, release, err := n.Lease()
+		require.NoError(t, err)
+		assert.Equal(t, e, ip.String())
+		releases[e] = release
+	}
+	_, _, err = n.Lease()
+	require.Error(t, err)
+
+	leases, err := n.Leases()
+	require.NoError(t, err)
+	require.Len(t, leases, len(expected))
+	for _, e := range expected {
+		lease := leases[mustCIDR(t, e).IP.String()]
+		assert.Equal(t, os.Getpid(), lease.PID)
+		assert.Equal(t, startTime, lease.StartTime)
+		assert.WithinDuration(t, time.Now(), lease.Created, time.Minute)
+	}
+
+	// Released address is leased again.
+	require.NoError(t, releases["10.234.1.4/29"]())
+	leases, err = n.Leases()
+	require.NoError(t, err)
+	assert.NotContains(t, leases, "10.234.1.4")
+
+	ip, _, err := n.Lease()
+	require.NoError(t, err)
+	assert.Equal(t, "10.234.1.4/29", ip.String())
+}
+
+func TestLeaseRemovedNetwork(t *testing.T) {
+	n := newTestNetwork(t, "10.234.1.0/24")
+	require.NoError(t, os.Remove(stateFile(n.stateDir, n.name)))
+
+	_, _, err := n.Lease()
+	require.Error(t, err)
+}
+
+func TestPruneLeases(t *testing.T) {
+	stateDir := t.TempDir()
+
+	pid := os.Getpid()
+	startTime, err := processStartTime(pid)
+	require.NoError(t, err)
+
+	live := Lease{PID: pid, StartTime: startTime, Created: time.Now().UTC().Truncate(time.Second)}
+	require.NoError(t, saveState(stateDir, networkState{
+		Name: "test",
+		CIDR: "10.234.1.0/24",
+		Leases: map[string]Lease{
+			"10.234.1.2": live,
+			// PID has been reused by other process.
+			"10.234.1.3": {PID: pid, StartTime: startTime + 1},
+			// Process does not exist.
+			"10.234.1.4": {PID: deadPID(t), StartTime: startTime},
+		},
+	}))
+	require.NoError(t, saveState(stateDir, networkState{
+		Name:   "empty",
+		CIDR:   "10.234.2.0/24",
+		Leases: map[string]Lease{},
+	}))
+
+	require.NoError(t, pruneLeases(stateDir))
+
+	states, err := loadStates(stateDir)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]networkState{
+		"test": {
+			Name:   "test",
+			CIDR:   "10.234.1.0/24",
+			Leases: map[string]Lease{"10.234.1.2": live},
+		},
+		"empty": {
+			Name:   "empty",
+			CIDR:   "10.234.2.0/24",
+			Leases: map[string]Lease{},
+		},
+	}, states)
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	stateDir := t.TempDir()
+
+	state := networkState{
+		Name: "test",
+		CIDR: "10.234.1.0/24",
+		Leases: map[string]Lease{
+			"10.234.1.2": {PID: 1, StartTime: 2, Created: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		},
+	}
+	require.NoError(t, saveState(stateDir, state))
+
+	loaded, err := loadState(stateFile(stateDir, "test"))
+	require.NoError(t, err)
+	assert.Equal(t, state, loaded)
+
+	// Temporary file is renamed, so only the state file and nothing else is left.
+	files, err := os.ReadDir(stateDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "test"+stateFileExt, files[0].Name())
+}
+
+func TestLoadStateWithoutLeases(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test"+stateFileExt)
+	require.NoError(t, os.WriteFile(file, []byte(`{"Name":"test","CIDR":"10.234.1.0/24"}`), 0o600))
+
+	state, err := loadState(file)
+	require.NoError(t, err)
+	assert.Equal(t, networkState{Name: "test", CIDR: "10.234.1.0/24", Leases: map[string]Lease{}}, state)
+}
+
+func TestLoadStateInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test"+stateFileExt)
+	require.NoError(t, os.WriteFile(file, []byte(`{"Name":`), 0o600))
+
+	_, err := loadState(file)
+	require.Error(t, err)
+}
+
+func TestProcessStartTime(t *testing.T) {
+	startTime, err := processStartTime(os.Getpid())
+	require.NoError(t, err)
+	assert.NotZero(t, startTime)
+
+	_, err = processStartTime(deadPID(t))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func newTestNetwork(t *testing.T, cidr string) *Network {
+	n := &Network{
+		name:     "test",
+		stateDir: t.TempDir(),
+		cidr:     mustCIDR(t, cidr),
+	}
+	require.NoError(t, saveState(n.stateDir, networkState{
+		Name:   n.name,
+		CIDR:   n.cidr.String(),
+		Leases: map[string]Lease{},
+	}))
+	return n
+}
+
+func mustCIDR(t *testing.T, cidr string) *net.IPNet {
+	ip, network, err := net.ParseCIDR(cidr)
+	require.NoError(t, err)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	network.IP = ip
+	return network
+}
+
+// deadPID returns the PID of the process which has already exited.
+func deadPID(t *testing.T) int {
+	p, err := os.StartProcess("/bin/true", []string{"true"}, &os.ProcAttr{})
+	require.NoError(t, err)
+	_, err = p.Wait()
+	require.NoError(t, err)
+	return p.Pid
+}
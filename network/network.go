@@ -1,18 +1,23 @@
 package network
 
 import (
+	"bytes"
 	"encoding/hex"
 	"math"
 	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 
+	"github.com/outofforest/isolator/lib/dns"
 	"github.com/outofforest/isolator/lib/firewall"
 )
 
@@ -24,9 +29,30 @@ const (
 	nftChainNATOutput      = "NAT_OUTPUT"
 	nftChainNATPrerouting  = "NAT_PREROUTING"
 	nftChainNATPostrouting = "NAT_POSTROUTING"
+
+	foreignCommentPrefix = nftTable + ":"
+
+	// udataRuleComment is the type of user data attribute storing the comment of the rule.
+	udataRuleComment = 0
+
+	bridgePrefix = "islbr"
+	vethPrefix   = "islve"
 )
 
-var mu = sync.Mutex{}
+// ulaPrefix is the unique local IPv6 prefix (RFC 4193) of networks created by isolator. IPv6 addresses are derived
+// from IPv4 ones by placing them in the lowest 32 bits, so IPv6 network is free whenever IPv4 one is.
+var ulaPrefix = net.IP{0xfd, 0x69, 0x73, 0x6f, 0x6c, 0x61}
+
+// maxAllocationAttempts is the number of random networks checked before giving up.
+const maxAllocationAttempts = 10000
+
+// defaultPool is the pool random networks are allocated from.
+var defaultPool = &net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}
+
+var (
+	mu        = sync.Mutex{}
+	exclusive bool
+)
 
 // ExposedPort defines a port to be exposed from the namespace.
 type ExposedPort struct {
@@ -37,17 +63,47 @@ type ExposedPort struct {
 	Public       bool
 }
 
-// Random selects random available network.
+// SetExclusive sets the mode of isolator's firewall. By default, it coexists with tables of other software, like
+// firewalld or Docker, and the host is protected by them. Their input and forward chains get rules, tagged by
+// the comment, accepting traffic of the bridges and DNS queries sent to them, those rules are deleted together with
+// the network. In exclusive mode, tables of other software are deleted and incoming traffic not related to
+// connections initiated by the host is dropped.
+// Mode must be set before networks are created.
+func SetExclusive(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	exclusive = enabled
+}
+
+// Random selects random available network. Network is dual-stack, IPv4 one is returned and IPv6 counterpart may be
+// obtained using IPv6.
+// Resources left by crashed processes are pruned before network is selected.
 func Random(prefix uint8) (*net.IPNet, func() error, error) {
 	mu.Lock()
 	defer mu.Unlock()
 
-	network, err := findFreeNetwork(prefix)
+	unlock, err := lockHost()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	if err := prune(""); err != nil {
+		return nil, nil, err
+	}
+
+	network, err := findFreeNetwork(defaultPool, prefix, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	owner, err := processOwner()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if err := createBridge(network); err != nil {
+	if err := createBridge(network, owner); err != nil {
 		return nil, nil, err
 	}
 
@@ -71,7 +127,33 @@ func Random(prefix uint8) (*net.IPNet, func() error, error) {
 	}, nil
 }
 
-func findFreeNetwork(prefix uint8) (*net.IPNet, error) {
+func findFreeNetwork(pool *net.IPNet, prefix uint8, reserved []*net.IPNet) (*net.IPNet, error) {
+	poolOnes, _ := pool.Mask.Size()
+	if int(prefix) < poolOnes || prefix > 30 {
+		return nil, errors.Errorf("invalid prefix /%d for pool %s", prefix, pool)
+	}
+
+	networks, err := hostNetworks()
+	if err != nil {
+		return nil, err
+	}
+	networks = append(networks, reserved...)
+
+	for range maxAllocationAttempts {
+		// Bits of pool prefix are taken from the pool, the rest is random.
+		ip := uint32ToIP4(ip4ToUint32(netIP(pool)) | rand.Uint32()&(math.MaxUint32>>poolOnes))
+		ipNet := &net.IPNet{IP: ip, Mask: net.CIDRMask(int(prefix), 32)}
+		ipNet.IP = netIP(ipNet)
+
+		if !isTaken(ipNet, networks) {
+			return ipNet, nil
+		}
+	}
+	return nil, errors.Errorf("no free network /%d found in pool %s", prefix, pool)
+}
+
+// hostNetworks returns networks of addresses assigned to the interfaces of the host.
+func hostNetworks() ([]*net.IPNet, error) {
 	links, err := netlink.LinkList()
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -79,43 +161,26 @@ func findFreeNetwork(prefix uint8) (*net.IPNet, error) {
 
 	networks := []*net.IPNet{}
 	for _, l := range links {
-		addrs, err := netlink.AddrList(l, netlink.FAMILY_V4)
+		addrs, err := netlink.AddrList(l, netlink.FAMILY_ALL)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
 		for _, addr := range addrs {
-			networks = append(networks, &net.IPNet{IP: netIP(addr.IPNet), Mask: addr.Mask})
+			networks = append(networks, addr.IPNet)
 		}
 	}
+	return networks, nil
+}
 
-	for {
-		ip := uint32ToIP4(rand.Uint32())
-		ip[0] = 10
-		ipNet := &net.IPNet{IP: ip, Mask: net.CIDRMask(int(prefix), 32)}
-		ipNet.IP = netIP(ipNet)
-
-		var exists bool
-		for _, n := range networks {
-			p := int(prefix)
-			ones, _ := n.Mask.Size()
-			if ones < p {
-				p = ones
-			}
-
-			mask := net.CIDRMask(p, 32)
-			n1 := netIP(&net.IPNet{IP: ipNet.IP, Mask: mask})
-			n2 := netIP(&net.IPNet{IP: n.IP, Mask: mask})
-
-			if n1.Equal(n2) {
-				exists = true
-				break
-			}
-		}
-
-		if !exists {
-			return ipNet, nil
+// isTaken returns true if network or its IPv6 counterpart overlaps with any of the networks.
+func isTaken(network *net.IPNet, networks []*net.IPNet) bool {
+	network6 := IPv6(network)
+	for _, n := range networks {
+		if overlap(n, network) || overlap(n, network6) {
+			return true
 		}
 	}
+	return false
 }
 
 // Addr returns nth address in the network.
@@ -123,11 +188,31 @@ func Addr(network *net.IPNet, index uint32) *net.IPNet {
 	return &net.IPNet{IP: uint32ToIP4(ip4ToUint32(netIP(network)) + index), Mask: network.Mask}
 }
 
+// IPv6 returns the IPv6 counterpart of IPv4 address or network.
+func IPv6(ip *net.IPNet) *net.IPNet {
+	ip6 := make(net.IP, net.IPv6len)
+	copy(ip6, ulaPrefix)
+	copy(ip6[net.IPv6len-net.IPv4len:], ip.IP.To4())
+	ones, bits := ip.Mask.Size()
+	return &net.IPNet{IP: ip6, Mask: net.CIDRMask(8*net.IPv6len-bits+ones, 8*net.IPv6len)}
+}
+
 // Join adds container to the network.
 func Join(ip *net.IPNet, exposedPorts []ExposedPort, pid int) (func() error, error) {
 	mu.Lock()
 	defer mu.Unlock()
 
+	unlock, err := lockHost()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	owner, err := processOwner()
+	if err != nil {
+		return nil, err
+	}
+
 	link, err := netlink.LinkByName(bridgeName(ip))
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -152,6 +237,10 @@ func Join(ip *net.IPNet, exposedPorts []ExposedPort, pid int) (func() error, err
 		return nil, errors.WithStack(err)
 	}
 
+	if err := netlink.LinkSetAlias(vethHost, owner); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
 	if err := netlink.LinkSetUp(vethHost); err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -221,10 +310,26 @@ func SetupContainer(ip *net.IPNet) error {
 		return errors.WithStack(err)
 	}
 
+	// Duplicate address detection is skipped, otherwise services can't bind to the address until it completes.
+	if err := netlink.AddrAdd(vethContainer, &netlink.Addr{IPNet: IPv6(ip), Flags: unix.IFA_F_NODAD}); err != nil {
+		if errors.Is(err, unix.EAFNOSUPPORT) {
+			// IPv6 is disabled in the kernel.
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+
+	if err := netlink.RouteAdd(&netlink.Route{
+		Scope:     netlink.SCOPE_UNIVERSE,
+		LinkIndex: vethContainer.Attrs().Index,
+		Gw:        IPv6(&net.IPNet{IP: firstIP(ip), Mask: ip.Mask}).IP,
+	}); err != nil && !errors.Is(err, unix.EAFNOSUPPORT) {
+		return errors.WithStack(err)
+	}
 	return nil
 }
 
-func createBridge(network *net.IPNet) error {
+func createBridge(network *net.IPNet, owner string) error {
 	bridge := &netlink.Bridge{
 		LinkAttrs: netlink.LinkAttrs{
 			Name: bridgeName(network),
@@ -235,11 +340,29 @@ func createBridge(network *net.IPNet) error {
 		return errors.WithStack(err)
 	}
 
+	if err := netlink.LinkSetAlias(bridge, owner); err != nil {
+		return errors.WithStack(err)
+	}
+
 	if err := netlink.AddrAdd(bridge, &netlink.Addr{IPNet: &net.IPNet{IP: firstIP(network),
 		Mask: network.Mask}}); err != nil {
 		return errors.WithStack(err)
 	}
 
+	if ipv6Supported() {
+		// IPv6 might be disabled for new interfaces by default.
+		if err := os.WriteFile(filepath.Join("/proc/sys/net/ipv6/conf", bridge.Name, "disable_ipv6"), []byte("0"),
+			0o600); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := netlink.AddrAdd(bridge, &netlink.Addr{
+			IPNet: IPv6(&net.IPNet{IP: firstIP(network), Mask: network.Mask}),
+			Flags: unix.IFA_F_NODAD,
+		}); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
 	if err := netlink.LinkSetUp(bridge); err != nil {
 		return errors.WithStack(err)
 	}
@@ -258,14 +381,16 @@ func prepareFirewall(network *net.IPNet) error {
 	}
 
 	for _, t := range tables {
-		if t.Name != nftTable {
+		// Table of the same name but different family is left by previous versions of isolator.
+		if !isTable(t) && (exclusive || t.Name == nftTable) {
 			c.DelTable(t)
 		}
 	}
 
+	// Table of inet family handles both IPv4 and IPv6 packets.
 	table := c.AddTable(&nftables.Table{
 		Name:   nftTable,
-		Family: nftables.TableFamilyIPv4,
+		Family: nftables.TableFamilyINet,
 	})
 
 	policyDrop := nftables.ChainPolicyDrop
@@ -277,17 +402,26 @@ func prepareFirewall(network *net.IPNet) error {
 	}
 
 	var filterInputChain *nftables.Chain
+	var foreignInputChains, foreignForwardChains []*nftables.Chain
 	for _, ch := range chains {
-		if ch.Table.Name != nftTable {
-			continue
-		}
-		if ch.Name == nftChainFilterInput {
-			filterInputChain = ch
-			break
+		switch {
+		case isTable(ch.Table):
+			if ch.Name == nftChainFilterInput {
+				filterInputChain = ch
+			}
+		case !exclusive && isForeignChain(ch, nftables.ChainHookInput):
+			foreignInputChains = append(foreignInputChains, ch)
+		case !exclusive && isForeignChain(ch, nftables.ChainHookForward):
+			foreignForwardChains = append(foreignForwardChains, ch)
 		}
 	}
 
-	if filterInputChain == nil {
+	// Host is protected by the input chain in exclusive mode only, otherwise it is the job of its own firewall.
+	switch {
+	case !exclusive && filterInputChain != nil:
+		c.FlushChain(filterInputChain)
+		c.DelChain(filterInputChain)
+	case exclusive && filterInputChain == nil:
 		filterInputChain = c.AddChain(&nftables.Chain{
 			Name:     nftChainFilterInput,
 			Table:    table,
@@ -314,6 +448,32 @@ func prepareFirewall(network *net.IPNet) error {
 				firewall.Accept(),
 			),
 		})
+		// ICMPv6 carries neighbor discovery, without it IPv6 doesn't work at all.
+		c.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: filterInputChain,
+			Exprs: firewall.Expressions(
+				firewall.Protocol("icmpv6"),
+				firewall.Accept(),
+			),
+		})
+	}
+
+	// Namespaces resolve names using DNS server running on the bridge.
+	if exclusive {
+		for _, exprs := range dnsExpressions(bridge) {
+			c.AddRule(&nftables.Rule{
+				Table:    table,
+				Chain:    filterInputChain,
+				UserData: netAddr,
+				Exprs:    exprs,
+			})
+		}
+	}
+
+	forwardPolicy := policyAccept
+	if exclusive {
+		forwardPolicy = policyDrop
 	}
 
 	c.AddChain(&nftables.Chain{
@@ -330,7 +490,7 @@ func prepareFirewall(network *net.IPNet) error {
 		Type:     nftables.ChainTypeFilter,
 		Hooknum:  nftables.ChainHookForward,
 		Priority: nftables.ChainPriorityFilter,
-		Policy:   &policyDrop,
+		Policy:   &forwardPolicy,
 	})
 	c.AddChain(&nftables.Chain{
 		Name:     nftChainNATOutput,
@@ -380,6 +540,20 @@ func prepareFirewall(network *net.IPNet) error {
 		),
 	})
 
+	// Forward chain accepts everything by default if it coexists with other firewalls, so traffic to namespace not
+	// accepted by rules above is dropped explicitly. Rules accepting exposed ports are inserted before this one.
+	if !exclusive {
+		c.AddRule(&nftables.Rule{
+			Table:    table,
+			Chain:    filterForwardChain,
+			UserData: netAddr,
+			Exprs: firewall.Expressions(
+				firewall.OutgoingInterface(bridge),
+				firewall.Drop(),
+			),
+		})
+	}
+
 	// masquerade namespace
 	c.AddRule(&nftables.Rule{
 		Table:    table,
@@ -391,6 +565,41 @@ func prepareFirewall(network *net.IPNet) error {
 		),
 	})
 
+	// Packet is dropped if any base chain drops it, so traffic of namespace must be accepted explicitly by forward
+	// chains of other firewalls, like the one of Docker, before their rules dropping or rejecting it. Traffic to
+	// namespace is still filtered by the forward chain of isolator. Rules use only the matches understood by
+	// iptables-nft, so tables created by it may still be listed and saved.
+	for _, ch := range foreignForwardChains {
+		for _, exprs := range [][]expr.Any{
+			firewall.Expressions(
+				firewall.IncomingInterface(bridge),
+				firewall.Accept(),
+			),
+			firewall.Expressions(
+				firewall.OutgoingInterface(bridge),
+				firewall.Accept(),
+			),
+		} {
+			c.InsertRule(&nftables.Rule{
+				Table:    ch.Table,
+				Chain:    ch,
+				UserData: foreignUserData(netAddr),
+				Exprs:    exprs,
+			})
+		}
+	}
+	// For the same reason queries sent to DNS server running on the bridge must be accepted by input chains.
+	for _, ch := range foreignInputChains {
+		for _, exprs := range dnsExpressions(bridge) {
+			c.InsertRule(&nftables.Rule{
+				Table:    ch.Table,
+				Chain:    ch,
+				UserData: foreignUserData(netAddr),
+				Exprs:    exprs,
+			})
+		}
+	}
+
 	return errors.WithStack(c.Flush())
 }
 
@@ -399,6 +608,12 @@ func enableForwarding(network *net.IPNet) error {
 		return errors.WithStack(err)
 	}
 
+	if ipv6Supported() {
+		if err := os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0o600); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
 	return errors.WithStack(os.WriteFile(filepath.Join("/proc/sys/net/ipv4/conf", bridgeName(network),
 		"route_localnet"), []byte("1"), 0o600))
 }
@@ -430,7 +645,7 @@ func configureFirewall(ip *net.IPNet, exposedPorts []ExposedPort) error {
 
 	var table *nftables.Table
 	for _, t := range tables {
-		if t.Name == nftTable {
+		if isTable(t) {
 			table = t
 			break
 		}
@@ -450,7 +665,7 @@ func configureFirewall(ip *net.IPNet, exposedPorts []ExposedPort) error {
 	var natPreroutingChain *nftables.Chain
 	var natPostroutingChain *nftables.Chain
 	for _, ch := range chains {
-		if ch.Table.Name != nftTable {
+		if !isTable(ch.Table) {
 			continue
 		}
 		switch ch.Name {
@@ -483,46 +698,49 @@ func configureFirewall(ip *net.IPNet, exposedPorts []ExposedPort) error {
 	}
 
 	bridge := bridgeName(ip)
-	hostIP := firstIP(ip)
 	for _, p := range exposedPorts {
-		// redirecting requests originating from the host machine
-		c.AddRule(&nftables.Rule{
-			Table:    table,
-			Chain:    natOutputChain,
-			UserData: ip.IP,
-			Exprs: firewall.Expressions(
-				firewall.DestinationAddress(p.ExternalIP),
-				firewall.LocalDestinationAddress(),
-				firewall.Protocol(p.Protocol),
-				firewall.DestinationPort(p.ExternalPort),
-				firewall.DestinationNAT(ip.IP, p.InternalPort),
-			),
-		})
+		for _, addrs := range familyAddresses(ip, p.ExternalIP) {
+			// redirecting requests originating from the host machine
+			c.AddRule(&nftables.Rule{
+				Table:    table,
+				Chain:    natOutputChain,
+				UserData: ip.IP,
+				Exprs: firewall.Expressions(
+					firewall.DestinationAddress(addrs.ExternalIP),
+					firewall.LocalDestinationAddress(),
+					firewall.Protocol(p.Protocol),
+					firewall.DestinationPort(p.ExternalPort),
+					firewall.DestinationNAT(addrs.IP.IP, p.InternalPort),
+				),
+			})
 
-		// redirecting requests from local addresses.
-		c.AddRule(&nftables.Rule{
-			Table:    table,
-			Chain:    natPostroutingChain,
-			UserData: ip.IP,
-			Exprs: firewall.Expressions(
-				firewall.OutgoingInterface(bridge),
-				firewall.NotSourceAddress(hostIP),
-				firewall.LocalSourceAddress(),
-				firewall.DestinationAddress(ip.IP),
-				firewall.Protocol(p.Protocol),
-				firewall.DestinationPort(p.InternalPort),
-				firewall.Masquerade(),
-			),
-		})
+			// redirecting requests from local addresses.
+			c.AddRule(&nftables.Rule{
+				Table:    table,
+				Chain:    natPostroutingChain,
+				UserData: ip.IP,
+				Exprs: firewall.Expressions(
+					firewall.OutgoingInterface(bridge),
+					firewall.NotSourceAddress(addrs.HostIP),
+					firewall.LocalSourceAddress(),
+					firewall.DestinationAddress(addrs.IP.IP),
+					firewall.Protocol(p.Protocol),
+					firewall.DestinationPort(p.InternalPort),
+					firewall.Masquerade(),
+				),
+			})
+
+			if !p.Public {
+				continue
+			}
 
-		if p.Public {
 			// enable forwarding
-			c.AddRule(&nftables.Rule{
+			c.InsertRule(&nftables.Rule{
 				Table:    table,
 				Chain:    filterForwardChain,
 				UserData: ip.IP,
 				Exprs: firewall.Expressions(
-					firewall.DestinationAddress(ip.IP),
+					firewall.DestinationAddress(addrs.IP.IP),
 					firewall.Protocol(p.Protocol),
 					firewall.DestinationPort(p.InternalPort),
 					firewall.Accept(),
@@ -535,11 +753,11 @@ func configureFirewall(ip *net.IPNet, exposedPorts []ExposedPort) error {
 				Chain:    natPreroutingChain,
 				UserData: ip.IP,
 				Exprs: firewall.Expressions(
-					firewall.DestinationAddress(p.ExternalIP),
+					firewall.DestinationAddress(addrs.ExternalIP),
 					firewall.LocalDestinationAddress(),
 					firewall.Protocol(p.Protocol),
 					firewall.DestinationPort(p.ExternalPort),
-					firewall.DestinationNAT(ip.IP, p.InternalPort),
+					firewall.DestinationNAT(addrs.IP.IP, p.InternalPort),
 				),
 			})
 
@@ -550,9 +768,9 @@ func configureFirewall(ip *net.IPNet, exposedPorts []ExposedPort) error {
 				UserData: ip.IP,
 				Exprs: firewall.Expressions(
 					firewall.OutgoingInterface(bridge),
-					firewall.SourceNetwork(ip),
-					firewall.NotSourceAddress(hostIP),
-					firewall.DestinationAddress(ip.IP),
+					firewall.SourceNetwork(addrs.IP),
+					firewall.NotSourceAddress(addrs.HostIP),
+					firewall.DestinationAddress(addrs.IP.IP),
 					firewall.Protocol(p.Protocol),
 					firewall.DestinationPort(p.InternalPort),
 					firewall.Masquerade(),
@@ -565,24 +783,15 @@ func configureFirewall(ip *net.IPNet, exposedPorts []ExposedPort) error {
 }
 
 func cleanFirewall(ip *net.IPNet) error {
-	c := &nftables.Conn{}
-
-	tables, err := c.ListTables()
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	var table *nftables.Table
-	for _, t := range tables {
-		if t.Name == nftTable {
-			table = t
-			break
-		}
-	}
+	return deleteRules(func(ruleIP net.IP) bool {
+		return ruleIP.Equal(ip.IP) || netIP(&net.IPNet{IP: ruleIP, Mask: ip.Mask}).Equal(ip.IP)
+	})
+}
 
-	if table == nil {
-		return nil
-	}
+// deleteRules deletes rules created by isolator for networks and containers whose addresses are matched by
+// the function.
+func deleteRules(match func(ip net.IP) bool) error {
+	c := &nftables.Conn{}
 
 	chains, err := c.ListChains()
 	if err != nil {
@@ -590,20 +799,28 @@ func cleanFirewall(ip *net.IPNet) error {
 	}
 
 	for _, ch := range chains {
-		if ch.Table.Name != nftTable {
+		own := isTable(ch.Table)
+		if !own && !isForeignChain(ch, nftables.ChainHookInput) && !isForeignChain(ch, nftables.ChainHookForward) {
 			continue
 		}
 
-		rules, err := c.GetRules(table, ch)
+		rules, err := c.GetRules(ch.Table, ch)
 		if err != nil {
 			return errors.WithStack(err)
 		}
 
 		for _, r := range rules {
-			if len(r.UserData) != 4 {
+			userData := r.UserData
+			if !own {
+				var ok bool
+				if userData, ok = parseForeignUserData(userData); !ok {
+					continue
+				}
+			}
+			if len(userData) != 4 {
 				continue
 			}
-			if !net.IP(r.UserData).Equal(ip.IP) && !netIP(&net.IPNet{IP: r.UserData, Mask: ip.Mask}).Equal(ip.IP) {
+			if !match(userData) {
 				continue
 			}
 			if err := c.DelRule(r); err != nil {
@@ -615,6 +832,160 @@ func cleanFirewall(ip *net.IPNet) error {
 	return errors.WithStack(c.Flush())
 }
 
+// firewallComplete returns true if forward chain of isolator and input and forward chains of other firewalls contain
+// rules of the network.
+func firewallComplete(network *net.IPNet) (bool, error) {
+	c := &nftables.Conn{}
+
+	chains, err := c.ListChains()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	netAddr := netIP(network)
+	ownFound := false
+	for _, ch := range chains {
+		own := isTable(ch.Table) && ch.Name == nftChainFilterForward
+		if !own && (exclusive || (!isForeignChain(ch, nftables.ChainHookInput) &&
+			!isForeignChain(ch, nftables.ChainHookForward))) {
+			continue
+		}
+
+		rules, err := c.GetRules(ch.Table, ch)
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+
+		found := false
+		for _, r := range rules {
+			var ip net.IP = r.UserData
+			if !own {
+				var ok bool
+				if ip, ok = parseForeignUserData(r.UserData); !ok {
+					continue
+				}
+			}
+			if ip.Equal(netAddr) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+		ownFound = ownFound || own
+	}
+
+	return ownFound, nil
+}
+
+// addresses are the addresses used by rules of exposed port in single IP family.
+type addresses struct {
+	// ExternalIP is the address port is exposed on, nil means any address.
+	ExternalIP net.IP
+
+	// IP is the address of the container.
+	IP *net.IPNet
+
+	// HostIP is the address of the bridge.
+	HostIP net.IP
+}
+
+// familyAddresses returns addresses of the container in the IP families port is exposed in. If external IP is
+// unspecified, port is exposed in both of them.
+func familyAddresses(ip *net.IPNet, externalIP net.IP) []addresses {
+	hostIP := &net.IPNet{IP: firstIP(ip), Mask: ip.Mask}
+	addrs4 := addresses{IP: ip, HostIP: hostIP.IP}
+	addrs6 := addresses{IP: IPv6(ip), HostIP: IPv6(hostIP).IP}
+
+	switch {
+	case len(externalIP) == 0 || externalIP.IsUnspecified():
+		return []addresses{addrs4, addrs6}
+	case externalIP.To4() != nil:
+		addrs4.ExternalIP = externalIP
+		return []addresses{addrs4}
+	default:
+		addrs6.ExternalIP = externalIP
+		return []addresses{addrs6}
+	}
+}
+
+// isForeignChain returns true if chain is the base filter chain of other firewall attached to the hook.
+// Chains of raw, mangle and security tables are skipped, because accepting packet there would bypass their other
+// rules, e.g. the ones marking packets, instead of preventing the packet from being dropped.
+func isForeignChain(ch *nftables.Chain, hook *nftables.ChainHook) bool {
+	switch ch.Table.Family {
+	case nftables.TableFamilyINet, nftables.TableFamilyIPv4, nftables.TableFamilyIPv6:
+	default:
+		return false
+	}
+	if ch.Priority == nil || *ch.Priority < *nftables.ChainPriorityFilter ||
+		*ch.Priority >= *nftables.ChainPrioritySecurity {
+		return false
+	}
+	return ch.Table.Name != nftTable && ch.Type == nftables.ChainTypeFilter && ch.Hooknum != nil &&
+		*ch.Hooknum == *hook
+}
+
+// dnsExpressions returns expressions of rules accepting queries sent from namespaces to the DNS server running on
+// the bridge.
+func dnsExpressions(bridge string) [][]expr.Any {
+	exprs := make([][]expr.Any, 0, 2)
+	for _, protocol := range []string{"udp", "tcp"} {
+		exprs = append(exprs, firewall.Expressions(
+			firewall.IncomingInterface(bridge),
+			firewall.Protocol(protocol),
+			firewall.DestinationPort(dns.Port),
+			firewall.Accept(),
+		))
+	}
+	return exprs
+}
+
+// foreignUserData returns user data tagging rules added to chains of other firewalls, so they may be distinguished
+// from the rules added by their owners. Tag is stored as the comment of the rule, the same way nft and iptables-nft
+// store it.
+func foreignUserData(ip net.IP) []byte {
+	comment := foreignCommentPrefix + ip.String()
+	userData := []byte{udataRuleComment, byte(len(comment) + 1)}
+	userData = append(userData, comment...)
+	return append(userData, 0)
+}
+
+// parseForeignUserData returns the address of network the rule added to chain of other firewall belongs to.
+func parseForeignUserData(userData []byte) (net.IP, bool) {
+	// Attributes are stored as type, length and value.
+	for len(userData) >= 2 && len(userData) >= int(userData[1])+2 {
+		attrType, value := userData[0], userData[2:userData[1]+2]
+		userData = userData[userData[1]+2:]
+		if attrType != udataRuleComment {
+			continue
+		}
+
+		ipStr, ok := strings.CutPrefix(string(bytes.TrimSuffix(value, []byte{0})), foreignCommentPrefix)
+		if !ok {
+			return nil, false
+		}
+		ip := net.ParseIP(ipStr).To4()
+		return ip, ip != nil
+	}
+	return nil, false
+}
+
+// isTable returns true if table is the one managed by isolator.
+func isTable(table *nftables.Table) bool {
+	return table.Name == nftTable && table.Family == nftables.TableFamilyINet
+}
+
+func ipv6Supported() bool {
+	_, err := os.Stat("/proc/sys/net/ipv6")
+	return err == nil
+}
+
+func overlap(n1, n2 *net.IPNet) bool {
+	return n1.Contains(n2.IP) || n2.Contains(n1.IP)
+}
+
 func ip4ToUint32(ip net.IP) uint32 {
 	ip = ip.To4()
 	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
@@ -634,9 +1005,9 @@ func netIP(network *net.IPNet) net.IP {
 }
 
 func bridgeName(ip *net.IPNet) string {
-	return "islbr" + hex.EncodeToString(netIP(ip))
+	return bridgePrefix + hex.EncodeToString(netIP(ip))
 }
 
 func vethName(ip net.IP) string {
-	return "islve" + hex.EncodeToString(ip.To4())
+	return vethPrefix + hex.EncodeToString(ip.To4())
 }
@@ -0,0 +1,124 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPv6(t *testing.T) {
+	tests := []struct {
+		Name     string
+		IP       *net.IPNet
+		Expected string
+	}{
+		{
+			Name:     "address",
+			IP:       &net.IPNet{IP: net.IPv4(10, 0, 1, 2), Mask: net.CIDRMask(24, 32)},
+			Expected: "fd69:736f:6c61::a00:102/120",
+		},
+		{
+			Name:     "address4",
+			IP:       &net.IPNet{IP: net.IPv4(10, 0, 1, 2).To4(), Mask: net.CIDRMask(30, 32)},
+			Expected: "fd69:736f:6c61::a00:102/126",
+		},
+		{
+			Name:     "network",
+			IP:       &net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+			Expected: "fd69:736f:6c61::a00:0/104",
+		},
+		{
+			Name:     "host",
+			IP:       &net.IPNet{IP: net.IPv4(192, 168, 255, 254), Mask: net.CIDRMask(32, 32)},
+			Expected: "fd69:736f:6c61::c0a8:fffe/128",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			ip := IPv6(test.IP)
+			assert.Equal(t, test.Expected, ip.String())
+			assert.Len(t, ip.IP, net.IPv6len)
+			assert.True(t, ip.IP.IsPrivate())
+		})
+	}
+}
+
+func TestIPv6Containment(t *testing.T) {
+	network := &net.IPNet{IP: net.IPv4(10, 0, 1, 0), Mask: net.CIDRMask(24, 32)}
+	network6 := IPv6(network)
+
+	// Addresses of the network are mapped to addresses of its IPv6 counterpart and the other ones are not.
+	assert.True(t, network6.Contains(IPv6(Addr(network, 1)).IP))
+	assert.True(t, network6.Contains(IPv6(Addr(network, 255)).IP))
+	assert.False(t, network6.Contains(IPv6(Addr(network, 256)).IP))
+	assert.False(t, IPv6(&net.IPNet{IP: net.IPv4(10, 0, 2, 0), Mask: net.CIDRMask(24, 32)}).Contains(
+		IPv6(Addr(network, 1)).IP))
+}
+
+func TestForeignUserData(t *testing.T) {
+	ip := net.IPv4(10, 0, 1, 0).To4()
+	userData := foreignUserData(ip)
+
+	// Comment attribute is terminated by zero, like the ones created by nft.
+	assert.Equal(t, append([]byte{0, 18}, "isolator:10.0.1.0\x00"...), userData)
+
+	parsed, ok := parseForeignUserData(userData)
+	require.True(t, ok)
+	assert.Equal(t, ip, parsed)
+}
+
+func TestParseForeignUserDataInvalid(t *testing.T) {
+	tests := []struct {
+		Name     string
+		UserData []byte
+	}{
+		{Name: "empty"},
+		{Name: "foreignComment", UserData: append([]byte{0, 7}, "docker\x00"...)},
+		{Name: "otherAttribute", UserData: append([]byte{1, 18}, "isolator:10.0.1.0\x00"...)},
+		{Name: "truncated", UserData: append([]byte{0, 18}, "isolator:10"...)},
+		{Name: "invalidIP", UserData: append([]byte{0, 13}, "isolator:abc\x00"...)},
+		{Name: "rawIP", UserData: append([]byte("isolator:"), 10, 0, 1, 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			_, ok := parseForeignUserData(test.UserData)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestIsForeignChain(t *testing.T) {
+	chain := func(family nftables.TableFamily, table string, priority nftables.ChainPriority) *nftables.Chain {
+		return &nftables.Chain{
+			Table:    &nftables.Table{Name: table, Family: family},
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookForward,
+			Priority: nftables.ChainPriorityRef(priority),
+		}
+	}
+
+	tests := []struct {
+		Name     string
+		Chain    *nftables.Chain
+		Expected bool
+	}{
+		{Name: "docker", Chain: chain(nftables.TableFamilyIPv4, "filter", 0), Expected: true},
+		{Name: "firewalld", Chain: chain(nftables.TableFamilyINet, "firewalld", 10), Expected: true},
+		{Name: "own", Chain: chain(nftables.TableFamilyINet, nftTable, 0)},
+		{Name: "mangle", Chain: chain(nftables.TableFamilyIPv4, "mangle", -150)},
+		{Name: "security", Chain: chain(nftables.TableFamilyIPv4, "security", 50)},
+		{Name: "bridge", Chain: chain(nftables.TableFamilyBridge, "filter", 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			assert.Equal(t, test.Expected, isForeignChain(test.Chain, nftables.ChainHookForward))
+			assert.False(t, isForeignChain(test.Chain, nftables.ChainHookInput))
+		})
+	}
+}
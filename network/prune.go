@@ -0,0 +1,252 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// Prefixes of link aliases storing owners of links created by isolator.
+const (
+	ownerProcessPrefix = "isolator:process:"
+	ownerNetworkPrefix = "isolator:network:"
+)
+
+// ownersDir is the directory where named networks owning links are registered. Length of link alias is limited, so
+// it stores the hash of the state file path only, and the symlink named after the hash points to the state file.
+var ownersDir = "/run/isolator/networks"
+
+// Prune removes bridges, veth pairs and firewall rules left by processes which exited without cleaning them up,
+// e.g. after being killed. Bridges of named networks are removed once their state files are gone. If state
+// directory is set, leases of exited processes are released in named networks stored there.
+func Prune(stateDir string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	unlockHost, err := lockHost()
+	if err != nil {
+		return err
+	}
+	defer unlockHost()
+
+	if stateDir != "" {
+		unlock, err := lockState(stateDir)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	return prune(stateDir)
+}
+
+// prune removes resources of exited processes. Host and state directory must be locked by the caller.
+func prune(stateDir string) error {
+	if stateDir != "" {
+		if err := pruneLeases(stateDir); err != nil {
+			return err
+		}
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Veths are pruned first, because bridge created by previous versions of isolator is considered stale
+	// once nothing is attached to it.
+	liveIPs := map[string]bool{}
+	for _, l := range links {
+		name := l.Attrs().Name
+		if !strings.HasPrefix(name, vethPrefix) || !strings.HasSuffix(name, "0") {
+			continue
+		}
+		ip, err := hex.DecodeString(strings.TrimSuffix(strings.TrimPrefix(name, vethPrefix), "0"))
+		if err != nil || len(ip) != net.IPv4len {
+			continue
+		}
+
+		if l.Attrs().Alias != "" && !ownerExists(l.Attrs().Alias) {
+			if err := netlink.LinkDel(l); err != nil {
+				return errors.Wrapf(err, "deleting link %s failed", name)
+			}
+			continue
+		}
+		liveIPs[net.IP(ip).String()] = true
+	}
+
+	links, err = netlink.LinkList()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	members := map[int]bool{}
+	for _, l := range links {
+		members[l.Attrs().MasterIndex] = true
+	}
+
+	liveNetworks := map[string]bool{}
+	for _, l := range links {
+		name := l.Attrs().Name
+		if !strings.HasPrefix(name, bridgePrefix) {
+			continue
+		}
+		ip, err := hex.DecodeString(strings.TrimPrefix(name, bridgePrefix))
+		if err != nil || len(ip) != net.IPv4len {
+			continue
+		}
+
+		alias := l.Attrs().Alias
+		if (alias == "" && !members[l.Attrs().Index]) || (alias != "" && !ownerExists(alias)) {
+			if err := netlink.LinkDel(l); err != nil {
+				return errors.Wrapf(err, "deleting link %s failed", name)
+			}
+			if err := unregisterOwner(alias); err != nil {
+				return err
+			}
+			continue
+		}
+		liveNetworks[net.IP(ip).String()] = true
+	}
+
+	// Rules are tagged with the address of the network or container they were created for.
+	return deleteRules(func(ip net.IP) bool {
+		return !liveIPs[ip.String()] && !liveNetworks[ip.String()]
+	})
+}
+
+// pruneLeases releases addresses leased to exited processes in named networks.
+func pruneLeases(stateDir string) error {
+	states, err := loadStates(stateDir)
+	if err != nil {
+		return err
+	}
+
+	for _, state := range states {
+		var changed bool
+		for ip, lease := range state.Leases {
+			if processExists(lease.PID, lease.StartTime) {
+				continue
+			}
+			delete(state.Leases, ip)
+			changed = true
+		}
+		if changed {
+			if err := saveState(stateDir, state); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// processOwner returns the owner of links created by the current process.
+func processOwner() (string, error) {
+	pid := os.Getpid()
+	startTime, err := processStartTime(pid)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%d:%d", ownerProcessPrefix, pid, startTime), nil
+}
+
+// networkOwner returns the owner of links belonging to the named network stored in the state file.
+func networkOwner(stateFile string) string {
+	hash := sha256.Sum256([]byte(stateFile))
+	return ownerNetworkPrefix + hex.EncodeToString(hash[:])
+}
+
+// registerNetworkOwner registers the named network stored in the state file and returns the owner of its links.
+func registerNetworkOwner(stateFile string) (string, error) {
+	owner := networkOwner(stateFile)
+	link, _ := networkOwnerLink(owner)
+
+	if target, err := os.Readlink(link); err == nil && target == stateFile {
+		return owner, nil
+	}
+	if err := os.MkdirAll(ownersDir, 0o700); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := os.Remove(link); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", errors.WithStack(err)
+	}
+	if err := os.Symlink(stateFile, link); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return owner, nil
+}
+
+// unregisterOwner removes the registration of the named network owning links. Other owners are ignored.
+func unregisterOwner(owner string) error {
+	link, ok := networkOwnerLink(owner)
+	if !ok {
+		return nil
+	}
+	if err := os.Remove(link); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// networkOwnerLink returns the path of the symlink registering the named network owning links.
+func networkOwnerLink(owner string) (string, bool) {
+	id, ok := strings.CutPrefix(owner, ownerNetworkPrefix)
+	if !ok {
+		return "", false
+	}
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 2*sha256.Size {
+		return "", false
+	}
+	return filepath.Join(ownersDir, id), true
+}
+
+// ownerExists returns true if owner of the link still exists. Unknown owners are assumed to exist.
+func ownerExists(owner string) bool {
+	if strings.HasPrefix(owner, ownerNetworkPrefix) {
+		link, ok := networkOwnerLink(owner)
+		if !ok {
+			return true
+		}
+		// Unregistered network is assumed to exist, e.g. if directory of owners was cleaned while bridge exists.
+		if _, err := os.Lstat(link); err != nil {
+			return true
+		}
+		// Symlink is dangling once state file is removed.
+		_, err := os.Stat(link)
+		return !errors.Is(err, os.ErrNotExist)
+	}
+
+	process, ok := strings.CutPrefix(owner, ownerProcessPrefix)
+	if !ok {
+		return true
+	}
+	pidStr, startTimeStr, ok := strings.Cut(process, ":")
+	if !ok {
+		return true
+	}
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil {
+		return true
+	}
+	startTime, err := strconv.ParseUint(startTimeStr, 10, 64)
+	if err != nil {
+		return true
+	}
+	return processExists(pid, startTime)
+}
+
+// processExists returns true if process is running. Start time is compared, because PID might be reused.
+func processExists(pid int, startTime uint64) bool {
+	st, err := processStartTime(pid)
+	if err != nil {
+		return !errors.Is(err, os.ErrNotExist)
+	}
+	return st == startTime
+}
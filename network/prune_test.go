@@ -0,0 +1,93 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ifAliasSize is the IFALIASZ limit of link alias length, including terminating zero.
+const ifAliasSize = 256
+
+func TestProcessOwnerExists(t *testing.T) {
+	pid := os.Getpid()
+	startTime, err := processStartTime(pid)
+	require.NoError(t, err)
+
+	owner, err := processOwner()
+	require.NoError(t, err)
+	assert.True(t, ownerExists(owner))
+
+	tests := []struct {
+		Name   string
+		Owner  string
+		Exists bool
+	}{
+		{Name: "reusedPID", Owner: fmt.Sprintf("%s%d:%d", ownerProcessPrefix, pid, startTime+1)},
+		{Name: "dead", Owner: fmt.Sprintf("%s%d:%d", ownerProcessPrefix, deadPID(t), startTime)},
+		{Name: "foreign", Owner: "docker", Exists: true},
+		{Name: "invalid", Owner: ownerProcessPrefix + "abc", Exists: true},
+		{Name: "invalidPID", Owner: ownerProcessPrefix + "abc:1", Exists: true},
+		{Name: "invalidStartTime", Owner: ownerProcessPrefix + "1:abc", Exists: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			assert.Equal(t, test.Exists, ownerExists(test.Owner))
+		})
+	}
+}
+
+func TestNetworkOwnerExists(t *testing.T) {
+	originalOwnersDir := ownersDir
+	ownersDir = t.TempDir()
+	t.Cleanup(func() {
+		ownersDir = originalOwnersDir
+	})
+	stateDir := t.TempDir()
+
+	file := stateFile(stateDir, "test")
+	require.NoError(t, saveState(stateDir, networkState{Name: "test", CIDR: "10.234.1.0/24"}))
+
+	owner, err := registerNetworkOwner(file)
+	require.NoError(t, err)
+	assert.Equal(t, networkOwner(file), owner)
+	assert.True(t, ownerExists(owner))
+
+	// Registration is idempotent.
+	owner2, err := registerNetworkOwner(file)
+	require.NoError(t, err)
+	assert.Equal(t, owner, owner2)
+
+	// Owners of other networks are not affected.
+	otherFile := stateFile(stateDir, "other")
+	require.NoError(t, saveState(stateDir, networkState{Name: "other", CIDR: "10.234.2.0/24"}))
+	otherOwner, err := registerNetworkOwner(otherFile)
+	require.NoError(t, err)
+	assert.NotEqual(t, owner, otherOwner)
+
+	require.NoError(t, os.Remove(file))
+	assert.False(t, ownerExists(owner))
+	assert.True(t, ownerExists(otherOwner))
+
+	require.NoError(t, unregisterOwner(owner))
+	files, err := os.ReadDir(ownersDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, otherOwner, ownerNetworkPrefix+files[0].Name())
+
+	// Unregistered and unknown networks are assumed to exist.
+	assert.True(t, ownerExists(owner))
+	assert.True(t, ownerExists(ownerNetworkPrefix+"/var/lib/network.json"))
+	assert.True(t, ownerExists(ownerNetworkPrefix+"../"+filepath.Base(ownersDir)))
+}
+
+func TestNetworkOwnerLength(t *testing.T) {
+	owner := networkOwner("/" + strings.Repeat("long-directory-name/", 500) + "network.json")
+	assert.Less(t, len(owner), ifAliasSize)
+}
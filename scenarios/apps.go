@@ -9,15 +9,18 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/ridge/must"
 	"go.uber.org/zap"
 
+	"github.com/outofforest/isolator/lib/dns"
 	"github.com/outofforest/isolator/lib/retry"
 	"github.com/outofforest/isolator/lib/task"
 	"github.com/outofforest/isolator/lib/tcontext"
+	"github.com/outofforest/isolator/network"
 	"github.com/outofforest/isolator/wire"
 	"github.com/outofforest/logger"
 	"github.com/outofforest/parallel"
@@ -33,6 +36,10 @@ type RunAppsConfig struct {
 	CacheDir   string
 	AppsDir    string
 	LogsConfig LogsConfig
+
+	// DNS is the configuration of DNS server resolving names and aliases of apps. It runs on the bridge address of
+	// every network apps are connected to.
+	DNS dns.Config
 }
 
 // Application represents an app to run in isolation.
@@ -43,6 +50,26 @@ type Application interface {
 		logsCh chan<- logEnvelope) task.Func
 }
 
+// ResolvableApplication represents an app resolved by DNS server running on the bridge of its network.
+type ResolvableApplication interface {
+	Application
+	GetAliases() []string
+	GetIPNet() *net.IPNet
+}
+
+// appDNS returns nameservers configured inside app. If they are not set, DNS server running on the bridge is used.
+func appDNS(dns []net.IP, ip *net.IPNet) []net.IP {
+	if dns != nil || ip == nil {
+		return dns
+	}
+	return []net.IP{bridgeIP(ip)}
+}
+
+// bridgeIP returns the address of the bridge in the network of the app.
+func bridgeIP(ip *net.IPNet) net.IP {
+	return network.Addr(ip, 1).IP
+}
+
 type logEnvelope struct {
 	AppName string
 	Log     wire.Log
@@ -50,14 +77,48 @@ type logEnvelope struct {
 
 // RunApps runs applications.
 func RunApps(ctx context.Context, config RunAppsConfig, apps ...Application) error {
+	dnsServer, err := dns.New(config.DNS)
+	if err != nil {
+		return err
+	}
+
 	containerHosts := map[string]net.IP{}
+	bridges := map[string]net.IP{}
 	for _, app := range apps {
 		if app.GetName() != "" && app.GetIP() != nil {
 			containerHosts[app.GetName()] = app.GetIP()
 		}
+
+		rApp, ok := app.(ResolvableApplication)
+		if !ok || rApp.GetIPNet() == nil {
+			continue
+		}
+		ip := rApp.GetIPNet()
+		for _, name := range append([]string{app.GetName()}, rApp.GetAliases()...) {
+			if name == "" {
+				continue
+			}
+			containerHosts[name] = ip.IP
+			dnsServer.Add(name, ip, network.IPv6(ip))
+		}
+		bridge := bridgeIP(ip)
+		bridges[bridge.String()] = bridge
+	}
+
+	// Apps use DNS server running on the bridge by default, so it must be started there.
+	for _, bridge := range bridges {
+		if err := dnsServer.Listen(bridge); err != nil {
+			if errors.Is(err, syscall.EADDRINUSE) {
+				return errors.Errorf("DNS server can't be started on bridge %s, because address is in use, "+
+					"network can't be shared by many RunApps calls", bridge)
+			}
+			return err
+		}
 	}
 
 	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("dns", parallel.Fail, dnsServer.Run)
+
 		logsCh := make(chan logEnvelope)
 
 		spawn("apps", parallel.Exit, func(ctx context.Context) error {
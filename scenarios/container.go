@@ -10,6 +10,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/outofforest/isolator"
+	"github.com/outofforest/isolator/lib/docker"
 	"github.com/outofforest/isolator/lib/task"
 	"github.com/outofforest/isolator/network"
 	"github.com/outofforest/isolator/wire"
@@ -17,13 +18,19 @@ import (
 	"github.com/outofforest/parallel"
 )
 
-var _ Application = Container{}
+var _ ResolvableApplication = Container{}
+
+// layersDir is the directory of the layer store inside cache directory.
+const layersDir = "layers"
 
 // Container defines container.
 type Container struct {
 	// Name is the name of the container.
 	Name string
 
+	// Aliases are the additional names the container is resolved by inside other apps.
+	Aliases []string
+
 	// Image is the name of the image.
 	Image string
 
@@ -51,7 +58,8 @@ type Container struct {
 	// IP is the IP address of the container.
 	IP *net.IPNet
 
-	// DNS is the list of nameservers to configure inside container.
+	// DNS is the list of nameservers to configure inside container. If nil, DNS server started by RunApps on the
+	// bridge is used.
 	DNS []net.IP
 
 	// Hosts is the list of hosts and their IP addresses to resolve inside namespace.
@@ -59,6 +67,21 @@ type Container struct {
 
 	// ExposedPorts is the list of ports to expose.
 	ExposedPorts []ExposedPort
+
+	// Resources defines resource limits of the container.
+	Resources isolator.Resources
+
+	// ReadOnlyRoot makes root filesystem of the container read-only.
+	ReadOnlyRoot bool
+
+	// Rlimits is the list of resource limits set for the container.
+	Rlimits []wire.Rlimit
+
+	// Sysctls maps namespaced kernel parameters to their values set inside container.
+	Sysctls map[string]string
+
+	// Seccomp defines the seccomp filter of the container. If nil, the default profile is applied.
+	Seccomp *wire.Seccomp
 }
 
 // GetName returns the name of the container.
@@ -66,6 +89,11 @@ func (c Container) GetName() string {
 	return c.Name
 }
 
+// GetAliases returns aliases of the container.
+func (c Container) GetAliases() []string {
+	return c.Aliases
+}
+
 // GetIP returns IP of the container.
 func (c Container) GetIP() net.IP {
 	if c.IP == nil {
@@ -74,6 +102,11 @@ func (c Container) GetIP() net.IP {
 	return c.IP.IP
 }
 
+// GetIPNet returns IP of the container together with the mask of its network.
+func (c Container) GetIPNet() *net.IPNet {
+	return c.IP
+}
+
 // GetTaskFunc returns task function running the container.
 func (c Container) GetTaskFunc(config RunAppsConfig, appHosts map[string]net.IP, spawn parallel.SpawnFn,
 	logsCh chan<- logEnvelope) task.Func {
@@ -88,25 +121,54 @@ func (c Container) GetTaskFunc(config RunAppsConfig, appHosts map[string]net.IP,
 			return errors.WithStack(err)
 		}
 		appDir := filepath.Join(config.AppsDir, c.Name)
+		if err := os.Mkdir(appDir, 0o700); err != nil {
+			return errors.WithStack(err)
+		}
+		rootDir := filepath.Join(appDir, "root")
+		upperDir := filepath.Join(appDir, "upper")
+		workDir := filepath.Join(appDir, "work")
 		// 0o755 mode is essential here. Without this, container running as non-root user will
-		// fail with "permission denied"
-		if err := os.Mkdir(appDir, 0o755); err != nil {
+		// fail with "permission denied". Root of the overlay takes its mode from the upper directory.
+		for _, dir := range []string{rootDir, upperDir} {
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if err := os.Mkdir(workDir, 0o700); err != nil {
 			return errors.WithStack(err)
 		}
 
-		if err := c.inflate(ctx, config, appDir); err != nil {
+		if err := c.inflate(ctx, config, rootDir); err != nil {
+			return err
+		}
+
+		layers, err := docker.ImageLayers(config.CacheDir, c.Image, c.Tag)
+		if err != nil {
 			return err
 		}
+		// Top layer must go first.
+		lowerDirs := make([]string, 0, len(layers))
+		for i := len(layers) - 1; i >= 0; i-- {
+			lowerDirs = append(lowerDirs, docker.LayerDir(filepath.Join(config.CacheDir, layersDir), layers[i]))
+		}
+		root := wire.Mount{
+			Type:         wire.MountOverlay,
+			Writable:     true,
+			OverlayLower: lowerDirs,
+			OverlayUpper: upperDir,
+			OverlayWork:  workDir,
+		}
 
 		spawn(c.Name, parallel.Fail, func(ctx context.Context) error {
 			ctx = logger.With(ctx, zap.String("appName", c.Name), zap.Stringer("appIP", c.IP))
-			return c.run(ctx, config, appDir, appHosts, logsCh)
+			return c.run(ctx, config, rootDir, root, appHosts, logsCh)
 		})
 		return nil
 	}
 }
 
-func (c Container) inflate(ctx context.Context, config RunAppsConfig, appDir string) (retErr error) {
+// inflate extracts layers of the image to the layer store. Root directory is not modified.
+func (c Container) inflate(ctx context.Context, config RunAppsConfig, rootDir string) (retErr error) {
 	ctx = logger.With(ctx, zap.String("container", c.Name))
 	log := logger.Get(ctx)
 
@@ -123,11 +185,8 @@ func (c Container) inflate(ctx context.Context, config RunAppsConfig, appDir str
 		}
 	}()
 
-	return isolator.Run(ctx, isolator.Config{
-		Dir: appDir,
-		Types: []interface{}{
-			wire.Result{},
-		},
+	return isolator.RunSession(ctx, isolator.Config{
+		Dir: rootDir,
 		Executor: wire.Config{
 			IP:       network.Addr(inflateNetwork, 2),
 			Hostname: "inflate",
@@ -139,40 +198,26 @@ func (c Container) inflate(ctx context.Context, config RunAppsConfig, appDir str
 				},
 			},
 		},
-	}, func(ctx context.Context, incoming <-chan interface{}, outgoing chan<- interface{}) error {
+	}, nil, func(ctx context.Context, session *isolator.Session) error {
 		log := logger.Get(ctx)
 		log.Info("Inflating container's filesystem")
 
-		select {
-		case <-ctx.Done():
-			return errors.WithStack(ctx.Err())
-		case outgoing <- wire.InflateDockerImage{
-			CacheDir: "/.cache",
-			Image:    c.Image,
-			Tag:      c.Tag,
-		}:
-		}
-
-		for content := range incoming {
-			switch m := content.(type) {
-			// wire.Result means command finished
-			case wire.Result:
-				if m.Error != "" {
-					return errors.Errorf("inflating image failed: %s", m.Error)
-				}
-				log.Info("Container's filesystem inflated")
-				return errors.WithStack(ctx.Err())
-			default:
-				return errors.Errorf("unexpected message %T received", content)
-			}
+		if _, err := session.InflateImage(ctx, wire.InflateDockerImage{
+			CacheDir:  "/.cache",
+			Image:     c.Image,
+			Tag:       c.Tag,
+			LayersDir: filepath.Join("/.cache", layersDir),
+		}); err != nil {
+			return errors.Wrap(err, "inflating image failed")
 		}
 
-		return errors.WithStack(ctx.Err())
+		log.Info("Container's filesystem inflated")
+		return nil
 	})
 }
 
-func (c Container) run(ctx context.Context, config RunAppsConfig, appDir string, appHosts map[string]net.IP,
-	logsCh chan<- logEnvelope) error {
+func (c Container) run(ctx context.Context, config RunAppsConfig, rootDir string, root wire.Mount,
+	appHosts map[string]net.IP, logsCh chan<- logEnvelope) error {
 	hosts := map[string]net.IP{}
 	for h, ip := range c.Hosts {
 		hosts[h] = ip
@@ -182,17 +227,18 @@ func (c Container) run(ctx context.Context, config RunAppsConfig, appDir string,
 	}
 
 	runConfig := isolator.Config{
-		Dir: appDir,
-		Types: []interface{}{
-			wire.Log{},
-			wire.Result{},
-		},
+		Dir:       rootDir,
+		Resources: c.Resources,
 		Executor: wire.Config{
+			Root:            &root,
 			IP:              c.IP,
 			Hostname:        c.Name,
-			DNS:             c.DNS,
+			DNS:             appDNS(c.DNS, c.IP),
 			Hosts:           hosts,
 			ConfigureSystem: true,
+			ReadOnlyRoot:    c.ReadOnlyRoot,
+			Sysctls:         c.Sysctls,
+			Seccomp:         c.Seccomp,
 			Mounts: []wire.Mount{
 				{
 					Host:      config.CacheDir,
@@ -214,22 +260,21 @@ func (c Container) run(ctx context.Context, config RunAppsConfig, appDir string,
 	}
 
 	for _, m := range c.Mounts {
-		runConfig.Executor.Mounts = append(runConfig.Executor.Mounts, wire.Mount{
-			Host:      m.Host,
-			Namespace: m.Namespace,
-			Writable:  m.Writable,
-		})
+		runConfig.Executor.Mounts = append(runConfig.Executor.Mounts, m.toWire())
 	}
 
-	return isolator.Run(ctx, runConfig, func(ctx context.Context, incoming <-chan interface{},
-		outgoing chan<- interface{}) error {
-		log := logger.Get(ctx)
-		log.Info("Requesting docker container")
-
+	return isolator.RunSession(ctx, runConfig, func(ctx context.Context, log wire.Log) error {
 		select {
 		case <-ctx.Done():
 			return errors.WithStack(ctx.Err())
-		case outgoing <- wire.RunDockerContainer{
+		case logsCh <- logEnvelope{AppName: c.Name, Log: log}:
+			return nil
+		}
+	}, func(ctx context.Context, session *isolator.Session) error {
+		log := logger.Get(ctx)
+		log.Info("Requesting docker container")
+
+		_, err := session.RunContainer(ctx, wire.RunDockerContainer{
 			CacheDir:   "/.cache",
 			Name:       c.Name,
 			Image:      c.Image,
@@ -239,23 +284,15 @@ func (c Container) run(ctx context.Context, config RunAppsConfig, appDir string,
 			WorkingDir: c.WorkingDir,
 			Entrypoint: c.Entrypoint,
 			Args:       c.Args,
-		}:
-		}
-
-		for content := range incoming {
-			switch m := content.(type) {
-			// wire.Log contains message printed by executed command to stdout or stderr
-			case wire.Log:
-				logsCh <- logEnvelope{AppName: c.Name, Log: m}
-			// wire.Result means command finished
-			case wire.Result:
-				if m.Error != "" {
-					return errors.Errorf("container failed: %s", m.Error)
-				}
-				return errors.WithStack(ctx.Err())
-			default:
-				return errors.Errorf("unexpected message %T received", content)
+			Rlimits:    c.Rlimits,
+		})
+		if err != nil {
+			// OOM event is always delivered before the result of the killed process.
+			if session.OOMKills() > 0 {
+				log.Error("App OOM-killed")
+				return errors.Errorf("app %s OOM-killed", c.Name)
 			}
+			return errors.Wrap(err, "container failed")
 		}
 
 		return errors.WithStack(ctx.Err())
@@ -16,13 +16,16 @@ import (
 	"github.com/outofforest/parallel"
 )
 
-var _ Application = Embedded{}
+var _ ResolvableApplication = Embedded{}
 
 // Embedded defines embedded function to run inside isolation.
 type Embedded struct {
 	// Name is the name of the function.
 	Name string
 
+	// Aliases are the additional names the function is resolved by inside other apps.
+	Aliases []string
+
 	// Mounts are the mounts to configure inside embedded function.
 	Mounts []Mount
 
@@ -32,7 +35,8 @@ type Embedded struct {
 	// IP is the IP address of the embedded function.
 	IP *net.IPNet
 
-	// DNS is the list of nameservers to configure inside embedded function.
+	// DNS is the list of nameservers to configure inside embedded function. If nil, DNS server started by RunApps
+	// on the bridge is used.
 	DNS []net.IP
 
 	// Hosts is the list of hosts and their IP addresses to resolve inside namespace.
@@ -47,6 +51,11 @@ func (e Embedded) GetName() string {
 	return e.Name
 }
 
+// GetAliases returns aliases of the function.
+func (e Embedded) GetAliases() []string {
+	return e.Aliases
+}
+
 // GetIP returns IP of the function.
 func (e Embedded) GetIP() net.IP {
 	if e.IP == nil {
@@ -55,6 +64,11 @@ func (e Embedded) GetIP() net.IP {
 	return e.IP.IP
 }
 
+// GetIPNet returns IP of the function together with the mask of its network.
+func (e Embedded) GetIPNet() *net.IPNet {
+	return e.IP
+}
+
 // GetTaskFunc returns task function running the embedded function.
 func (e Embedded) GetTaskFunc(config RunAppsConfig, appHosts map[string]net.IP, spawn parallel.SpawnFn,
 	logsCh chan<- logEnvelope) task.Func {
@@ -87,14 +101,10 @@ func (e Embedded) run(ctx context.Context, appDir string, appHosts map[string]ne
 
 	runConfig := isolator.Config{
 		Dir: appDir,
-		Types: []interface{}{
-			wire.Log{},
-			wire.Result{},
-		},
 		Executor: wire.Config{
 			IP:              e.IP,
 			Hostname:        e.Name,
-			DNS:             e.DNS,
+			DNS:             appDNS(e.DNS, e.IP),
 			Hosts:           hosts,
 			ConfigureSystem: true,
 		},
@@ -111,41 +121,25 @@ func (e Embedded) run(ctx context.Context, appDir string, appHosts map[string]ne
 	}
 
 	for _, m := range e.Mounts {
-		runConfig.Executor.Mounts = append(runConfig.Executor.Mounts, wire.Mount{
-			Host:      m.Host,
-			Namespace: m.Namespace,
-			Writable:  m.Writable,
-		})
+		runConfig.Executor.Mounts = append(runConfig.Executor.Mounts, m.toWire())
 	}
 
-	return isolator.Run(ctx, runConfig, func(ctx context.Context, incoming <-chan interface{},
-		outgoing chan<- interface{}) error {
-		log := logger.Get(ctx)
-		log.Info("Requesting embedded function execution")
-
+	return isolator.RunSession(ctx, runConfig, func(ctx context.Context, log wire.Log) error {
 		select {
 		case <-ctx.Done():
 			return errors.WithStack(ctx.Err())
-		case outgoing <- wire.RunEmbeddedFunction{
-			Name: e.Name,
-			Args: e.Args,
-		}:
+		case logsCh <- logEnvelope{AppName: e.Name, Log: log}:
+			return nil
 		}
+	}, func(ctx context.Context, session *isolator.Session) error {
+		log := logger.Get(ctx)
+		log.Info("Requesting embedded function execution")
 
-		for content := range incoming {
-			switch m := content.(type) {
-			// wire.Log contains message printed by executed command to stdout or stderr
-			case wire.Log:
-				logsCh <- logEnvelope{AppName: e.Name, Log: m}
-			// wire.Result means command finished
-			case wire.Result:
-				if m.Error != "" {
-					return errors.Errorf("embedded failed: %s", m.Error)
-				}
-				return errors.WithStack(ctx.Err())
-			default:
-				return errors.Errorf("unexpected message %T received", content)
-			}
+		if _, err := session.RunEmbedded(ctx, wire.RunEmbeddedFunction{
+			Name: e.Name,
+			Args: e.Args,
+		}); err != nil {
+			return errors.Wrap(err, "embedded failed")
 		}
 
 		return errors.WithStack(ctx.Err())
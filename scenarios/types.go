@@ -1,12 +1,47 @@
 package scenarios
 
-import "net"
+import (
+	"net"
+	"os"
+
+	"github.com/outofforest/isolator/wire"
+)
 
 // Mount defines the mount to be configured inside container.
 type Mount struct {
-	Host      string
-	Namespace string
-	Writable  bool
+	Type         wire.MountType
+	Host         string
+	Namespace    string
+	Writable     bool
+	NoSuid       bool
+	NoDev        bool
+	NoExec       bool
+	Propagation  wire.Propagation
+	SkipMissing  bool
+	TmpfsSize    int64
+	TmpfsMode    os.FileMode
+	OverlayLower []string
+	OverlayUpper string
+	OverlayWork  string
+}
+
+func (m Mount) toWire() wire.Mount {
+	return wire.Mount{
+		Type:         m.Type,
+		Host:         m.Host,
+		Namespace:    m.Namespace,
+		Writable:     m.Writable,
+		NoSuid:       m.NoSuid,
+		NoDev:        m.NoDev,
+		NoExec:       m.NoExec,
+		Propagation:  m.Propagation,
+		SkipMissing:  m.SkipMissing,
+		TmpfsSize:    m.TmpfsSize,
+		TmpfsMode:    m.TmpfsMode,
+		OverlayLower: m.OverlayLower,
+		OverlayUpper: m.OverlayUpper,
+		OverlayWork:  m.OverlayWork,
+	}
 }
 
 // ExposedPort defines a port to be exposed from the container.
@@ -0,0 +1,275 @@
+package isolator
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/outofforest/isolator/wire"
+	"github.com/outofforest/parallel"
+)
+
+// LogFunc is called for every log message received from executor.
+type LogFunc func(ctx context.Context, log wire.Log) error
+
+// SessionFunc defines the client function using the session.
+type SessionFunc func(ctx context.Context, session *Session) error
+
+// LogWriter returns log function writing content of received logs to the writer, one log per line.
+func LogWriter(w io.Writer) LogFunc {
+	return func(ctx context.Context, log wire.Log) error {
+		_, err := w.Write(append(append([]byte{}, log.Content...), '\n'))
+		return errors.WithStack(err)
+	}
+}
+
+// RunSession runs executor server and provides the session to the client function.
+// Session must not be used after client function returns.
+func RunSession(ctx context.Context, config Config, logFunc LogFunc, sessionFunc SessionFunc) error {
+	config.Types = append(append([]interface{}{}, config.Types...), wire.Log{}, wire.Result{}, wire.TerminalOutput{})
+
+	return Run(ctx, config, func(ctx context.Context, incoming <-chan interface{}, outgoing chan<- interface{}) error {
+		session := newSession(outgoing, logFunc)
+
+		return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+			spawn("dispatcher", parallel.Fail, func(ctx context.Context) error {
+				return session.dispatch(ctx, incoming)
+			})
+			spawn("session", parallel.Exit, func(ctx context.Context) error {
+				return sessionFunc(ctx, session)
+			})
+
+			return nil
+		})
+	})
+}
+
+func newSession(outgoing chan<- interface{}, logFunc LogFunc) *Session {
+	return &Session{
+		outgoing: outgoing,
+		logFunc:  logFunc,
+		results:  map[uint64]chan wire.Result{},
+		outputs:  map[uint64]io.Writer{},
+		statsCh:  make(chan wire.Stats, 1),
+	}
+}
+
+// Session provides typed API for sending requests to executor and receiving their results.
+type Session struct {
+	outgoing chan<- interface{}
+	logFunc  LogFunc
+	statsCh  chan wire.Stats
+	oomKills atomic.Uint64
+
+	mu      sync.Mutex
+	lastID  uint64
+	results map[uint64]chan wire.Result
+	outputs map[uint64]io.Writer
+}
+
+// Stats returns channel receiving the most recent resource usage stats. Stats are sent only if StatsInterval is set
+// in the config. Stats which are not consumed on time are replaced by newer ones.
+func (s *Session) Stats() <-chan wire.Stats {
+	return s.statsCh
+}
+
+// OOMKills returns the number of processes killed by OOM killer inside the environment so far. Processes are
+// counted only if environment runs inside cgroup, e.g. if resource limits are set. Killed process is counted before
+// its result is returned.
+func (s *Session) OOMKills() uint64 {
+	return s.oomKills.Load()
+}
+
+// Exec executes the command and waits for its result.
+func (s *Session) Exec(ctx context.Context, cmd wire.Execute) (wire.Result, error) {
+	return s.Do(ctx, cmd)
+}
+
+// RunEmbedded runs the embedded function and waits for its result.
+func (s *Session) RunEmbedded(ctx context.Context, fn wire.RunEmbeddedFunction) (wire.Result, error) {
+	return s.Do(ctx, fn)
+}
+
+// InflateImage inflates the docker image and waits for the result.
+func (s *Session) InflateImage(ctx context.Context, image wire.InflateDockerImage) (wire.Result, error) {
+	return s.Do(ctx, image)
+}
+
+// RunContainer runs the docker container and waits for its result.
+func (s *Session) RunContainer(ctx context.Context, container wire.RunDockerContainer) (wire.Result, error) {
+	return s.Do(ctx, container)
+}
+
+// StartTerminal starts the command attached to the pseudo-terminal. Data printed to the terminal are written to
+// the output. Input is sent using Stdin method of the returned command.
+func (s *Session) StartTerminal(ctx context.Context, cmd wire.ExecuteTerminal, output io.Writer) (*Command, error) {
+	return s.start(ctx, cmd, output)
+}
+
+// Do sends the request to executor and waits for its result. Error is returned if request failed.
+func (s *Session) Do(ctx context.Context, content interface{}) (wire.Result, error) {
+	cmd, err := s.Start(ctx, content)
+	if err != nil {
+		return wire.Result{}, err
+	}
+	return cmd.Wait(ctx)
+}
+
+// Start sends the request to executor without waiting for its result.
+func (s *Session) Start(ctx context.Context, content interface{}) (*Command, error) {
+	return s.start(ctx, content, nil)
+}
+
+func (s *Session) start(ctx context.Context, content interface{}, output io.Writer) (*Command, error) {
+	s.mu.Lock()
+	s.lastID++
+	id := s.lastID
+	resultCh := make(chan wire.Result, 1)
+	s.results[id] = resultCh
+	if output != nil {
+		s.outputs[id] = output
+	}
+	s.mu.Unlock()
+
+	content = wire.SetID(content, id)
+	if wire.ContentToID(content) != id {
+		s.forget(id)
+		return nil, errors.Errorf("content %T does not carry request ID", content)
+	}
+
+	if err := s.send(ctx, content); err != nil {
+		s.forget(id)
+		return nil, err
+	}
+
+	return &Command{
+		id:       id,
+		session:  s,
+		resultCh: resultCh,
+	}, nil
+}
+
+func (s *Session) send(ctx context.Context, content interface{}) error {
+	select {
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	case s.outgoing <- content:
+		return nil
+	}
+}
+
+func (s *Session) forget(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.results, id)
+	delete(s.outputs, id)
+}
+
+func (s *Session) dispatch(ctx context.Context, incoming <-chan interface{}) error {
+	for content := range incoming {
+		switch m := content.(type) {
+		// wire.Log contains message printed by executed command to stdout or stderr
+		case wire.Log:
+			if s.logFunc == nil {
+				continue
+			}
+			if err := s.logFunc(ctx, m); err != nil {
+				return err
+			}
+		// wire.Stats contains resource usage of the environment
+		case wire.Stats:
+			// Dispatcher is the only sender, so after dropping outdated stats there is always a room for new ones.
+			select {
+			case <-s.statsCh:
+			default:
+			}
+			s.statsCh <- m
+		// wire.OOMEvent means that processes in the environment were killed by OOM killer
+		case wire.OOMEvent:
+			s.oomKills.Add(m.Kills)
+		// wire.TerminalOutput contains data printed by command to the terminal
+		case wire.TerminalOutput:
+			s.mu.Lock()
+			output := s.outputs[m.ID]
+			s.mu.Unlock()
+
+			if output == nil {
+				return errors.Errorf("terminal output for unknown request %d received", m.ID)
+			}
+			if _, err := output.Write(m.Data); err != nil {
+				return errors.WithStack(err)
+			}
+		// wire.Result means command finished
+		case wire.Result:
+			s.mu.Lock()
+			resultCh, exists := s.results[m.ID]
+			delete(s.results, m.ID)
+			delete(s.outputs, m.ID)
+			s.mu.Unlock()
+
+			if !exists {
+				return errors.Errorf("result for unknown request %d received", m.ID)
+			}
+			resultCh <- m
+		default:
+			return errors.Errorf("unexpected message %T received", content)
+		}
+	}
+
+	return errors.WithStack(ctx.Err())
+}
+
+// Command represents the request running inside executor.
+type Command struct {
+	id       uint64
+	session  *Session
+	resultCh <-chan wire.Result
+}
+
+// ID returns the ID of the request.
+func (c *Command) ID() uint64 {
+	return c.id
+}
+
+// Stdin sends data to the standard input of the command.
+func (c *Command) Stdin(ctx context.Context, data []byte) error {
+	return c.session.send(ctx, wire.Stdin{ID: c.id, Data: data})
+}
+
+// CloseStdin closes the standard input of the command.
+func (c *Command) CloseStdin(ctx context.Context) error {
+	return c.session.send(ctx, wire.StdinClose{ID: c.id})
+}
+
+// Signal delivers the signal to the main process of the command.
+func (c *Command) Signal(ctx context.Context, sig syscall.Signal) error {
+	return c.session.send(ctx, wire.Signal{ID: c.id, Signal: sig})
+}
+
+// SignalGroup delivers the signal to all the processes in the process group of the command.
+func (c *Command) SignalGroup(ctx context.Context, sig syscall.Signal) error {
+	return c.session.send(ctx, wire.Signal{ID: c.id, Signal: sig, Group: true})
+}
+
+// Resize changes the size of the terminal attached to the command.
+func (c *Command) Resize(ctx context.Context, rows, cols uint16) error {
+	return c.session.send(ctx, wire.TerminalResize{ID: c.id, Rows: rows, Cols: cols})
+}
+
+// Wait waits for the result of the command. Error is returned if command failed.
+func (c *Command) Wait(ctx context.Context) (wire.Result, error) {
+	select {
+	case <-ctx.Done():
+		return wire.Result{}, errors.WithStack(ctx.Err())
+	case result := <-c.resultCh:
+		if result.Error != "" {
+			return result, errors.New(result.Error)
+		}
+		return result, nil
+	}
+}
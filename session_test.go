@@ -0,0 +1,226 @@
+package isolator
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/outofforest/isolator/lib/test"
+	"github.com/outofforest/isolator/wire"
+)
+
+// testSession runs the dispatcher of the session, messages sent by executor are delivered to incoming channel and
+// the ones sent by session are collected by outgoing one.
+type testSession struct {
+	*Session
+
+	incoming chan interface{}
+	outgoing chan interface{}
+	errCh    chan error
+}
+
+func newTestSession(t *testing.T, logFunc LogFunc) *testSession {
+	s := &testSession{
+		incoming: make(chan interface{}),
+		outgoing: make(chan interface{}, 100),
+		errCh:    make(chan error, 1),
+	}
+	s.Session = newSession(s.outgoing, logFunc)
+
+	ctx := test.Context(t)
+	go func() {
+		s.errCh <- s.dispatch(ctx, s.incoming)
+	}()
+	return s
+}
+
+func (s *testSession) receive(t *testing.T) interface{} {
+	select {
+	case content := <-s.outgoing:
+		return content
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for message")
+		return nil
+	}
+}
+
+func TestSessionDo(t *testing.T) {
+	process := &wire.ProcessState{ExitCode: 3}
+
+	tests := []struct {
+		Name   string
+		Result wire.Result
+		Error  string
+	}{
+		{Name: "success", Result: wire.Result{ID: 1, Process: &wire.ProcessState{}}},
+		{Name: "failure", Result: wire.Result{ID: 1, Error: "process exited with status 3", Process: process},
+			Error: "process exited with status 3"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			s := newTestSession(t, nil)
+
+			resultCh := make(chan wire.Result, 1)
+			errCh := make(chan error, 1)
+			go func() {
+				result, err := s.Exec(context.Background(), wire.Execute{Command: "ls"})
+				resultCh <- result
+				errCh <- err
+			}()
+
+			assert.Equal(t, wire.Execute{ID: 1, Command: "ls"}, s.receive(t))
+			s.incoming <- test.Result
+
+			// Result is returned even if request failed, so exit code of the process may be inspected.
+			assert.Equal(t, test.Result, <-resultCh)
+			if test.Error == "" {
+				require.NoError(t, <-errCh)
+			} else {
+				require.EqualError(t, <-errCh, test.Error)
+			}
+		})
+	}
+}
+
+func TestSessionConcurrentRequests(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSession(t, nil)
+
+	cmd1, err := s.Start(ctx, wire.Execute{Command: "first"})
+	require.NoError(t, err)
+	cmd2, err := s.Start(ctx, wire.RunEmbeddedFunction{Name: "second"})
+	require.NoError(t, err)
+
+	assert.Equal(t, wire.Execute{ID: 1, Command: "first"}, s.receive(t))
+	assert.Equal(t, wire.RunEmbeddedFunction{ID: 2, Name: "second"}, s.receive(t))
+
+	// Results are delivered to the requests they belong to, regardless of their order.
+	s.incoming <- wire.Result{ID: 2, Error: "failed"}
+	s.incoming <- wire.Result{ID: 1}
+
+	result, err := cmd1.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, wire.Result{ID: 1}, result)
+
+	result, err = cmd2.Wait(ctx)
+	require.EqualError(t, err, "failed")
+	assert.Equal(t, wire.Result{ID: 2, Error: "failed"}, result)
+}
+
+func TestSessionCommandMessages(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSession(t, nil)
+
+	output := &bytes.Buffer{}
+	cmd, err := s.StartTerminal(ctx, wire.ExecuteTerminal{Command: "sh"}, output)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), cmd.ID())
+	assert.Equal(t, wire.ExecuteTerminal{ID: 1, Command: "sh"}, s.receive(t))
+
+	require.NoError(t, cmd.Stdin(ctx, []byte("ls\n")))
+	require.NoError(t, cmd.Resize(ctx, 24, 80))
+	require.NoError(t, cmd.Signal(ctx, syscall.SIGINT))
+	require.NoError(t, cmd.SignalGroup(ctx, syscall.SIGTERM))
+	require.NoError(t, cmd.CloseStdin(ctx))
+
+	for _, expected := range []interface{}{
+		wire.Stdin{ID: 1, Data: []byte("ls\n")},
+		wire.TerminalResize{ID: 1, Rows: 24, Cols: 80},
+		wire.Signal{ID: 1, Signal: syscall.SIGINT},
+		wire.Signal{ID: 1, Signal: syscall.SIGTERM, Group: true},
+		wire.StdinClose{ID: 1},
+	} {
+		assert.Equal(t, expected, s.receive(t))
+	}
+
+	s.incoming <- wire.TerminalOutput{ID: 1, Data: []byte("file\n")}
+	s.incoming <- wire.Result{ID: 1}
+
+	_, err = cmd.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "file\n", output.String())
+}
+
+func TestSessionStartContentWithoutID(t *testing.T) {
+	s := newTestSession(t, nil)
+
+	_, err := s.Start(context.Background(), wire.Config{})
+	require.Error(t, err)
+	assert.Empty(t, s.results)
+	assert.Empty(t, s.outgoing)
+}
+
+func TestSessionStartCanceled(t *testing.T) {
+	// Nothing receives the request, so it may be sent only if context is not canceled.
+	s := newSession(make(chan interface{}), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := s.Start(ctx, wire.Execute{})
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, s.results)
+}
+
+func TestSessionEvents(t *testing.T) {
+	var logs []wire.Log
+	s := newTestSession(t, func(ctx context.Context, log wire.Log) error {
+		logs = append(logs, log)
+		return nil
+	})
+
+	s.incoming <- wire.Log{ID: 1, Content: []byte("log")}
+	s.incoming <- wire.OOMEvent{Kills: 2}
+	s.incoming <- wire.OOMEvent{Kills: 1}
+	s.incoming <- wire.Stats{Pids: 1}
+	// Stats not consumed on time are replaced.
+	s.incoming <- wire.Stats{Pids: 2}
+	close(s.incoming)
+
+	require.NoError(t, <-s.errCh)
+	assert.Equal(t, []wire.Log{{ID: 1, Content: []byte("log")}}, logs)
+	assert.Equal(t, uint64(3), s.OOMKills())
+	assert.Equal(t, wire.Stats{Pids: 2}, <-s.Stats())
+}
+
+func TestSessionDispatchInvalid(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Content interface{}
+	}{
+		{Name: "unknownResult", Content: wire.Result{ID: 1}},
+		{Name: "unknownTerminalOutput", Content: wire.TerminalOutput{ID: 1}},
+		{Name: "unexpectedMessage", Content: wire.Execute{ID: 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			s := newTestSession(t, nil)
+			s.incoming <- test.Content
+			require.Error(t, <-s.errCh)
+		})
+	}
+}
+
+func TestSessionDuplicatedResult(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSession(t, nil)
+
+	cmd, err := s.Start(ctx, wire.Execute{})
+	require.NoError(t, err)
+	assert.Equal(t, wire.Execute{ID: 1}, s.receive(t))
+
+	s.incoming <- wire.Result{ID: 1}
+	_, err = cmd.Wait(ctx)
+	require.NoError(t, err)
+
+	// Request is forgotten once its result is received.
+	s.incoming <- wire.Result{ID: 1}
+	require.Error(t, <-s.errCh)
+}
@@ -4,23 +4,98 @@ import (
 	"encoding/json"
 	"io"
 	"net"
+	"os"
 	"reflect"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
+// MountType is the type of mount.
+type MountType string
+
+// Supported mount types.
+const (
+	MountBind    MountType = "bind"
+	MountRBind   MountType = "rbind"
+	MountTmpfs   MountType = "tmpfs"
+	MountOverlay MountType = "overlay"
+	MountProc    MountType = "proc"
+	MountSysfs   MountType = "sysfs"
+	MountMqueue  MountType = "mqueue"
+)
+
+// Propagation is the propagation mode of mount.
+type Propagation string
+
+// Supported propagation modes.
+const (
+	PropagationPrivate  Propagation = "private"
+	PropagationRPrivate Propagation = "rprivate"
+	PropagationSlave    Propagation = "slave"
+	PropagationRSlave   Propagation = "rslave"
+	PropagationShared   Propagation = "shared"
+	PropagationRShared  Propagation = "rshared"
+)
+
 // Mount defines directories to mount inside container.
 type Mount struct {
-	// Host is the location on host.
+	// Type is the type of mount. If empty, host location is bound.
+	Type MountType
+
+	// Host is the location on host. It is used by bind mounts only.
 	Host string
 
 	// Namespace is the mountpoint inside namespace.
 	Namespace string
 
-	// Writable makes mount writable inside container.
+	// Writable makes bind and overlay mounts writable inside container, they are read-only by default.
 	Writable bool
+
+	// ReadOnly makes tmpfs, proc, sysfs and mqueue mounts read-only, they are writable by default.
+	ReadOnly bool
+
+	// NoSuid, NoDev and NoExec set nosuid, nodev and noexec flags of the mount.
+	NoSuid bool
+	NoDev  bool
+	NoExec bool
+
+	// Propagation is the propagation mode of the mount. If empty, mount is private.
+	Propagation Propagation
+
+	// SkipMissing skips bind mount if host location does not exist, instead of failing.
+	SkipMissing bool
+
+	// TmpfsSize is the size limit of tmpfs in bytes. Zero means default limit set by kernel.
+	TmpfsSize int64
+
+	// TmpfsMode is the permission mode of tmpfs root directory. Zero means default mode.
+	TmpfsMode os.FileMode
+
+	// OverlayLower is the list of lower directories of overlay, the top one goes first.
+	OverlayLower []string
+
+	// OverlayUpper is the upper directory of overlay. If empty, overlay is read-only.
+	OverlayUpper string
+
+	// OverlayWork is the work directory of overlay, required if upper directory is set.
+	OverlayWork string
+}
+
+// HostDevice defines host device bound inside namespace.
+type HostDevice struct {
+	// Host is the path of the device on host, e.g. /dev/fuse.
+	Host string
+
+	// Namespace is the path of the device inside namespace. If empty, host path is used.
+	Namespace string
+
+	// Permissions is the combination of r (read), w (write) and m (mknod) granted to the device. If empty, rw is
+	// granted. Permissions are enforced by the device filter attached to the cgroup of environment, so root
+	// privileges on host are required.
+	Permissions string
 }
 
 // Config stores configuration of executor.
@@ -44,18 +119,173 @@ type Config struct {
 	// Hosts is the list of hosts and their IP addresses to resolve inside namespace.
 	Hosts map[string]net.IP
 
+	// Devices is the list of standard devices created in /dev if ConfigureSystem is set, e.g. null, shm or pts.
+	// If nil, the default set is created.
+	Devices []string
+
+	// ShmSize is the size limit of /dev/shm in bytes. Zero means 64MB.
+	ShmSize int64
+
+	// HostDevices is the list of host devices bound inside namespace if ConfigureSystem is set.
+	HostDevices []HostDevice
+
+	// MountSysfs mounts read-only sysfs at /sys if ConfigureSystem is set. If host network is used, sysfs of host
+	// is bound, otherwise the one of the network namespace is mounted.
+	MountSysfs bool
+
+	// MountCgroup mounts read-only cgroup2 filesystem of the cgroup namespace at /sys/fs/cgroup if ConfigureSystem
+	// is set.
+	MountCgroup bool
+
+	// MountMqueue mounts mqueue filesystem at /dev/mqueue if ConfigureSystem is set.
+	MountMqueue bool
+
+	// Root is the mount used as the root filesystem, e.g. overlay of image layers. Its namespace path is ignored.
+	// If nil, directory of the environment is used.
+	Root *Mount
+
 	// Mounts is the list of bindings to apply inside container.
 	Mounts []Mount
+
+	// ReadOnlyRoot remounts the root filesystem read-only after mounts are applied, so the only writable places
+	// are the declared mounts.
+	ReadOnlyRoot bool
+
+	// MaskedPaths is the list of paths hidden inside namespace. If nil, the paths masked by OCI runtimes are used.
+	MaskedPaths []string
+
+	// ReadOnlyPaths is the list of paths made read-only inside namespace. If nil, the paths made read-only by OCI
+	// runtimes are used.
+	ReadOnlyPaths []string
+
+	// Sysctls maps kernel parameters to their values set inside namespace, e.g. net.core.somaxconn. Only parameters
+	// isolated by namespaces are accepted.
+	Sysctls map[string]string
+
+	// StopSignal is the signal which makes executor exit gracefully, in addition to SIGTERM and SIGINT.
+	StopSignal syscall.Signal
+
+	// Seccomp defines the seccomp filter installed before commands are executed. If nil, the default profile is applied.
+	Seccomp *Seccomp
+
+	// Capabilities is the set of capabilities granted to the executed commands, e.g. CAP_CHOWN. If nil, the default
+	// set similar to the one used by Docker is granted.
+	Capabilities []string
+
+	// AllowNewPrivileges allows commands to gain privileges using setuid binaries and file capabilities.
+	// By default, PR_SET_NO_NEW_PRIVS is set for executed commands.
+	AllowNewPrivileges bool
+}
+
+// Seccomp defines the seccomp filter.
+type Seccomp struct {
+	// Unconfined disables filtering of syscalls.
+	Unconfined bool
+
+	// Profile is the seccomp profile in Docker or OCI JSON format. If empty, the default profile denying dangerous
+	// syscalls, similar to the one used by Docker, is applied.
+	Profile json.RawMessage
 }
 
 // Execute is sent to execute a shell command.
 type Execute struct {
-	// Command is a command to execute
+	// ID is the ID of the request.
+	ID uint64 `json:"-"`
+
+	// Command is a command to execute using /bin/sh. It is ignored if Args is set.
 	Command string
+
+	// Args is the command to execute without shell. The first item is the path or name of the executable.
+	// Relative paths are resolved against WorkingDir.
+	Args []string
+
+	// Env sets environment variables of the command, in addition to the environment of the executor.
+	// If User, Group or Groups is set, HOME defaults to the home directory of the user.
+	Env map[string]string
+
+	// WorkingDir is the path to working directory of the command.
+	WorkingDir string
+
+	// User is the name or UID to run the command as. Names are resolved using /etc/passwd of the container.
+	// If empty, command runs as root.
+	User string
+
+	// Group is the name or GID to run the command as. If empty, primary group of the user is used.
+	Group string
+
+	// Groups is the list of supplementary group names or GIDs of the command. If Group is empty, groups listing
+	// the user as a member in /etc/group are added too.
+	Groups []string
+
+	// Rlimits is the list of resource limits set for the command.
+	Rlimits []Rlimit
+
+	// Stdin opens standard input of the command to be streamed using Stdin messages.
+	Stdin bool
+
+	// Capabilities is the set of capabilities granted to the command. It must be a subset of capabilities granted
+	// to the environment. If nil, all the capabilities of the environment are granted.
+	Capabilities []string
+}
+
+// Rlimit defines the resource limit of the process.
+type Rlimit struct {
+	// Type is the name of the resource, e.g. RLIMIT_NOFILE. Name is case-insensitive, RLIMIT_ prefix is optional.
+	Type string
+
+	// Soft is the soft limit of the resource. math.MaxUint64 means unlimited.
+	Soft uint64
+
+	// Hard is the hard limit of the resource. math.MaxUint64 means unlimited. It can't exceed the hard limit of
+	// the executor.
+	Hard uint64
+}
+
+// ExecuteTerminal is sent to execute a shell command attached to the pseudo-terminal.
+// Input of the terminal is streamed using Stdin messages.
+type ExecuteTerminal struct {
+	// ID is the ID of the request.
+	ID uint64 `json:"-"`
+
+	// Command is a command to execute.
+	Command string
+
+	// Term is the value of TERM environment variable set for the command.
+	Term string
+
+	// Rows is the initial number of rows of the terminal window.
+	Rows uint16
+
+	// Cols is the initial number of columns of the terminal window.
+	Cols uint16
+}
+
+// TerminalOutput contains raw bytes printed by the command to the pseudo-terminal.
+type TerminalOutput struct {
+	// ID is the ID of the request running the command.
+	ID uint64 `json:"-"`
+
+	// Data is the chunk of printed data.
+	Data []byte
+}
+
+// TerminalResize changes the size of the terminal window.
+type TerminalResize struct {
+	// ID is the ID of the request running the command.
+	ID uint64 `json:"-"`
+
+	// Rows is the number of rows of the terminal window.
+	Rows uint16
+
+	// Cols is the number of columns of the terminal window.
+	Cols uint16
 }
 
 // InflateDockerImage initializes filesystem by downloading and inflating docker image.
 type InflateDockerImage struct {
+	// ID is the ID of the request.
+	ID uint64 `json:"-"`
+
 	// Path were cached downloads are stored.
 	CacheDir string
 
@@ -64,10 +294,18 @@ type InflateDockerImage struct {
 
 	// Tag is the tag of the image.
 	Tag string
+
+	// LayersDir is the directory of the layer store. If set, each layer is extracted once to its own
+	// content-addressed directory, to be used as a lower directory of overlay, instead of inflating the image
+	// in the root filesystem.
+	LayersDir string
 }
 
 // RunDockerContainer runs docker container.
 type RunDockerContainer struct {
+	// ID is the ID of the request.
+	ID uint64 `json:"-"`
+
 	// Path were cached downloads are stored.
 	CacheDir string
 
@@ -94,10 +332,31 @@ type RunDockerContainer struct {
 
 	// Args is a list of arguments for the container.
 	Args []string
+
+	// Rlimits is the list of resource limits set for the container.
+	Rlimits []Rlimit
+
+	// Stdin opens standard input of the container to be streamed using Stdin messages.
+	Stdin bool
+
+	// Capabilities is the set of capabilities granted to the container. It must be a subset of capabilities granted
+	// to the environment. If nil, all the capabilities of the environment are granted.
+	Capabilities []string
+
+	// StopSignal is the name or number of the signal sent to the container when request is canceled.
+	// If empty, signal defined by the image is used, SIGTERM otherwise.
+	StopSignal string
+
+	// StopTimeout is the time given to the container to exit after receiving the stop signal. Once it passes,
+	// container is killed. If zero, default timeout of executor is used.
+	StopTimeout time.Duration
 }
 
 // RunEmbeddedFunction runs embedded function.
 type RunEmbeddedFunction struct {
+	// ID is the ID of the request.
+	ID uint64 `json:"-"`
+
 	// Name is the name of the embedded function.
 	Name string
 
@@ -105,14 +364,121 @@ type RunEmbeddedFunction struct {
 	Args []string
 }
 
+// Stdin sends chunk of data to the standard input of running command.
+type Stdin struct {
+	// ID is the ID of the request running the command.
+	ID uint64 `json:"-"`
+
+	// Data is the chunk of data to write.
+	Data []byte
+}
+
+// StdinClose closes the standard input of running command.
+type StdinClose struct {
+	// ID is the ID of the request running the command.
+	ID uint64 `json:"-"`
+}
+
+// Signal delivers the signal to the process started by the running command.
+type Signal struct {
+	// ID is the ID of the request running the command.
+	ID uint64 `json:"-"`
+
+	// Signal is the signal to deliver.
+	Signal syscall.Signal
+
+	// Group delivers the signal to the whole process group instead of the main process only.
+	Group bool
+}
+
 // Result is sent once command finishes.
 type Result struct {
+	// ID is the ID of the request which finished.
+	ID uint64 `json:"-"`
+
 	// Error is the error returned by command.
 	Error string
+
+	// Process is the state of the process started by the command, nil if no process was started.
+	Process *ProcessState
+}
+
+// ProcessState describes the process which exited.
+type ProcessState struct {
+	// ExitCode is the exit code of the process, -1 if process was terminated by a signal.
+	ExitCode int
+
+	// Signal is the signal which terminated the process.
+	Signal syscall.Signal
+
+	// CoreDumped is true if process dumped core.
+	CoreDumped bool
+
+	// StartTime is the time when process was started.
+	StartTime time.Time
+
+	// EndTime is the time when process exited.
+	EndTime time.Time
+
+	// UserTime is the CPU time spent in user mode.
+	UserTime time.Duration
+
+	// SystemTime is the CPU time spent in kernel mode.
+	SystemTime time.Duration
+
+	// MaxRSS is the maximum resident set size in bytes.
+	MaxRSS int64
+}
+
+// OOMEvent is sent when OOM killer kills processes inside the isolated environment because memory limit was
+// exceeded. Killed process might be the one started by any request or its descendant. Event is delivered before
+// the result of the killed process.
+type OOMEvent struct {
+	// Time is the time when event was detected.
+	Time time.Time
+
+	// Kills is the number of processes killed since the previous event.
+	Kills uint64
+}
+
+// Stats reports resource usage of the isolated environment. It is sent periodically if enabled.
+type Stats struct {
+	// Time is the time when stats were collected.
+	Time time.Time
+
+	// CPUUsage is the total CPU time consumed.
+	CPUUsage time.Duration
+
+	// CPUUser is the CPU time consumed in user mode.
+	CPUUser time.Duration
+
+	// CPUSystem is the CPU time consumed in kernel mode.
+	CPUSystem time.Duration
+
+	// MemoryCurrent is the current memory usage in bytes.
+	MemoryCurrent int64
+
+	// MemoryPeak is the maximum memory usage in bytes.
+	MemoryPeak int64
+
+	// Pids is the number of running processes.
+	Pids int64
+
+	// IOReadBytes is the number of bytes read from block devices.
+	IOReadBytes uint64
+
+	// IOWriteBytes is the number of bytes written to block devices.
+	IOWriteBytes uint64
+
+	// OOMKills is the number of processes killed by OOM killer so far.
+	OOMKills uint64
 }
 
 // Log is the log message printed by executed command.
 type Log struct {
+	// ID is the ID of the request which produced the log.
+	ID uint64 `json:"-"`
+
 	// Time is the time when log was produced.
 	Time time.Time
 
@@ -120,7 +486,12 @@ type Log struct {
 	Content []byte
 }
 
+// message is the envelope of content transmitted between client and executor. Requests are correlated with their
+// outputs and results by ID. Executor rejects the request if another one with the same ID is running, so clients using
+// the protocol directly must assign distinct IDs to concurrent requests. Zero ID is fine if requests are sent one by
+// one.
 type message struct {
+	ID      uint64 `json:",omitempty"`
 	Type    string
 	Payload json.RawMessage
 }
@@ -142,6 +513,7 @@ func NewEncoder(w io.Writer) EncoderFunc {
 		defer mu.Unlock()
 
 		return errors.WithStack(encoder.Encode(message{
+			ID:      ContentToID(content),
 			Type:    ContentToType(content),
 			Payload: contentRaw,
 		}))
@@ -173,16 +545,60 @@ func NewDecoder(r io.Reader, types []interface{}) DecoderFunc {
 			return nil, errors.WithStack(err)
 		}
 
+		if idField := findIDField(value.Elem()); idField.IsValid() {
+			idField.SetUint(msg.ID)
+		}
+
 		return value.Elem().Interface(), nil
 	}
 }
 
+// WithID returns encoder setting the request ID on encoded content.
+func WithID(encode EncoderFunc, id uint64) EncoderFunc {
+	return func(content interface{}) error {
+		return encode(SetID(content, id))
+	}
+}
+
+// ContentToID returns the request ID carried by the content. Zero is returned if content does not carry the ID.
+func ContentToID(content interface{}) uint64 {
+	idField := findIDField(reflect.ValueOf(content))
+	if !idField.IsValid() {
+		return 0
+	}
+	return idField.Uint()
+}
+
+// SetID returns copy of the content with request ID set. Content is returned unchanged if it does not carry the ID.
+func SetID(content interface{}, id uint64) interface{} {
+	value := reflect.New(reflect.TypeOf(content)).Elem()
+	value.Set(reflect.ValueOf(content))
+
+	idField := findIDField(value)
+	if !idField.IsValid() {
+		return content
+	}
+	idField.SetUint(id)
+	return value.Interface()
+}
+
 // ContentToType returns string representation for type of the content.
 func ContentToType(content interface{}) string {
 	t := reflect.TypeOf(content)
 	return t.PkgPath() + "/" + t.Name()
 }
 
+func findIDField(value reflect.Value) reflect.Value {
+	if value.Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	idField := value.FieldByName("ID")
+	if !idField.IsValid() || idField.Kind() != reflect.Uint64 {
+		return reflect.Value{}
+	}
+	return idField
+}
+
 func typesToMap(types []interface{}) map[string]interface{} {
 	res := map[string]interface{}{}
 	for _, t := range types {
@@ -0,0 +1,84 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentToID(t *testing.T) {
+	assert.Equal(t, uint64(5), ContentToID(Execute{ID: 5}))
+	assert.Equal(t, uint64(0), ContentToID(Execute{}))
+	assert.Equal(t, uint64(0), ContentToID(Config{}))
+	assert.Equal(t, uint64(0), ContentToID(&Execute{ID: 5}))
+	assert.Equal(t, uint64(0), ContentToID("string"))
+}
+
+func TestSetID(t *testing.T) {
+	original := Execute{Command: "ls"}
+	content := SetID(original, 7)
+
+	assert.Equal(t, Execute{ID: 7, Command: "ls"}, content)
+	assert.Equal(t, uint64(0), original.ID)
+
+	config := Config{Hostname: "host"}
+	assert.Equal(t, config, SetID(config, 7))
+}
+
+func TestWithID(t *testing.T) {
+	var encoded []interface{}
+	encode := WithID(func(content interface{}) error {
+		encoded = append(encoded, content)
+		return nil
+	}, 3)
+
+	require.NoError(t, encode(Result{Error: "error"}))
+	require.NoError(t, encode(Log{ID: 9}))
+	require.NoError(t, encode(Config{}))
+
+	assert.Equal(t, []interface{}{
+		Result{ID: 3, Error: "error"},
+		Log{ID: 3},
+		Config{},
+	}, encoded)
+}
+
+func TestEncodeDecode(t *testing.T) {
+	buf := &bytes.Buffer{}
+	encode := NewEncoder(buf)
+
+	require.NoError(t, encode(Execute{ID: 11, Command: "ls"}))
+	require.NoError(t, encode(Stdin{Data: []byte("data")}))
+	require.NoError(t, encode(Config{Hostname: "host"}))
+
+	// ID is carried by the envelope, not by the payload.
+	line, err := buf.ReadString('\n')
+	require.NoError(t, err)
+	var msg message
+	require.NoError(t, json.Unmarshal([]byte(line), &msg))
+	assert.Equal(t, uint64(11), msg.ID)
+	assert.NotContains(t, string(msg.Payload), "11")
+
+	decode := NewDecoder(strings.NewReader(line+buf.String()), []interface{}{Execute{}, Stdin{}, Config{}})
+	for _, expected := range []interface{}{
+		Execute{ID: 11, Command: "ls"},
+		Stdin{Data: []byte("data")},
+		Config{Hostname: "host"},
+	} {
+		content, err := decode()
+		require.NoError(t, err)
+		assert.Equal(t, expected, content)
+	}
+}
+
+func TestDecodeUnknownType(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, NewEncoder(buf)(Execute{ID: 1}))
+
+	_, err := NewDecoder(buf, []interface{}{Stdin{}})()
+	require.Error(t, err)
+}